@@ -0,0 +1,239 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const (
+	// apiKeyPrefix starts every API key, so that leaked keys are easy to
+	// recognize, e.g. by secret scanners
+	apiKeyPrefix   = "gwk_"
+	apiKeyIDLength = 8
+	// apiKeyLastUsedInterval is how often the last use of a key is recorded
+	apiKeyLastUsedInterval = time.Minute
+)
+
+// ScopeAll is granted to sessions, which can do anything the user can
+const ScopeAll = "*"
+
+var (
+	errInvalidAPIKey = errors.New("invalid API key")
+	apiKeyIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+type (
+	// APIKey is a long-lived credential for scripts and integrations,
+	// acting for its user within its scopes. Only its hash is stored; its
+	// prefix identifies it.
+	APIKey struct {
+		core.BaseModel
+
+		User       *SessionUser `json:"-" gorm:"foreignKey:UserID"`
+		UserID     uint         `json:"user_id" gorm:"not null;index"`
+		Name       string       `json:"name" gorm:"not null"`
+		Prefix     string       `json:"prefix" gorm:"uniqueIndex;not null"`
+		KeyHash    string       `json:"-" gorm:"not null"`
+		Scopes     string       `json:"-" gorm:"not null"` // space separated
+		ExpiresAt  *time.Time   `json:"expires_at"`
+		LastUsedAt *time.Time   `json:"last_used_at"`
+		LastUsedIP string       `json:"last_used_ip"`
+		RevokedAt  *time.Time   `json:"revoked_at"`
+	}
+
+	// APIKeyInfo describes an API key. Key is only set when it is created.
+	APIKeyInfo struct {
+		*APIKey
+		ScopeList []string `json:"scopes"`
+		Key       string   `json:"key,omitempty"`
+	}
+
+	CreateAPIKeyRequest struct {
+		Name      string     `json:"name" binding:"required,max=100"`
+		Scopes    []string   `json:"scopes" binding:"required,min=1,dive,required,max=100,excludesall= "`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+)
+
+// CreateAPIKeyHandler creates an API key. The key is only returned once.
+func (sessMgr *SessionManager) CreateAPIKeyHandler(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		core.AbortWithError(c, core.ErrInvalidField{Field: "expires_at", Message: "must be in the future"})
+		return
+	}
+
+	userID := sessMgr.GetUserID(c)
+	key, prefix, err := generateAPIKey()
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to generate API key", err))
+		return
+	}
+	apiKey := &APIKey{
+		UserID:    userID,
+		Name:      req.Name,
+		Prefix:    prefix,
+		KeyHash:   hashToken(key),
+		Scopes:    strings.Join(req.Scopes, " "),
+		ExpiresAt: req.ExpiresAt,
+	}
+	apiKey.OwnedBy = ownerID(userID)
+	if err := sessMgr.db.Create(apiKey).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to create API key", err))
+		return
+	}
+
+	info := newAPIKeyInfo(apiKey)
+	info.Key = key
+	c.JSON(http.StatusCreated, info)
+}
+
+// GetAPIKeysHandler lists the user's API keys that aren't revoked
+func (sessMgr *SessionManager) GetAPIKeysHandler(c *gin.Context) {
+	var apiKeys []*APIKey
+	err := sessMgr.db.Where("user_id = ? AND revoked_at IS NULL", sessMgr.GetUserID(c)).
+		Order("created_at").
+		Find(&apiKeys).Error
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch API keys", err))
+		return
+	}
+
+	infos := make([]APIKeyInfo, len(apiKeys))
+	for idx, apiKey := range apiKeys {
+		infos[idx] = newAPIKeyInfo(apiKey)
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": infos})
+}
+
+// RevokeAPIKeyHandler revokes one of the user's API keys
+func (sessMgr *SessionManager) RevokeAPIKeyHandler(c *gin.Context) {
+	apiKeyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid API key ID"))
+		return
+	}
+
+	result := sessMgr.db.Model(&APIKey{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL", apiKeyID, sessMgr.GetUserID(c)).
+		UpdateColumn("revoked_at", time.Now())
+	if result.Error != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke API key", result.Error))
+		return
+	}
+	if result.RowsAffected == 0 {
+		core.AbortWithError(c, core.NotFound("API key not found"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetScopes returns the scopes granted to the request's credential:
+// ScopeAll for sessions, the key's scopes for API keys
+func (sessMgr *SessionManager) GetScopes(c *gin.Context) []string {
+	return c.GetStringSlice(scopesKey)
+}
+
+// HasScope reports whether the request's credential was granted scope
+func (sessMgr *SessionManager) HasScope(c *gin.Context, scope string) bool {
+	for _, granted := range sessMgr.GetScopes(c) {
+		if granted == ScopeAll || granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope only lets credentials granted scope through. It must run
+// after AuthMiddleware.
+func (sessMgr *SessionManager) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !sessMgr.HasScope(c, scope) {
+			core.AbortWithError(c, core.Forbidden("The API key lacks the "+scope+" scope"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkAPIKey returns the active API key, with its user, and records its use
+func (sessMgr *SessionManager) checkAPIKey(key, clientIP string) (apiKey *APIKey, err error) {
+	prefix, ok := apiKeyPrefixOf(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+
+	apiKey = &APIKey{}
+	err = sessMgr.db.Preload("User").Where("prefix = ?", prefix).First(apiKey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if subtle.ConstantTimeCompare([]byte(apiKey.KeyHash), []byte(hashToken(key))) != 1 ||
+		apiKey.RevokedAt != nil ||
+		(apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt)) ||
+		apiKey.User == nil {
+		return nil, errInvalidAPIKey
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyLastUsedInterval || apiKey.LastUsedIP != clientIP {
+		err = sessMgr.db.Model(&APIKey{}).Where("id = ?", apiKey.ID).UpdateColumns(map[string]interface{}{
+			"last_used_at": now,
+			"last_used_ip": clientIP,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return apiKey, nil
+}
+
+// scopeList returns the key's scopes
+func (apiKey *APIKey) scopeList() []string {
+	return strings.Fields(apiKey.Scopes)
+}
+
+func newAPIKeyInfo(apiKey *APIKey) APIKeyInfo {
+	return APIKeyInfo{APIKey: apiKey, ScopeList: apiKey.scopeList()}
+}
+
+// generateAPIKey returns a new key, gwk_<id>_<secret>, and its prefix
+// gwk_<id>
+func generateAPIKey() (key, prefix string, err error) {
+	id := make([]byte, 5)
+	if _, err = rand.Read(id); err != nil {
+		return
+	}
+	secret, err := generateOpaqueToken()
+	if err != nil {
+		return
+	}
+	prefix = apiKeyPrefix + apiKeyIDEncoding.EncodeToString(id)
+	return prefix + "_" + secret, prefix, nil
+}
+
+// apiKeyPrefixOf returns the prefix identifying key
+func apiKeyPrefixOf(key string) (string, bool) {
+	length := len(apiKeyPrefix) + apiKeyIDLength
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) <= length+1 || key[length] != '_' {
+		return "", false
+	}
+	return key[:length], true
+}
@@ -0,0 +1,85 @@
+package authentication
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIKeys(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+	router.GET("/reports", sessMgr.AuthMiddleware, sessMgr.RequireScope("reports:read"), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": sessMgr.GetUserID(c), "scopes": sessMgr.GetScopes(c)})
+	})
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+
+	request := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	createKey := func(body string) APIKeyInfo {
+		w := request(session.Token, http.MethodPost, "/api-keys", body)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var info APIKeyInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		return info
+	}
+
+	assert.Equal(t, http.StatusBadRequest, request(session.Token, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": []}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(session.Token, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": ["a b"]}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(session.Token, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": ["reports:read"], "expires_at": "2000-01-01T00:00:00Z"}`).Code)
+
+	info := createKey(`{"name": "CI", "scopes": ["reports:read", "reports:write"]}`)
+	assert.True(t, strings.HasPrefix(info.Key, info.Prefix+"_"))
+	assert.Equal(t, []string{"reports:read", "reports:write"}, info.ScopeList)
+
+	// The key authenticates as the user, within its scopes
+	w := request(info.Key, http.MethodGet, "/reports", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"user_id": %d, "scopes": ["reports:read", "reports:write"]}`, user.ID), w.Body.String())
+	narrow := createKey(`{"name": "Billing", "scopes": ["billing:read"]}`)
+	assert.Equal(t, http.StatusForbidden, request(narrow.Key, http.MethodGet, "/reports", "").Code)
+	assert.Equal(t, http.StatusOK, request(session.Token, http.MethodGet, "/reports", "").Code)
+
+	// Keys can't manage the account
+	assert.Equal(t, http.StatusForbidden, request(info.Key, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": ["*"]}`).Code)
+
+	// Only the hash is stored and the key is only shown once
+	var stored APIKey
+	sessMgr.db.First(&stored, info.ID)
+	assert.Equal(t, hashToken(info.Key), stored.KeyHash)
+	assert.NotNil(t, stored.LastUsedAt)
+	w = request(session.Token, http.MethodGet, "/api-keys", "")
+	assert.Contains(t, w.Body.String(), info.Prefix)
+	assert.NotContains(t, w.Body.String(), info.Key)
+
+	// Tampered, revoked and expired keys are rejected
+	assert.Equal(t, http.StatusUnauthorized, request(info.Key+"x", http.MethodGet, "/reports", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(apiKeyPrefix+"garbage", http.MethodGet, "/reports", "").Code)
+	assert.Equal(t, http.StatusNoContent, request(session.Token, http.MethodDelete, fmt.Sprintf("/api-keys/%d", info.ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, request(session.Token, http.MethodDelete, fmt.Sprintf("/api-keys/%d", info.ID), "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(info.Key, http.MethodGet, "/reports", "").Code)
+
+	expiring := createKey(fmt.Sprintf(`{"name": "Temp", "scopes": ["reports:read"], "expires_at": %q}`, time.Now().Add(time.Hour).Format(time.RFC3339)))
+	assert.Equal(t, http.StatusOK, request(expiring.Key, http.MethodGet, "/reports", "").Code)
+	sessMgr.db.Model(&APIKey{}).Where("id = ?", expiring.ID).UpdateColumn("expires_at", time.Now().Add(-time.Minute))
+	assert.Equal(t, http.StatusUnauthorized, request(expiring.Key, http.MethodGet, "/reports", "").Code)
+}
@@ -0,0 +1,131 @@
+package authentication
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// cborMaxDepth bounds the nesting of decoded CBOR items
+const cborMaxDepth = 16
+
+var errInvalidCBOR = errors.New("invalid CBOR")
+
+// decodeCBOR decodes the first CBOR (RFC 8949) item of data and returns the
+// bytes following it. It supports the subset WebAuthn uses: integers as
+// int64, byte and text strings, arrays as []interface{}, maps as
+// map[interface{}]interface{}, booleans and null. Indefinite lengths,
+// floats and tags are rejected.
+func decodeCBOR(data []byte) (value interface{}, rest []byte, err error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (value interface{}, rest []byte, err error) {
+	if depth > cborMaxDepth || len(data) == 0 {
+		return nil, nil, errInvalidCBOR
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	// Simple values carry no argument
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22:
+			return nil, data, nil
+		}
+		return nil, nil, errInvalidCBOR
+	}
+
+	arg, data, err := cborArgument(info, data)
+	if err != nil {
+		return
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return int64(arg), data, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errInvalidCBOR
+		}
+		return -1 - int64(arg), data, nil
+	case 2, 3:
+		if arg > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		if major == 3 {
+			return string(data[:arg]), data[arg:], nil
+		}
+		return data[:arg:arg], data[arg:], nil
+	case 4:
+		// Every item takes at least a byte
+		if arg > uint64(len(data)) {
+			return nil, nil, errInvalidCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for idx := uint64(0); idx < arg; idx++ {
+			var item interface{}
+			if item, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+	case 5:
+		if arg > uint64(len(data))/2 {
+			return nil, nil, errInvalidCBOR
+		}
+		items := make(map[interface{}]interface{}, arg)
+		for idx := uint64(0); idx < arg; idx++ {
+			var key, item interface{}
+			if key, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errInvalidCBOR
+			}
+			if item, data, err = decodeCBORItem(data, depth+1); err != nil {
+				return
+			}
+			items[key] = item
+		}
+		return items, data, nil
+	}
+	return nil, nil, errInvalidCBOR
+}
+
+// cborArgument reads the argument following an initial byte with the
+// additional information info
+func cborArgument(info byte, data []byte) (arg uint64, rest []byte, err error) {
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info > 27:
+		return 0, nil, errInvalidCBOR
+	}
+
+	size := 1 << (info - 24)
+	if len(data) < size {
+		return 0, nil, errInvalidCBOR
+	}
+	switch size {
+	case 1:
+		arg = uint64(data[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(data))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(data))
+	case 8:
+		arg = binary.BigEndian.Uint64(data)
+	}
+	return arg, data[size:], nil
+}
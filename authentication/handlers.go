@@ -2,34 +2,49 @@ package authentication
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
 	"gorm.io/gorm"
 )
 
 type (
 	LoginRequest struct {
 		Email    string `json:"email" binding:"required,email"`
-		Password string `json:"password" binding:"required,min=6"`
+		Password string `json:"password" binding:"required"`
 	}
 
+	// LoginResponse carries the new session, or an MFA challenge token to
+	// exchange at POST /login/mfa when the user enabled MFA
 	LoginResponse struct {
-		User    *SessionUser `json:"user"`
-		Session *Session     `json:"session"`
+		User        *SessionUser `json:"user,omitempty"`
+		Session     *Session     `json:"session,omitempty"`
+		MFARequired bool         `json:"mfa_required,omitempty"`
+		MFAToken    string       `json:"mfa_token,omitempty"`
 	}
 
+	// RegisterRequest's password must satisfy the PasswordPolicy
 	RegisterRequest struct {
 		Email    string `json:"email" binding:"required,email"`
-		Password string `json:"password" binding:"required,min=6"`
+		Password string `json:"password" binding:"required"`
 	}
 )
 
-// LoginHandler handles user authentication and creates a new session
+// LoginHandler handles user authentication and creates a new session.
+// Failed logins delay the next ones and then lock the account, see
+// LoginThrottle.
 func (sessMgr *SessionManager) LoginHandler(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		core.AbortWithError(c, err)
+		return
+	}
+
+	if err := sessMgr.checkIPThrottle(c.ClientIP()); err != nil {
+		sessMgr.recordLoginAttempt(c, req.Email, 0, loginIPThrottled)
+		core.AbortWithError(c, err)
 		return
 	}
 
@@ -38,29 +53,82 @@ func (sessMgr *SessionManager) LoginHandler(c *gin.Context) {
 	err := sessMgr.db.Where("email = ?", req.Email).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+			sessMgr.recordLoginAttempt(c, req.Email, 0, loginUnknownEmail)
+			core.AbortWithError(c, core.Unauthorized("Invalid email or password"))
 			return
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		core.AbortWithError(c, core.Internal("Failed to find user", err))
+		return
+	}
+
+	if err := sessMgr.checkLocked(c, &user); err != nil {
+		sessMgr.recordLoginAttempt(c, req.Email, user.ID, loginLocked)
+		core.AbortWithError(c, err)
 		return
 	}
 
 	// Verify password
 	if err := user.ComparePassword(req.Password); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		sessMgr.recordLoginAttempt(c, req.Email, user.ID, loginInvalidPassword)
+		if err := sessMgr.failLogin(c, &user); err != nil {
+			core.AbortWithError(c, core.Internal("Failed to record failed login", err))
+			return
+		}
+		core.AbortWithError(c, core.Unauthorized("Invalid email or password"))
+		return
+	}
+
+	sessMgr.completeLogin(c, &user, false)
+}
+
+// completeLogin starts a session for a user who proved their identity, with
+// a password, a passkey or an identity provider, and records the login.
+// Locked accounts are refused. When the proof wasn't multi-factor and the
+// user enabled MFA, it responds with a challenge to complete with their
+// second factor instead.
+func (sessMgr *SessionManager) completeLogin(c *gin.Context, user *SessionUser, multiFactor bool) {
+	if err := sessMgr.checkLocked(c, user); err != nil {
+		sessMgr.recordLoginAttempt(c, user.Email, user.ID, loginLocked)
+		core.AbortWithError(c, err)
+		return
+	}
+	sessMgr.recordLoginAttempt(c, user.Email, user.ID, "")
+
+	if sessMgr.requireVerifiedEmail && !user.IsEmailVerified() {
+		core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeEmailNotVerified, "Email address is not verified"))
+		return
+	}
+
+	if !multiFactor && user.IsMFAEnabled() {
+		token, err := issueUserToken(sessMgr.db, user.ID, purposeMFAChallenge, mfaChallengeDuration)
+		if err != nil {
+			core.AbortWithError(c, core.Internal("Failed to create MFA challenge", err))
+			return
+		}
+		c.JSON(http.StatusOK, LoginResponse{MFARequired: true, MFAToken: token})
 		return
 	}
 
-	// Create new session
-	session, err := NewSession(sessMgr.secretKey, &user, c.ClientIP(), c.Request.UserAgent())
+	sessMgr.startSession(c, user, multiFactor)
+}
+
+// startSession creates a new session for the user and responds with it.
+// The user's failed logins are only cleared here, once every factor passed.
+func (sessMgr *SessionManager) startSession(c *gin.Context, user *SessionUser, mfa bool) {
+	if err := sessMgr.clearFailedLogins(user); err != nil {
+		core.AbortWithError(c, core.Internal("Failed to reset failed logins", err))
+		return
+	}
+
+	session, err := newSession(sessMgr.keyring, user, mfa, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session token"})
+		core.AbortWithError(c, core.Internal("Failed to create session token", err))
 		return
 	}
 
 	// Save session to database
 	if err := sessMgr.db.Create(session).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		core.AbortWithError(c, core.Internal("Failed to create session", err))
 		return
 	}
 
@@ -68,34 +136,43 @@ func (sessMgr *SessionManager) LoginHandler(c *gin.Context) {
 	user.Password = ""
 
 	c.JSON(http.StatusOK, LoginResponse{
-		User:    &user,
+		User:    user,
 		Session: session,
 	})
 }
 
-// LogoutHandler invalidates the current session
+// LogoutHandler invalidates the current session. The user's sessions on
+// other devices stay active.
 func (sessMgr *SessionManager) LogoutHandler(c *gin.Context) {
 	userID := sessMgr.GetUserID(c)
-	if userID == 0 {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+	tokenID := c.GetString(tokenIDKey)
+	if userID == 0 || tokenID == "" {
+		core.AbortWithError(c, core.Unauthorized("Not authenticated"))
 		return
 	}
 
-	// Delete the current session
-	err := sessMgr.db.Where("user_id = ?", userID).Delete(&Session{}).Error
+	// Revoke the current session
+	err := sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ? AND token_id = ?", userID, tokenID)
+	}, revokedLoggedOut)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to logout"})
+		core.AbortWithError(c, core.Internal("Failed to logout", err))
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Successfully logged out"})
 }
 
-// RegisterHandler creates a new user account
+// RegisterHandler creates a new user account and mails them a token to
+// verify their email
 func (sessMgr *SessionManager) RegisterHandler(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		core.AbortWithError(c, err)
+		return
+	}
+	if err := sessMgr.passwordPolicy.Validate("password", req.Password, req.Email); err != nil {
+		core.AbortWithError(c, err)
 		return
 	}
 
@@ -103,10 +180,10 @@ func (sessMgr *SessionManager) RegisterHandler(c *gin.Context) {
 	var existingUser SessionUser
 	err := sessMgr.db.Where("email = ?", req.Email).First(&existingUser).Error
 	if err == nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "Email already registered"})
+		core.AbortWithError(c, core.Conflict("Email already registered"))
 		return
 	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check email"})
+		core.AbortWithError(c, core.Internal("Failed to check email", err))
 		return
 	}
 
@@ -116,10 +193,16 @@ func (sessMgr *SessionManager) RegisterHandler(c *gin.Context) {
 		Password: req.Password,
 	}
 	if err := sessMgr.db.Create(user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		core.AbortWithError(c, err)
 		return
 	}
 
+	// A failed email doesn't fail the registration, the user can ask for
+	// another one
+	if err := sessMgr.sendVerificationEmail(c, user); err != nil {
+		_ = c.Error(fmt.Errorf("failed to send verification email: %w", err))
+	}
+
 	// Clear password from response
 	user.Password = ""
 
@@ -2,12 +2,14 @@ package authentication
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -19,9 +21,12 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
-	// Auto migrate the schema
-	err = db.AutoMigrate(&SessionUser{}, &Session{})
-	if err != nil {
+	// Apply the plugin's migrations
+	migrator := core.NewMigrator(db)
+	if err = migrator.Register(PluginName, (&SessionManager{}).Migrations()...); err != nil {
+		t.Fatalf("Failed to register migrations: %v", err)
+	}
+	if err = migrator.Up(context.Background()); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
 
@@ -85,6 +90,12 @@ func TestRegister(t *testing.T) {
 			sessMgr.RegisterHandler(c)
 
 			assert.Equal(t, tt.expectedCode, w.Code)
+
+			if tt.expectedCode == http.StatusCreated {
+				var user SessionUser
+				assert.NoError(t, db.Where("email = ?", tt.requestBody["email"]).First(&user).Error)
+				assert.Equal(t, ownerID(user.ID), user.OwnedBy)
+			}
 		})
 	}
 }
@@ -171,12 +182,19 @@ func TestLogout(t *testing.T) {
 	}
 	db.Create(testUser)
 
-	session, err := NewSession(sessMgr.secretKey, testUser, "127.0.0.1", "test-agent")
+	session, err := NewSession(sessMgr.keyring, testUser, "127.0.0.1", "test-agent")
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
 	db.Create(session)
 
+	// A session on another device
+	otherSession, err := NewSession(sessMgr.keyring, testUser, "127.0.0.2", "other-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	db.Create(otherSession)
+
 	tests := []struct {
 		name         string
 		setupAuth    func(*gin.Context)
@@ -186,6 +204,7 @@ func TestLogout(t *testing.T) {
 			name: "successful logout",
 			setupAuth: func(c *gin.Context) {
 				c.Set(userKey, testUser.ID)
+				c.Set(tokenIDKey, session.TokenID)
 			},
 			expectedCode: http.StatusOK,
 		},
@@ -208,9 +227,11 @@ func TestLogout(t *testing.T) {
 			assert.Equal(t, tt.expectedCode, w.Code)
 
 			if tt.expectedCode == http.StatusOK {
-				var count int64
-				db.Model(&Session{}).Where("user_id = ?", testUser.ID).Count(&count)
-				assert.Equal(t, int64(0), count)
+				var current, other Session
+				db.First(&current, session.ID)
+				db.First(&other, otherSession.ID)
+				assert.True(t, current.IsRevoked())
+				assert.False(t, other.IsRevoked())
 			}
 		})
 	}
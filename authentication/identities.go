@@ -0,0 +1,350 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const oidcStateDuration = time.Minute * 10
+
+// CodeIdentityProviderError is the error code of logins failing because of
+// the identity provider
+const CodeIdentityProviderError = "identity_provider_error"
+
+var errInvalidOIDCState = errors.New("invalid or expired OIDC state")
+
+type (
+	// UserIdentity links a user to their account at an identity provider
+	UserIdentity struct {
+		core.BaseModel
+
+		UserID   uint   `json:"user_id" gorm:"not null;index"`
+		Provider string `json:"provider" gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+		Subject  string `json:"subject" gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+		Email    string `json:"email"`
+	}
+
+	// OIDCState is a login started at an identity provider. It is deleted
+	// once the login finishes.
+	OIDCState struct {
+		core.BaseModel
+
+		Provider     string    `gorm:"not null"`
+		StateHash    string    `gorm:"uniqueIndex;not null"`
+		Nonce        string    `gorm:"not null"`
+		CodeVerifier string    `gorm:"not null"`
+		UserID       uint      // the user linking the identity, 0 for logins
+		ExpiresAt    time.Time `gorm:"not null"`
+	}
+
+	OIDCBeginResponse struct {
+		AuthorizationURL string `json:"authorization_url"`
+		State            string `json:"state"`
+	}
+
+	// OIDCFinishRequest carries the code and state the provider redirected
+	// the user back with
+	OIDCFinishRequest struct {
+		Code  string `json:"code" binding:"required"`
+		State string `json:"state" binding:"required"`
+	}
+)
+
+func (OIDCState) TableName() string { return "oidc_states" }
+
+// BeginOIDCLoginHandler returns the URL to send the user to for logging in
+// with an identity provider. Clients keep the state to check it against
+// the one the provider redirects back with.
+func (sessMgr *SessionManager) BeginOIDCLoginHandler(c *gin.Context) {
+	sessMgr.beginOIDC(c, 0)
+}
+
+// FinishOIDCLoginHandler logs the user in with the code the identity
+// provider redirected them back with. New identities are linked to the user
+// with the same email, when both the provider and the user verified it, or
+// to a new user.
+func (sessMgr *SessionManager) FinishOIDCLoginHandler(c *gin.Context) {
+	claims, ok := sessMgr.finishOIDC(c, 0)
+	if !ok {
+		return
+	}
+
+	var user SessionUser
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		return sessMgr.identityUser(tx, c.Param("provider"), claims, &user)
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	sessMgr.completeLogin(c, &user, false)
+}
+
+// BeginOIDCLinkHandler returns the URL to send the user to for linking
+// their account at an identity provider
+func (sessMgr *SessionManager) BeginOIDCLinkHandler(c *gin.Context) {
+	sessMgr.beginOIDC(c, sessMgr.GetUserID(c))
+}
+
+// FinishOIDCLinkHandler links the identity the provider redirected the user
+// back with to their account
+func (sessMgr *SessionManager) FinishOIDCLinkHandler(c *gin.Context) {
+	userID := sessMgr.GetUserID(c)
+	claims, ok := sessMgr.finishOIDC(c, userID)
+	if !ok {
+		return
+	}
+
+	provider := c.Param("provider")
+	identity, err := findIdentity(sessMgr.db, provider, claims.Subject)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to find identity", err))
+		return
+	}
+	if identity != nil {
+		if identity.UserID != userID {
+			core.AbortWithError(c, core.Conflict("This identity is linked to another account"))
+			return
+		}
+		c.JSON(http.StatusOK, identity)
+		return
+	}
+
+	if identity, err = linkIdentity(sessMgr.db, userID, provider, claims); err != nil {
+		core.AbortWithError(c, core.Internal("Failed to link identity", err))
+		return
+	}
+	c.JSON(http.StatusCreated, identity)
+}
+
+// GetIdentitiesHandler lists the identities linked to the user
+func (sessMgr *SessionManager) GetIdentitiesHandler(c *gin.Context) {
+	var identities []UserIdentity
+	err := sessMgr.db.Where("user_id = ?", sessMgr.GetUserID(c)).Order("created_at").Find(&identities).Error
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch identities", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// UnlinkIdentityHandler unlinks one of the user's identities
+func (sessMgr *SessionManager) UnlinkIdentityHandler(c *gin.Context) {
+	identityID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid identity ID"))
+		return
+	}
+
+	// Identities are deleted for good, so that they can be linked again
+	result := sessMgr.db.Unscoped().Where("id = ? AND user_id = ?", identityID, sessMgr.GetUserID(c)).Delete(&UserIdentity{})
+	if result.Error != nil {
+		core.AbortWithError(c, core.Internal("Failed to unlink identity", result.Error))
+		return
+	}
+	if result.RowsAffected == 0 {
+		core.AbortWithError(c, core.NotFound("identity not found"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// oidcProvider returns the client of the provider in the URL, aborting
+// when it isn't configured
+func (sessMgr *SessionManager) oidcProvider(c *gin.Context) (*oidcClient, bool) {
+	client, ok := sessMgr.oidcProviders[c.Param("provider")]
+	if !ok {
+		core.AbortWithError(c, core.NotFound("identity provider not found"))
+	}
+	return client, ok
+}
+
+// beginOIDC saves the state, nonce and PKCE verifier of a new login and
+// responds with the provider's authorization URL
+func (sessMgr *SessionManager) beginOIDC(c *gin.Context, userID uint) {
+	client, ok := sessMgr.oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	var values [3]string
+	for idx := range values {
+		value, err := generateOpaqueToken()
+		if err != nil {
+			core.AbortWithError(c, core.Internal("Failed to start login", err))
+			return
+		}
+		values[idx] = value
+	}
+	state, nonce, codeVerifier := values[0], values[1], values[2]
+
+	authURL, err := client.authorizationURL(c.Request.Context(), state, nonce, codeVerifier)
+	if err != nil {
+		core.AbortWithError(c, identityProviderError("Identity provider unavailable", err))
+		return
+	}
+
+	oidcState := &OIDCState{
+		Provider:     client.provider.Name,
+		StateHash:    hashToken(state),
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		UserID:       userID,
+		ExpiresAt:    time.Now().Add(oidcStateDuration),
+	}
+	if err := sessMgr.db.Create(oidcState).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to start login", err))
+		return
+	}
+	// Drop the logins that were never finished
+	if err := sessMgr.db.Unscoped().Where("expires_at < ?", time.Now()).Delete(&OIDCState{}).Error; err != nil {
+		_ = c.Error(fmt.Errorf("failed to delete expired OIDC states: %w", err))
+	}
+
+	c.JSON(http.StatusOK, OIDCBeginResponse{AuthorizationURL: authURL, State: state})
+}
+
+// finishOIDC consumes the state of a login started by userID, redeems the
+// code and verifies the ID token
+func (sessMgr *SessionManager) finishOIDC(c *gin.Context, userID uint) (claims *idTokenClaims, ok bool) {
+	var req OIDCFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	client, ok := sessMgr.oidcProvider(c)
+	if !ok {
+		return
+	}
+
+	oidcState, err := consumeOIDCState(sessMgr.db, client.provider.Name, req.State)
+	if err == nil && oidcState.UserID != userID {
+		err = errInvalidOIDCState
+	}
+	if err != nil {
+		if errors.Is(err, errInvalidOIDCState) {
+			core.AbortWithError(c, core.BadRequest("Invalid or expired login state"))
+			return nil, false
+		}
+		core.AbortWithError(c, core.Internal("Failed to find login state", err))
+		return nil, false
+	}
+
+	idToken, err := client.exchange(c.Request.Context(), req.Code, oidcState.CodeVerifier)
+	if err == nil {
+		claims, err = client.verifyIDToken(c.Request.Context(), idToken, oidcState.Nonce)
+	}
+	if err != nil {
+		if errors.Is(err, errInvalidIDToken) {
+			core.AbortWithError(c, core.Unauthorized("Invalid ID token"))
+			return nil, false
+		}
+		core.AbortWithError(c, identityProviderError("Identity provider login failed", err))
+		return nil, false
+	}
+	return claims, true
+}
+
+// identityUser finds the user of an identity, linking new identities to the
+// user with the same email or to a new user
+func (sessMgr *SessionManager) identityUser(tx *gorm.DB, provider string, claims *idTokenClaims, user *SessionUser) error {
+	identity, err := findIdentity(tx, provider, claims.Subject)
+	if err != nil {
+		return core.Internal("Failed to find identity", err)
+	}
+	if identity != nil {
+		if err := tx.First(user, identity.UserID).Error; err != nil {
+			return core.Internal("Failed to find user", err)
+		}
+		return nil
+	}
+
+	// Emails are only trusted once verified by the provider
+	if claims.Email == "" || !claims.EmailVerified {
+		return core.Forbidden("The identity provider didn't share a verified email address")
+	}
+
+	err = tx.Where("email = ?", claims.Email).First(user).Error
+	switch {
+	case err == nil:
+		// Linking to an unverified account would hand it to whoever
+		// registered the email first
+		if !user.IsEmailVerified() {
+			return core.Conflict("An account with this email exists, log in to link the identity")
+		}
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		password, err := generateOpaqueToken()
+		if err != nil {
+			return core.Internal("Failed to create user", err)
+		}
+		now := time.Now()
+		*user = SessionUser{Email: claims.Email, Password: password, EmailVerifiedAt: &now}
+		if err := tx.Create(user).Error; err != nil {
+			return core.Internal("Failed to create user", err)
+		}
+	default:
+		return core.Internal("Failed to find user", err)
+	}
+
+	if _, err := linkIdentity(tx, user.ID, provider, claims); err != nil {
+		return core.Internal("Failed to link identity", err)
+	}
+	return nil
+}
+
+// consumeOIDCState deletes the login state and returns it. A state can only
+// be consumed once, even by concurrent requests.
+func consumeOIDCState(tx *gorm.DB, provider, state string) (oidcState *OIDCState, err error) {
+	oidcState = &OIDCState{}
+	err = tx.Where("state_hash = ? AND provider = ?", hashToken(state), provider).First(oidcState).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidOIDCState
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := tx.Unscoped().Where("id = ?", oidcState.ID).Delete(&OIDCState{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || time.Now().After(oidcState.ExpiresAt) {
+		return nil, errInvalidOIDCState
+	}
+	return
+}
+
+// identityProviderError returns a 502 error for a failing identity provider
+func identityProviderError(message string, cause error) *core.Error {
+	err := core.NewError(http.StatusBadGateway, CodeIdentityProviderError, message)
+	err.Err = cause
+	return err
+}
+
+// findIdentity returns the identity of the provider's subject, or nil
+func findIdentity(tx *gorm.DB, provider, subject string) (*UserIdentity, error) {
+	identity := &UserIdentity{}
+	err := tx.Where("provider = ? AND subject = ?", provider, subject).First(identity).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return identity, err
+}
+
+// linkIdentity links the provider's subject to the user
+func linkIdentity(tx *gorm.DB, userID uint, provider string, claims *idTokenClaims) (*UserIdentity, error) {
+	identity := &UserIdentity{
+		UserID:   userID,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+	identity.OwnedBy = ownerID(userID)
+	return identity, tx.Create(identity).Error
+}
@@ -1,6 +1,10 @@
 package authentication
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"time"
 
@@ -12,34 +16,87 @@ func (s *Session) createToken(expirationTime time.Duration) error {
 	if s.User == nil {
 		return errors.New("session user not set")
 	}
+	if s.Keyring == nil {
+		return errors.New("session keyring not set")
+	}
+
+	tokenID, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
 
 	claims := claims{
 		UserID: s.User.ID,
+		Admin:  s.User.IsAdmin,
+		MFA:    s.MFA,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expirationTime)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(s.SecretKey)
+	key := s.Keyring.activeKey()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	tokenString, err := token.SignedString(key.private)
 	if err != nil {
 		return err
 	}
 
 	s.Token = tokenString
+	s.TokenID = tokenID
 	s.ExpiresAt = time.Now().Add(expirationTime)
 	return nil
 }
 
+// createRefreshToken generates a new opaque refresh token for the session.
+// Only its hash is persisted.
+func (s *Session) createRefreshToken(expirationTime time.Duration) error {
+	refreshToken, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+
+	s.RefreshToken = refreshToken
+	s.RefreshTokenHash = hashToken(refreshToken)
+	s.RefreshExpiresAt = time.Now().Add(expirationTime)
+	return nil
+}
+
+// generateOpaqueToken returns a random URL-safe token
+func generateOpaqueToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken hashes an opaque token for storage and lookup. Opaque tokens
+// are random, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // parseToken validates and parses the JWT token
 func (s *Session) parseToken() (*claims, error) {
 	token, err := jwt.ParseWithClaims(s.Token, &claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		// Pick the key by kid. Tokens without one predate the keyring and
+		// the session IDs checked by AuthMiddleware, so they are refused.
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, errInvalidToken
+		}
+
+		// The algorithm is fixed by the key, never by the token
+		key, found := s.Keyring.verificationKey(kid)
+		if !found || key.Algorithm() != token.Method.Alg() {
 			return nil, errInvalidToken
 		}
-		return s.SecretKey, nil
+		return key.public, nil
 	})
 
 	if err != nil {
@@ -63,9 +120,9 @@ func (s *Session) validateToken() error {
 	return err
 }
 
-// UpdateLastUsed updates the last used timestamp and location information
-func (s *Session) UpdateLastUsed(ip, location string) {
+// UpdateLastUsed updates the last used timestamp, IP and user agent
+func (s *Session) UpdateLastUsed(ip, userAgent string) {
 	s.LastUsedAt = time.Now()
 	s.LastUsedIP = ip
-	s.LastUsedLoc = location
+	s.UserAgent = userAgent
 }
@@ -9,10 +9,11 @@ import (
 
 func TestCreateToken(t *testing.T) {
 	secretKey := []byte("test-secret-key")
+	keyring := NewKeyring(secretKey)
 	user := &SessionUser{Email: "test@example.com"}
 	user.ID = 123
 
-	session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+	session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
@@ -24,6 +25,7 @@ func TestCreateToken(t *testing.T) {
 
 func TestParseToken(t *testing.T) {
 	secretKey := []byte("test-secret-key")
+	keyring := NewKeyring(secretKey)
 	user := &SessionUser{Email: "test@example.com"}
 	user.ID = 123
 
@@ -35,14 +37,14 @@ func TestParseToken(t *testing.T) {
 		{
 			name: "valid token",
 			setupToken: func() (*Session, error) {
-				return NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				return NewSession(keyring, user, "127.0.0.1", "test-agent")
 			},
 			expectError: nil,
 		},
 		{
 			name: "expired token",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
@@ -56,6 +58,7 @@ func TestParseToken(t *testing.T) {
 					},
 				}
 				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = NewHMACKey(secretKey).ID()
 				tokenString, err := token.SignedString(secretKey)
 				if err != nil {
 					return nil, err
@@ -69,11 +72,11 @@ func TestParseToken(t *testing.T) {
 		{
 			name: "invalid secret",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession([]byte("wrong-secret"), user, "127.0.0.1", "test-agent")
+				session, err := NewSession(NewKeyring([]byte("wrong-secret")), user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
-				session.SecretKey = secretKey // Switch back to correct key for validation
+				session.Keyring = keyring // Switch back to correct key for validation
 				return session, nil
 			},
 			expectError: errInvalidToken,
@@ -81,7 +84,7 @@ func TestParseToken(t *testing.T) {
 		{
 			name: "malformed token",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
@@ -109,6 +112,7 @@ func TestParseToken(t *testing.T) {
 
 func TestValidateToken(t *testing.T) {
 	secretKey := []byte("test-secret-key")
+	keyring := NewKeyring(secretKey)
 	user := &SessionUser{Email: "test@example.com"}
 	user.ID = 123
 
@@ -120,14 +124,14 @@ func TestValidateToken(t *testing.T) {
 		{
 			name: "valid token",
 			setupToken: func() (*Session, error) {
-				return NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				return NewSession(keyring, user, "127.0.0.1", "test-agent")
 			},
 			expectError: nil,
 		},
 		{
 			name: "expired token",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
@@ -141,6 +145,7 @@ func TestValidateToken(t *testing.T) {
 					},
 				}
 				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = NewHMACKey(secretKey).ID()
 				tokenString, err := token.SignedString(secretKey)
 				if err != nil {
 					return nil, err
@@ -154,7 +159,7 @@ func TestValidateToken(t *testing.T) {
 		{
 			name: "invalid token",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
@@ -166,11 +171,11 @@ func TestValidateToken(t *testing.T) {
 		{
 			name: "wrong secret",
 			setupToken: func() (*Session, error) {
-				session, err := NewSession([]byte("wrong-secret"), user, "127.0.0.1", "test-agent")
+				session, err := NewSession(NewKeyring([]byte("wrong-secret")), user, "127.0.0.1", "test-agent")
 				if err != nil {
 					return nil, err
 				}
-				session.SecretKey = secretKey // Switch back to correct key for validation
+				session.Keyring = keyring // Switch back to correct key for validation
 				return session, nil
 			},
 			expectError: errInvalidToken,
@@ -194,24 +199,29 @@ func TestValidateToken(t *testing.T) {
 
 func TestUpdateLastUsed(t *testing.T) {
 	secretKey := []byte("test-secret-key")
+	keyring := NewKeyring(secretKey)
 	user := &SessionUser{Email: "test@example.com"}
 	user.ID = 123
 
-	session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+	session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 	if err != nil {
 		t.Fatalf("Failed to create session: %v", err)
 	}
 
 	ip := "192.168.1.1"
-	loc := "Mozilla/5.0"
-	session.UpdateLastUsed(ip, loc)
+	userAgent := "Mozilla/5.0"
+	session.UpdateLastUsed(ip, userAgent)
 
 	if session.LastUsedIP != ip {
 		t.Errorf("Expected LastUsedIP to be %s, got %s", ip, session.LastUsedIP)
 	}
 
-	if session.LastUsedLoc != loc {
-		t.Errorf("Expected LastUsedLoc to be %s, got %s", loc, session.LastUsedLoc)
+	if session.UserAgent != userAgent {
+		t.Errorf("Expected UserAgent to be %s, got %s", userAgent, session.UserAgent)
+	}
+
+	if session.LastUsedLoc != "" {
+		t.Errorf("Expected LastUsedLoc to stay empty, got %s", session.LastUsedLoc)
 	}
 
 	if session.LastUsedAt.IsZero() {
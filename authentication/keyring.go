@@ -0,0 +1,213 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+)
+
+var (
+	ErrUnknownSigningKey = errors.New("unknown signing key")
+	ErrActiveSigningKey  = errors.New("the active signing key can't be retired")
+)
+
+type (
+	// SigningKeyInfo describes a key of the keyring without its secret
+	SigningKeyInfo struct {
+		ID        string    `json:"kid"`
+		Algorithm string    `json:"alg"`
+		Active    bool      `json:"active"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+
+	// Keyring holds the keys used to sign and verify tokens. Tokens are
+	// signed with the active key and carry its ID in their kid header;
+	// older keys are kept to verify the tokens they signed until they are
+	// retired.
+	Keyring struct {
+		mu     sync.RWMutex
+		active string
+		keys   []*SigningKey
+	}
+)
+
+// NewKeyring returns a keyring signing with the active HMAC secret and
+// also verifying tokens signed with the previous secrets
+func NewKeyring(active []byte, previous ...[]byte) *Keyring {
+	previousKeys := make([]*SigningKey, len(previous))
+	for idx, secret := range previous {
+		previousKeys[idx] = NewHMACKey(secret)
+	}
+	keyring, _ := NewKeyringWithKeys(NewHMACKey(active), previousKeys...)
+	return keyring
+}
+
+// NewKeyringWithKeys returns a keyring signing with active and also
+// verifying tokens signed with the previous keys
+func NewKeyringWithKeys(active *SigningKey, previous ...*SigningKey) (keyring *Keyring, err error) {
+	if !active.CanSign() {
+		return nil, ErrVerificationOnly
+	}
+	keyring = &Keyring{}
+	for _, key := range previous {
+		keyring.add(key)
+	}
+	keyring.active = keyring.add(active).id
+	return
+}
+
+func (keyring *Keyring) add(key *SigningKey) *SigningKey {
+	if existing := keyring.find(key.id); existing != nil {
+		return existing
+	}
+	keyring.keys = append(keyring.keys, key)
+	return key
+}
+
+func (keyring *Keyring) find(id string) *SigningKey {
+	for _, key := range keyring.keys {
+		if key.id == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// Rotate makes the HMAC secret the active signing key. When secret is
+// empty a random key of the same type as the active key is generated.
+// The previous keys still verify their tokens.
+func (keyring *Keyring) Rotate(secret []byte) (id string, err error) {
+	var key *SigningKey
+	if len(secret) > 0 {
+		key = NewHMACKey(secret)
+	} else if key, err = generateLike(keyring.activeKey()); err != nil {
+		return
+	}
+	return keyring.RotateKey(key)
+}
+
+// RotateKey makes key the active signing key. The previous keys still
+// verify their tokens.
+func (keyring *Keyring) RotateKey(key *SigningKey) (id string, err error) {
+	if !key.CanSign() {
+		return "", ErrVerificationOnly
+	}
+
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	keyring.active = keyring.add(key).id
+	return keyring.active, nil
+}
+
+// Retire removes a verification key. Tokens it signed stop being valid.
+func (keyring *Keyring) Retire(id string) error {
+	keyring.mu.Lock()
+	defer keyring.mu.Unlock()
+
+	if id == keyring.active {
+		return ErrActiveSigningKey
+	}
+	for idx, key := range keyring.keys {
+		if key.id == id {
+			keyring.keys = append(keyring.keys[:idx], keyring.keys[idx+1:]...)
+			return nil
+		}
+	}
+	return ErrUnknownSigningKey
+}
+
+// Keys describes the keys of the keyring, oldest first
+func (keyring *Keyring) Keys() []SigningKeyInfo {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+
+	infos := make([]SigningKeyInfo, len(keyring.keys))
+	for idx, key := range keyring.keys {
+		infos[idx] = SigningKeyInfo{
+			ID:        key.id,
+			Algorithm: key.Algorithm(),
+			Active:    key.id == keyring.active,
+			CreatedAt: key.createdAt,
+		}
+	}
+	return infos
+}
+
+// JWKS returns the public keys of the asymmetric keys. HMAC secrets are
+// never published.
+func (keyring *Keyring) JWKS() JSONWebKeySet {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range keyring.keys {
+		if jwk, ok := key.jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// activeKey returns the key new tokens are signed with
+func (keyring *Keyring) activeKey() *SigningKey {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+
+	return keyring.find(keyring.active)
+}
+
+// verificationKey returns the key with the given ID
+func (keyring *Keyring) verificationKey(id string) (key *SigningKey, found bool) {
+	keyring.mu.RLock()
+	defer keyring.mu.RUnlock()
+
+	key = keyring.find(id)
+	return key, key != nil
+}
+
+// GetSigningKeysHandler lists the signing keys
+func (sessMgr *SessionManager) GetSigningKeysHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": sessMgr.keyring.Keys()})
+}
+
+// RotateSigningKeyHandler generates a new active signing key of the same
+// type as the current one. The key only lives in this process; deployments
+// running several instances rotate with Keyring.RotateKey and a shared key
+// instead.
+func (sessMgr *SessionManager) RotateSigningKeyHandler(c *gin.Context) {
+	id, err := sessMgr.keyring.Rotate(nil)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to rotate signing key", err))
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"kid": id})
+}
+
+// RetireSigningKeyHandler removes the :kid verification key
+func (sessMgr *SessionManager) RetireSigningKeyHandler(c *gin.Context) {
+	err := sessMgr.keyring.Retire(c.Param("kid"))
+	switch {
+	case errors.Is(err, ErrUnknownSigningKey):
+		core.AbortWithError(c, core.NotFound("signing key not found"))
+		return
+	case errors.Is(err, ErrActiveSigningKey):
+		core.AbortWithError(c, core.Conflict("The active signing key can't be retired"))
+		return
+	case err != nil:
+		core.AbortWithError(c, core.Internal("Failed to retire signing key", err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// JWKSHandler publishes the public signing keys so that other services
+// can verify tokens
+func (sessMgr *SessionManager) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, sessMgr.keyring.JWKS())
+}
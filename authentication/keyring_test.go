@@ -0,0 +1,114 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	keyring := NewKeyring([]byte("first-secret"))
+	user := &SessionUser{Email: "test@example.com"}
+	user.ID = 123
+
+	tokenKeyID := func(session *Session) string {
+		token, _, err := jwt.NewParser().ParseUnverified(session.Token, &claims{})
+		assert.NoError(t, err)
+		return token.Header["kid"].(string)
+	}
+
+	before, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	firstKeyID := tokenKeyID(before)
+	assert.Equal(t, NewHMACKey([]byte("first-secret")).ID(), firstKeyID)
+
+	// New tokens are signed with the new key, older ones still verify
+	secondKeyID, err := keyring.Rotate([]byte("second-secret"))
+	assert.NoError(t, err)
+	after, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	assert.Equal(t, secondKeyID, tokenKeyID(after))
+	assert.NoError(t, before.validateToken())
+	assert.NoError(t, after.validateToken())
+
+	// The active key can't be retired
+	assert.ErrorIs(t, keyring.Retire(secondKeyID), ErrActiveSigningKey)
+	assert.ErrorIs(t, keyring.Retire("unknown"), ErrUnknownSigningKey)
+
+	// Retiring the old key invalidates its tokens
+	assert.NoError(t, keyring.Retire(firstKeyID))
+	assert.Equal(t, errInvalidToken, before.validateToken())
+	assert.NoError(t, after.validateToken())
+
+	assert.Equal(t, []SigningKeyInfo{{ID: secondKeyID, Algorithm: "HS256", Active: true, CreatedAt: keyring.Keys()[0].CreatedAt}}, keyring.Keys())
+}
+
+func TestKeyringRejectsTokensWithoutKeyID(t *testing.T) {
+	keyring := NewKeyring([]byte("first-secret"))
+
+	// Tokens predating the keyring carry no kid and no session ID, so their
+	// sessions can't be checked
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{UserID: 123})
+	tokenString, err := token.SignedString([]byte("first-secret"))
+	assert.NoError(t, err)
+
+	session := &Session{Keyring: keyring, Token: tokenString}
+	assert.Equal(t, errInvalidToken, session.validateToken())
+}
+
+func TestSigningKeyHandlers(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	token := func(email string, isAdmin bool) string {
+		user := &SessionUser{Email: email, Password: "password123", IsAdmin: isAdmin}
+		sessMgr.db.Create(user)
+		session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		sessMgr.db.Create(session)
+		return session.Token
+	}
+	adminToken := token("admin@example.com", true)
+	userToken := token("user@example.com", false)
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", bearerSchema+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, request(http.MethodPost, "/admin/signing-keys/rotate", userToken).Code)
+
+	originalKeyID := sessMgr.keyring.Keys()[0].ID
+	w := request(http.MethodPost, "/admin/signing-keys/rotate", adminToken)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var rotated struct {
+		KeyID string `json:"kid"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &rotated))
+
+	w = request(http.MethodGet, "/admin/signing-keys", adminToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var listed struct {
+		Keys []SigningKeyInfo `json:"keys"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	assert.Len(t, listed.Keys, 2)
+	assert.Equal(t, rotated.KeyID, listed.Keys[1].ID)
+	assert.True(t, listed.Keys[1].Active)
+
+	// Tokens signed before the rotation keep working until their key is retired
+	assert.Equal(t, http.StatusConflict, request(http.MethodDelete, "/admin/signing-keys/"+rotated.KeyID, adminToken).Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/admin/signing-keys/"+originalKeyID, adminToken).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/admin/signing-keys", adminToken).Code)
+}
@@ -0,0 +1,348 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const (
+	unlockTokenDuration = time.Hour * 24
+	// maxLoginBackoff bounds the delay between failed logins when accounts
+	// aren't locked
+	maxLoginBackoff = time.Hour
+)
+
+// CodeAccountLocked is the error code of logins refused because of too many
+// failed logins in a row
+const CodeAccountLocked = "account_locked"
+
+// Permissions of the login attempt endpoints
+const (
+	PermissionUsersUnlock       = "users:unlock"
+	PermissionLoginAttemptsRead = "login_attempts:read"
+)
+
+// Reasons a login attempt failed
+const (
+	loginUnknownEmail    = "unknown_email"
+	loginInvalidPassword = "invalid_password"
+	loginInvalidMFACode  = "invalid_mfa_code"
+	loginLocked          = "locked"
+	loginIPThrottled     = "ip_throttled"
+)
+
+// maxLoginAttemptsPage bounds the login attempts listed at once
+const maxLoginAttemptsPage = 500
+
+type (
+	// LoginAttempt records a login, successful or not
+	LoginAttempt struct {
+		core.BaseModel
+
+		UserID    uint   `json:"user_id" gorm:"index"` // 0 for unknown emails
+		Email     string `json:"email" gorm:"not null;index"`
+		IP        string `json:"ip" gorm:"index"`
+		UserAgent string `json:"user_agent"`
+		Succeeded bool   `json:"succeeded" gorm:"not null;default:false"`
+		Reason    string `json:"reason,omitempty"` // why the login failed
+	}
+
+	// LoginThrottle protects password logins from brute force. Failed
+	// logins in a row delay the account's next login exponentially, and
+	// then lock it until it is unlocked. IPs failing too many logins, on any
+	// account, are refused for a while.
+	LoginThrottle struct {
+		// BackoffAfter failures in a row, logins wait BaseDelay, doubled
+		// by every further failure
+		BackoffAfter int
+		BaseDelay    time.Duration
+		// LockoutAfter failures in a row, the account is locked for
+		// LockoutDuration and the user is mailed an unlock link
+		LockoutAfter    int
+		LockoutDuration time.Duration
+		// IPMaxFailures failed logins from an IP within IPWindow refuse
+		// its logins
+		IPMaxFailures int
+		IPWindow      time.Duration
+	}
+
+	UnlockAccountRequest struct {
+		Token string `json:"token" binding:"required"`
+	}
+)
+
+// DefaultLoginThrottle delays logins after 3 failures in a row, locks
+// accounts for an hour after 10 and refuses IPs failing 100 logins in 15
+// minutes
+var DefaultLoginThrottle = LoginThrottle{
+	BackoffAfter:    3,
+	BaseDelay:       time.Second,
+	LockoutAfter:    10,
+	LockoutDuration: time.Hour,
+	IPMaxFailures:   100,
+	IPWindow:        time.Minute * 15,
+}
+
+// WithLoginThrottle replaces DefaultLoginThrottle. Zero thresholds disable
+// the corresponding protection.
+func WithLoginThrottle(throttle LoginThrottle) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.loginThrottle = throttle
+	}
+}
+
+// WithUnlockURL mails account unlock links to url, with the token in the
+// token query parameter, instead of the bare token
+func WithUnlockURL(url string) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.unlockURL = url
+	}
+}
+
+// UnlockAccountHandler unlocks the user's account with the token they were
+// mailed when it was locked
+func (sessMgr *SessionManager) UnlockAccountHandler(c *gin.Context) {
+	var req UnlockAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, purposeAccountUnlock, req.Token)
+		if err != nil {
+			return err
+		}
+		return unlockUser(tx, userToken.UserID)
+	})
+	switch {
+	case errors.Is(err, errInvalidUserToken):
+		core.AbortWithError(c, core.BadRequest("Invalid or already used unlock token"))
+		return
+	case errors.Is(err, errExpiredUserToken):
+		core.AbortWithError(c, core.BadRequest("Unlock token has expired"))
+		return
+	case err != nil:
+		core.AbortWithError(c, core.Internal("Failed to unlock account", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+}
+
+// AdminUnlockUserHandler unlocks a user's account
+func (sessMgr *SessionManager) AdminUnlockUserHandler(c *gin.Context) {
+	user, ok := sessMgr.paramUser(c)
+	if !ok {
+		return
+	}
+	if err := unlockUser(sessMgr.db, user.ID); err != nil {
+		core.AbortWithError(c, core.Internal("Failed to unlock account", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account unlocked"})
+}
+
+// GetLoginAttemptsHandler lists the latest login attempts, optionally
+// filtered by email, ip, user_id or succeeded. limit defaults to 100.
+func (sessMgr *SessionManager) GetLoginAttemptsHandler(c *gin.Context) {
+	query := sessMgr.db.Order("created_at DESC").Order("id DESC")
+	if email := c.Query("email"); email != "" {
+		query = query.Where("email = ?", email)
+	}
+	if ip := c.Query("ip"); ip != "" {
+		query = query.Where("ip = ?", ip)
+	}
+	if value := c.Query("user_id"); value != "" {
+		userID, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			core.AbortWithError(c, core.ErrInvalidField{Field: "user_id", Message: "must be a user ID"})
+			return
+		}
+		query = query.Where("user_id = ?", userID)
+	}
+	if value := c.Query("succeeded"); value != "" {
+		succeeded, err := strconv.ParseBool(value)
+		if err != nil {
+			core.AbortWithError(c, core.ErrInvalidField{Field: "succeeded", Message: "must be true or false"})
+			return
+		}
+		query = query.Where("succeeded = ?", succeeded)
+	}
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxLoginAttemptsPage {
+			core.AbortWithError(c, core.ErrInvalidField{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxLoginAttemptsPage)})
+			return
+		}
+	}
+
+	var attempts []LoginAttempt
+	if err := query.Limit(limit).Find(&attempts).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch login attempts", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"login_attempts": attempts})
+}
+
+// PruneLoginAttempts deletes the login attempts older than age. It can be
+// scheduled to bound the table's growth.
+func (sessMgr *SessionManager) PruneLoginAttempts(age time.Duration) (pruned int64, err error) {
+	result := sessMgr.db.Unscoped().Where("created_at < ?", time.Now().Add(-age)).Delete(&LoginAttempt{})
+	return result.RowsAffected, result.Error
+}
+
+// checkIPThrottle refuses logins from IPs that failed too many of them
+func (sessMgr *SessionManager) checkIPThrottle(ip string) error {
+	throttle := sessMgr.loginThrottle
+	if throttle.IPMaxFailures <= 0 {
+		return nil
+	}
+
+	since := time.Now().Add(-throttle.IPWindow)
+	var failures int64
+	err := sessMgr.db.Model(&LoginAttempt{}).
+		Where("ip = ? AND created_at > ? AND reason IN ?", ip, since, []string{loginUnknownEmail, loginInvalidPassword, loginInvalidMFACode}).
+		Count(&failures).Error
+	if err != nil {
+		return core.Internal("Failed to check login attempts", err)
+	}
+	if failures >= int64(throttle.IPMaxFailures) {
+		return core.TooManyRequests("Too many failed logins, try again later")
+	}
+	return nil
+}
+
+// checkLocked refuses logins to accounts locked by failed logins, telling
+// clients when to retry
+func (sessMgr *SessionManager) checkLocked(c *gin.Context, user *SessionUser) error {
+	if user.LockedUntil == nil || !time.Now().Before(*user.LockedUntil) {
+		return nil
+	}
+
+	retryAfter := int(math.Ceil(time.Until(*user.LockedUntil).Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	if sessMgr.loginThrottle.locks(user.FailedLogins) {
+		return core.NewError(http.StatusTooManyRequests, CodeAccountLocked, "Account locked after too many failed logins, use the emailed link to unlock it")
+	}
+	return core.TooManyRequests("Too many failed logins, try again later")
+}
+
+// failLogin counts a failed login, with a wrong password or second factor,
+// delaying the next one and locking the account after too many. The user is
+// mailed an unlock link when their account gets locked.
+func (sessMgr *SessionManager) failLogin(c *gin.Context, user *SessionUser) error {
+	var locked bool
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&SessionUser{}).Where("id = ?", user.ID).
+			UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&SessionUser{}).Where("id = ?", user.ID).Pluck("failed_logins", &user.FailedLogins).Error; err != nil {
+			return err
+		}
+
+		delay := sessMgr.loginThrottle.delay(user.FailedLogins)
+		if delay == 0 {
+			return nil
+		}
+		lockedUntil := time.Now().Add(delay)
+		user.LockedUntil = &lockedUntil
+		locked = sessMgr.loginThrottle.locks(user.FailedLogins)
+		return tx.Model(&SessionUser{}).Where("id = ?", user.ID).UpdateColumn("locked_until", lockedUntil).Error
+	})
+	if err != nil || !locked {
+		return err
+	}
+
+	// Users locked out again right away aren't mailed again, and a failed
+	// email doesn't fail the login: admins can unlock the account
+	err = sessMgr.mailUserTokenOnce(c, user, tokenEmail{
+		purpose:  purposeAccountUnlock,
+		duration: unlockTokenDuration,
+		url:      sessMgr.unlockURL,
+		subject:  "Your account was locked",
+		action:   "unlock your account after too many failed logins",
+	})
+	if err != nil {
+		_ = c.Error(fmt.Errorf("failed to send unlock email: %w", err))
+	}
+	return nil
+}
+
+// clearFailedLogins resets the failed logins of a user who logged in or
+// proved their second factor
+func (sessMgr *SessionManager) clearFailedLogins(user *SessionUser) error {
+	if user.FailedLogins == 0 && user.LockedUntil == nil {
+		return nil
+	}
+	if err := unlockUser(sessMgr.db, user.ID); err != nil {
+		return err
+	}
+	user.FailedLogins, user.LockedUntil = 0, nil
+	return nil
+}
+
+// recordLoginAttempt records a login or second factor check. Failing to record it
+// doesn't fail the login.
+func (sessMgr *SessionManager) recordLoginAttempt(c *gin.Context, email string, userID uint, reason string) {
+	attempt := &LoginAttempt{
+		UserID:    userID,
+		Email:     email,
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Succeeded: reason == "",
+		Reason:    reason,
+	}
+	if userID != 0 {
+		attempt.OwnedBy = ownerID(userID)
+	}
+	if err := sessMgr.db.Create(attempt).Error; err != nil {
+		_ = c.Error(fmt.Errorf("failed to record login attempt: %w", err))
+	}
+}
+
+// delay returns how long logins wait after failures in a row
+func (throttle LoginThrottle) delay(failures int) time.Duration {
+	switch {
+	case throttle.locks(failures):
+		return throttle.LockoutDuration
+	case throttle.BackoffAfter > 0 && failures >= throttle.BackoffAfter:
+		maxDelay := throttle.LockoutDuration
+		if maxDelay <= 0 {
+			maxDelay = maxLoginBackoff
+		}
+		delay := throttle.BaseDelay
+		for step := throttle.BackoffAfter; step < failures && delay < maxDelay; step++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		return delay
+	}
+	return 0
+}
+
+// locks reports whether failures in a row lock the account
+func (throttle LoginThrottle) locks(failures int) bool {
+	return throttle.LockoutAfter > 0 && failures >= throttle.LockoutAfter
+}
+
+// unlockUser clears the failed logins of a user
+func unlockUser(tx *gorm.DB, userID uint) error {
+	return tx.Model(&SessionUser{}).Where("id = ?", userID).UpdateColumns(map[string]interface{}{
+		"failed_logins": 0,
+		"locked_until":  nil,
+	}).Error
+}
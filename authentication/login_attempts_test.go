@@ -0,0 +1,167 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginThrottleDelay(t *testing.T) {
+	throttle := LoginThrottle{BackoffAfter: 3, BaseDelay: time.Second, LockoutAfter: 10, LockoutDuration: time.Minute}
+	for failures, delay := range map[int]time.Duration{
+		0: 0, 2: 0, 3: time.Second, 4: 2 * time.Second, 6: 8 * time.Second, 9: time.Minute, 10: time.Minute, 50: time.Minute,
+	} {
+		assert.Equal(t, delay, throttle.delay(failures), "%d failures", failures)
+	}
+
+	// Without lockouts the backoff is bounded
+	throttle.LockoutAfter, throttle.LockoutDuration = 0, 0
+	assert.False(t, throttle.locks(1000))
+	assert.Equal(t, maxLoginBackoff, throttle.delay(1000))
+}
+
+func TestLoginLockout(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	mailer := &recordingMailer{}
+	WithMailer(mailer)(sessMgr)
+	WithUnlockURL("https://app.example.com/unlock")(sessMgr)
+	WithLoginThrottle(LoginThrottle{BackoffAfter: 2, BaseDelay: time.Minute, LockoutAfter: 4, LockoutDuration: time.Hour})(sessMgr)
+	WithSuperadmin("root@example.com", "password123")(sessMgr)
+	assert.NoError(t, sessMgr.Init(context.Background(), nil))
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	login := func(password string) *httptest.ResponseRecorder {
+		return postJSON(router, "/login", map[string]string{"email": user.Email, "password": password})
+	}
+	// elapse lets the current delay pass
+	elapse := func() {
+		sessMgr.db.Model(&SessionUser{}).Where("id = ?", user.ID).UpdateColumn("locked_until", time.Now().Add(-time.Second))
+	}
+	lockedUntil := func() time.Duration {
+		var locked SessionUser
+		sessMgr.db.First(&locked, user.ID)
+		if locked.LockedUntil == nil {
+			return 0
+		}
+		return time.Until(*locked.LockedUntil).Round(time.Minute)
+	}
+
+	// Failures in a row delay the next login, even with the right password
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	assert.Equal(t, time.Duration(0), lockedUntil())
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	assert.Equal(t, time.Minute, lockedUntil())
+	w := login("password123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	elapse()
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	assert.Equal(t, 2*time.Minute, lockedUntil())
+	assert.Empty(t, mailer.messages)
+
+	// Then lock the account and mail an unlock link
+	elapse()
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	assert.Equal(t, time.Hour, lockedUntil())
+	w = login("password123")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), CodeAccountLocked)
+	assert.Equal(t, "Your account was locked", mailer.last().Subject)
+
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/unlock", map[string]string{"token": "invalid"}).Code)
+	token := mailer.lastLinkToken(t)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/unlock", map[string]string{"token": token}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/unlock", map[string]string{"token": token}).Code)
+	assert.Equal(t, http.StatusOK, login("password123").Code)
+
+	// Admins can unlock accounts too, and successful logins reset the count
+	for i := 0; i < 4; i++ {
+		elapse()
+		assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, login("password123").Code)
+
+	rootLogin := postJSON(router, "/login", map[string]string{"email": "root@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusOK, rootLogin.Code)
+	var response LoginResponse
+	assert.NoError(t, json.Unmarshal(rootLogin.Body.Bytes(), &response))
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", bearerSchema+response.Session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	assert.Equal(t, http.StatusOK, admin(http.MethodPost, fmt.Sprintf("/admin/users/%d/unlock", user.ID)).Code)
+	assert.Equal(t, http.StatusUnauthorized, login("wrong-password").Code)
+	assert.Equal(t, http.StatusOK, login("password123").Code)
+	var unlocked SessionUser
+	sessMgr.db.First(&unlocked, user.ID)
+	assert.Equal(t, 0, unlocked.FailedLogins)
+	assert.Nil(t, unlocked.LockedUntil)
+
+	// Every attempt is recorded
+	w = admin(http.MethodGet, "/admin/login-attempts?email=test@example.com&limit=3")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var attempts struct {
+		LoginAttempts []LoginAttempt `json:"login_attempts"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &attempts))
+	var reasons []string
+	for _, attempt := range attempts.LoginAttempts {
+		assert.Equal(t, user.ID, attempt.UserID)
+		reasons = append(reasons, attempt.Reason)
+	}
+	assert.Equal(t, []string{"", loginInvalidPassword, loginLocked}, reasons)
+	assert.True(t, attempts.LoginAttempts[0].Succeeded)
+
+	w = admin(http.MethodGet, "/admin/login-attempts?succeeded=false&user_id="+fmt.Sprint(user.ID))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &attempts))
+	assert.Len(t, attempts.LoginAttempts, 12)
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodGet, "/admin/login-attempts?limit=0").Code)
+
+	// Pruning drops the old attempts
+	pruned, err := sessMgr.PruneLoginAttempts(-time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), pruned)
+}
+
+func TestLoginIPThrottle(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	WithLoginThrottle(LoginThrottle{IPMaxFailures: 3, IPWindow: time.Minute})(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+	sessMgr.db.Create(&SessionUser{Email: "test@example.com", Password: "password123"})
+
+	login := func(ip, email string) int {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(fmt.Sprintf(`{"email": %q, "password": "password123"}`, email)))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Failures on any account count against the IP
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", fmt.Sprintf("user%d@example.com", i)))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, login("192.0.2.1", "test@example.com"))
+	assert.Equal(t, http.StatusOK, login("192.0.2.2", "test@example.com"))
+
+	// Until they leave the window
+	sessMgr.db.Model(&LoginAttempt{}).Where("ip = ?", "192.0.2.1").UpdateColumn("created_at", time.Now().Add(-time.Hour))
+	assert.Equal(t, http.StatusOK, login("192.0.2.1", "test@example.com"))
+}
@@ -0,0 +1,69 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoMailer is returned when sending emails without a mailer configured
+// with WithMailer
+var ErrNoMailer = errors.New("no mailer configured, see WithMailer")
+
+type (
+	// Message is an email sent to a user
+	Message struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	// Mailer delivers emails, e.g. through an SMTP server or an email API
+	Mailer interface {
+		Send(ctx context.Context, msg Message) error
+	}
+
+	// LogMailer writes emails to a logger instead of delivering them. It
+	// logs their tokens too, so it is only meant for local development.
+	LogMailer struct {
+		Logger *log.Logger
+	}
+
+	// FileMailer writes every email to its own file in Dir instead of
+	// delivering it
+	FileMailer struct {
+		Dir string
+
+		counter atomic.Uint64
+	}
+
+	// noMailer is the default mailer, refusing to send emails
+	noMailer struct{}
+)
+
+func (noMailer) Send(ctx context.Context, msg Message) error {
+	return ErrNoMailer
+}
+
+func (mailer *LogMailer) Send(ctx context.Context, msg Message) error {
+	logger := mailer.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+func (mailer *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(mailer.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), mailer.counter.Add(1))
+	content := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n", msg.To, msg.Subject, msg.Body)
+	return os.WriteFile(filepath.Join(mailer.Dir, name), []byte(content), 0o600)
+}
@@ -0,0 +1,397 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const (
+	mfaChallengeDuration    = time.Minute * 5
+	mfaChallengeMaxAttempts = 5
+	recoveryCodeCount       = 10
+	defaultMFAIssuer        = "goweb"
+)
+
+// CodeMFARequired is the error code of requests that need a session which
+// passed two-factor authentication
+const CodeMFARequired = "mfa_required"
+
+var errInvalidMFACode = errors.New("invalid MFA code")
+
+type (
+	// RecoveryCode is a single-use code replacing a TOTP code when the
+	// user lost their authenticator. Only its hash is stored.
+	RecoveryCode struct {
+		core.BaseModel
+
+		UserID   uint       `json:"user_id" gorm:"not null;index"`
+		CodeHash string     `json:"-" gorm:"uniqueIndex;not null"`
+		UsedAt   *time.Time `json:"used_at"`
+	}
+
+	TOTPEnrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+
+	MFACodeRequest struct {
+		Code string `json:"code" binding:"required"`
+	}
+
+	// MFALoginRequest completes a login with either a TOTP code or a
+	// recovery code
+	MFALoginRequest struct {
+		MFAToken     string `json:"mfa_token" binding:"required"`
+		Code         string `json:"code" binding:"required_without=RecoveryCode"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+)
+
+// EnrollTOTPHandler generates a TOTP secret for the user. MFA is only
+// enabled once the user confirms it with a code from their authenticator.
+func (sessMgr *SessionManager) EnrollTOTPHandler(c *gin.Context) {
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.IsMFAEnabled() {
+		core.AbortWithError(c, core.Conflict("Two-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to generate TOTP secret", err))
+		return
+	}
+	if err := sessMgr.db.Model(user).UpdateColumn("totp_secret", secret).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to save TOTP secret", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, TOTPEnrollment{
+		Secret: secret,
+		URI:    totpURI(sessMgr.mfaIssuer, user.Email, secret),
+	})
+}
+
+// ConfirmTOTPHandler enables MFA with a code from the authenticator and
+// returns the user's recovery codes. They are only shown once.
+func (sessMgr *SessionManager) ConfirmTOTPHandler(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.IsMFAEnabled() {
+		core.AbortWithError(c, core.Conflict("Two-factor authentication is already enabled"))
+		return
+	}
+	if user.TOTPSecret == "" {
+		core.AbortWithError(c, core.BadRequest("TOTP enrollment has not been started"))
+		return
+	}
+	if err := sessMgr.checkSecondFactor(c, user, req.Code, "", nil); err != nil {
+		core.AbortWithError(c, mfaError(err))
+		return
+	}
+
+	var codes []string
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) (err error) {
+		if err = tx.Model(user).UpdateColumn("mfa_enabled_at", time.Now()).Error; err != nil {
+			return
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return
+	})
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to enable two-factor authentication", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// DisableTOTPHandler disables MFA after checking a TOTP or recovery code
+func (sessMgr *SessionManager) DisableTOTPHandler(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+	if !user.IsMFAEnabled() {
+		core.AbortWithError(c, core.Conflict("Two-factor authentication is not enabled"))
+		return
+	}
+	if err := sessMgr.checkSecondFactor(c, user, req.Code, req.Code, nil); err != nil {
+		core.AbortWithError(c, mfaError(err))
+		return
+	}
+
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(user).UpdateColumns(map[string]interface{}{
+			"totp_secret":    "",
+			"mfa_enabled_at": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{}).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to disable two-factor authentication", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodesHandler replaces the user's recovery codes after
+// checking a TOTP code
+func (sessMgr *SessionManager) RegenerateRecoveryCodesHandler(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+	if !user.IsMFAEnabled() {
+		core.AbortWithError(c, core.Conflict("Two-factor authentication is not enabled"))
+		return
+	}
+	if err := sessMgr.checkSecondFactor(c, user, req.Code, "", nil); err != nil {
+		core.AbortWithError(c, mfaError(err))
+		return
+	}
+
+	var codes []string
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) (err error) {
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return
+	})
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to generate recovery codes", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// MFALoginHandler exchanges the MFA challenge token returned by
+// LoginHandler and a TOTP or recovery code for a session. A challenge is
+// dropped after too many wrong codes, and wrong codes count towards the
+// account's lockout like wrong passwords.
+func (sessMgr *SessionManager) MFALoginHandler(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	challenge, err := findUserToken(sessMgr.db, purposeMFAChallenge, req.MFAToken)
+	if err != nil {
+		if errors.Is(err, errInvalidUserToken) || errors.Is(err, errExpiredUserToken) {
+			core.AbortWithError(c, core.Unauthorized("Invalid or expired MFA token"))
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to find MFA challenge", err))
+		return
+	}
+
+	var user SessionUser
+	if err := sessMgr.db.First(&user, challenge.UserID).Error; err != nil {
+		core.AbortWithError(c, core.Unauthorized("Invalid or expired MFA token"))
+		return
+	}
+
+	// The challenge is consumed along with the code, so that a recovery
+	// code isn't used up without logging the user in
+	consumeChallenge := func(tx *gorm.DB) error {
+		if _, err := consumeUserToken(tx, purposeMFAChallenge, req.MFAToken); err != nil {
+			if errors.Is(err, errInvalidUserToken) || errors.Is(err, errExpiredUserToken) {
+				return core.Unauthorized("Invalid or expired MFA token")
+			}
+			return core.Internal("Failed to consume MFA challenge", err)
+		}
+		return nil
+	}
+	if err := sessMgr.checkSecondFactor(c, &user, req.Code, req.RecoveryCode, consumeChallenge); err != nil {
+		if !errors.Is(err, errInvalidMFACode) {
+			core.AbortWithError(c, err)
+			return
+		}
+		sessMgr.recordLoginAttempt(c, user.Email, user.ID, loginInvalidMFACode)
+		if err := failUserToken(sessMgr.db, challenge, mfaChallengeMaxAttempts); err != nil {
+			core.AbortWithError(c, core.Internal("Failed to record MFA attempt", err))
+			return
+		}
+		core.AbortWithError(c, core.Unauthorized("Invalid MFA code"))
+		return
+	}
+	sessMgr.startSession(c, &user, true)
+}
+
+// HasMFA reports whether the authenticated session passed two-factor
+// authentication
+func (sessMgr *SessionManager) HasMFA(c *gin.Context) bool {
+	return c.GetBool(mfaKey)
+}
+
+// RequireMFA only lets sessions that passed two-factor authentication
+// through. It must run after AuthMiddleware.
+func (sessMgr *SessionManager) RequireMFA(c *gin.Context) {
+	if !sessMgr.HasMFA(c) {
+		core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeMFARequired, "Two-factor authentication required"))
+		return
+	}
+	c.Next()
+}
+
+// currentUser loads the authenticated user, aborting when it doesn't exist
+func (sessMgr *SessionManager) currentUser(c *gin.Context) (user *SessionUser, ok bool) {
+	user = &SessionUser{}
+	if err := sessMgr.db.First(user, sessMgr.GetUserID(c)).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			core.AbortWithError(c, core.Unauthorized("Not authenticated"))
+			return nil, false
+		}
+		core.AbortWithError(c, core.Internal("Failed to find user", err))
+		return nil, false
+	}
+	return user, true
+}
+
+// checkSecondFactor verifies a TOTP or recovery code of the user. Wrong
+// codes count as failed logins, delaying and then locking the account, so
+// that second factors can't be brute-forced. When then is set, it runs in
+// the transaction using up the code, which is only used up when then
+// succeeds. It returns errInvalidMFACode for wrong codes and core errors
+// otherwise.
+func (sessMgr *SessionManager) checkSecondFactor(c *gin.Context, user *SessionUser, code, recoveryCode string, then func(tx *gorm.DB) error) error {
+	if err := sessMgr.checkLocked(c, user); err != nil {
+		return err
+	}
+
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		if err := verifySecondFactor(tx, user, code, recoveryCode); err != nil || then == nil {
+			return err
+		}
+		return then(tx)
+	})
+	var apiErr *core.Error
+	switch {
+	case errors.Is(err, errInvalidMFACode):
+		if err := sessMgr.failLogin(c, user); err != nil {
+			return core.Internal("Failed to record failed MFA code", err)
+		}
+		return errInvalidMFACode
+	case errors.As(err, &apiErr):
+		return err
+	case err != nil:
+		return core.Internal("Failed to verify MFA code", err)
+	}
+	if err := sessMgr.clearFailedLogins(user); err != nil {
+		return core.Internal("Failed to reset failed logins", err)
+	}
+	return nil
+}
+
+// verifySecondFactor checks a TOTP code or, when it is empty, a recovery code
+func verifySecondFactor(tx *gorm.DB, user *SessionUser, code, recoveryCode string) error {
+	if code != "" {
+		if err := verifyTOTP(tx, user, code); !errors.Is(err, errInvalidMFACode) {
+			return err
+		}
+	}
+	if recoveryCode != "" {
+		return useRecoveryCode(tx, user.ID, recoveryCode)
+	}
+	return errInvalidMFACode
+}
+
+// verifyTOTP checks a TOTP code. Every time step is only accepted once, so
+// an intercepted code can't be replayed.
+func verifyTOTP(tx *gorm.DB, user *SessionUser, code string) error {
+	counter, ok := matchTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return errInvalidMFACode
+	}
+	result := tx.Model(&SessionUser{}).
+		Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+		UpdateColumn("totp_last_counter", counter)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidMFACode
+	}
+	user.TOTPLastCounter = counter
+	return nil
+}
+
+// mfaError maps an error of checkSecondFactor to the response error
+func mfaError(err error) error {
+	if errors.Is(err, errInvalidMFACode) {
+		return core.ErrInvalidField{Field: "code", Message: "is invalid"}
+	}
+	return err
+}
+
+// replaceRecoveryCodes generates new recovery codes for the user,
+// dropping the previous ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) (codes []string, err error) {
+	if err = tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+		return
+	}
+
+	for idx := 0; idx < recoveryCodeCount; idx++ {
+		buf := make([]byte, 7)
+		if _, err = rand.Read(buf); err != nil {
+			return
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		recoveryCode := &RecoveryCode{
+			UserID:   userID,
+			CodeHash: hashToken(code),
+		}
+		recoveryCode.OwnedBy = ownerID(userID)
+		if err = tx.Create(recoveryCode).Error; err != nil {
+			return
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return
+}
+
+// useRecoveryCode consumes one of the user's recovery codes
+func useRecoveryCode(tx *gorm.DB, userID uint, code string) error {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	result := tx.Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errInvalidMFACode
+	}
+	return nil
+}
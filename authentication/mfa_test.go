@@ -0,0 +1,228 @@
+package authentication
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// totpCode returns the user's TOTP code steps periods from now
+func totpCode(t *testing.T, secret string, steps int64) string {
+	code, err := hotpCode(secret, totpCounter(time.Now())+steps)
+	assert.NoError(t, err)
+	return code
+}
+
+// mfaUser creates a user with MFA enabled and returns its TOTP secret
+func mfaUser(t *testing.T, sessMgr *SessionManager, email string) (*SessionUser, string) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+	now := time.Now()
+	user := &SessionUser{Email: email, Password: "password123", TOTPSecret: secret, MFAEnabledAt: &now}
+	assert.NoError(t, sessMgr.db.Create(user).Error)
+	return user, secret
+}
+
+func TestTOTPEnrollmentAndLogin(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+
+	authPost := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := authPost("/mfa/totp/enroll", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var enrollment TOTPEnrollment
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &enrollment))
+	assert.NotEmpty(t, enrollment.Secret)
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	// MFA is only enabled once confirmed with a valid code
+	assert.Equal(t, http.StatusBadRequest, authPost("/mfa/totp/confirm", `{"code": "abcdef"}`).Code)
+	w = authPost("/mfa/totp/confirm", `{"code": "`+totpCode(t, enrollment.Secret, 0)+`"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var confirmed struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &confirmed))
+	assert.Len(t, confirmed.RecoveryCodes, recoveryCodeCount)
+	assert.Equal(t, http.StatusConflict, authPost("/mfa/totp/enroll", "").Code)
+
+	// The password step only returns a challenge
+	login := func() string {
+		w := postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "password123"})
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp LoginResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.True(t, resp.MFARequired)
+		assert.Nil(t, resp.Session)
+		return resp.MFAToken
+	}
+	mfaToken := login()
+
+	// A code already used can't be replayed
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, enrollment.Secret, 0)}).Code)
+	w = postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, enrollment.Secret, 1)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.NotEmpty(t, resp.Session.Token)
+	claims, err := (&Session{Keyring: sessMgr.keyring, Token: resp.Session.Token}).parseToken()
+	assert.NoError(t, err)
+	assert.True(t, claims.MFA)
+
+	// Challenges are single use
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, enrollment.Secret, -1)}).Code)
+
+	// Recovery codes work once
+	recoveryCode := confirmed.RecoveryCodes[0]
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "recovery_code": recoveryCode}).Code)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "recovery_code": recoveryCode}).Code)
+
+	// Recovery codes aren't used up when the challenge can't be consumed
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/login/mfa", nil)
+	var reloaded SessionUser
+	sessMgr.db.First(&reloaded, user.ID)
+	consumeFails := func(*gorm.DB) error { return core.Unauthorized("Invalid or expired MFA token") }
+	assert.Error(t, sessMgr.checkSecondFactor(c, &reloaded, "", confirmed.RecoveryCodes[2], consumeFails))
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "recovery_code": confirmed.RecoveryCodes[2]}).Code)
+
+	// Disabling MFA takes a second factor too
+	assert.Equal(t, http.StatusBadRequest, authPost("/mfa/totp/disable", `{"code": "abcdef"}`).Code)
+	assert.Equal(t, http.StatusOK, authPost("/mfa/totp/disable", `{"code": "`+confirmed.RecoveryCodes[1]+`"}`).Code)
+	w = postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "password123"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "mfa_token")
+}
+
+func TestMFAChallengeAttemptLimit(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	// Leave the account's lockout out of it
+	WithLoginThrottle(LoginThrottle{})(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user, secret := mfaUser(t, sessMgr, "test@example.com")
+	mfaToken, err := issueUserToken(sessMgr.db, user.ID, purposeMFAChallenge, mfaChallengeDuration)
+	assert.NoError(t, err)
+
+	for idx := 0; idx < mfaChallengeMaxAttempts; idx++ {
+		assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": "abcdef"}).Code)
+	}
+	// The challenge is dropped, even with a valid code
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, secret, 0)}).Code)
+}
+
+func TestMFALockout(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	WithLoginThrottle(LoginThrottle{LockoutAfter: 3, LockoutDuration: time.Hour})(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user, secret := mfaUser(t, sessMgr, "test@example.com")
+	login := func() string {
+		w := postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "password123"})
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp LoginResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.MFAToken
+	}
+	failedLogins := func() int {
+		var reloaded SessionUser
+		sessMgr.db.First(&reloaded, user.ID)
+		return reloaded.FailedLogins
+	}
+
+	// Wrong codes count against the account across challenges, and the
+	// password step doesn't reset the count
+	for idx := 1; idx <= 2; idx++ {
+		assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "recovery_code": "aaaaa-bbbbb"}).Code)
+		assert.Equal(t, idx, failedLogins())
+	}
+
+	// Authenticated second factor checks count too
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+	authPost := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	mfaToken := login()
+	assert.Equal(t, http.StatusBadRequest, authPost("/mfa/totp/disable", `{"code": "abcdef"}`).Code)
+
+	// The account is locked, even for valid codes
+	w := postJSON(router, "/login/mfa", map[string]string{"mfa_token": mfaToken, "code": totpCode(t, secret, 0)})
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), CodeAccountLocked)
+	assert.Equal(t, http.StatusTooManyRequests, authPost("/mfa/recovery-codes", `{"code": "`+totpCode(t, secret, 0)+`"}`).Code)
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "password123"}).Code)
+
+	// Passing the second factor clears the count
+	assert.NoError(t, unlockUser(sessMgr.db, user.ID))
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "code": "abcdef"}).Code)
+	assert.Equal(t, 1, failedLogins())
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login/mfa", map[string]string{"mfa_token": login(), "code": totpCode(t, secret, 0)}).Code)
+	assert.Equal(t, 0, failedLogins())
+}
+
+func TestRequireAdminMFA(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	WithRequireAdminMFA()(sessMgr)
+
+	user, _ := mfaUser(t, sessMgr, "admin@example.com")
+	sessMgr.db.Model(user).UpdateColumn("is_admin", true)
+	user.IsAdmin = true
+
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+	router.GET("/admin", sessMgr.AuthMiddleware, sessMgr.RequireAdmin, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	// Both admin routes and permission-gated routes require MFA
+	for _, path := range []string{"/admin", "/admin/signing-keys"} {
+		for _, mfa := range []bool{false, true} {
+			session, err := newSession(sessMgr.keyring, user, mfa, "127.0.0.1", "test-agent")
+			assert.NoError(t, err)
+			sessMgr.db.Create(session)
+
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			req.Header.Set("Authorization", bearerSchema+session.Token)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if mfa {
+				assert.Equal(t, http.StatusOK, w.Code, path)
+			} else {
+				assert.Equal(t, http.StatusForbidden, w.Code, path)
+				assert.Contains(t, w.Body.String(), CodeMFARequired, path)
+			}
+		}
+	}
+}
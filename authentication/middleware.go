@@ -1,72 +1,116 @@
 package authentication
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
 )
 
 const (
 	bearerSchema         = "Bearer "
 	userKey              = "user_id"
-	defaultTokenDuration = time.Hour * 24 // 24 hours
+	adminKey             = "is_admin"
+	tokenIDKey           = "token_id"
+	mfaKey               = "mfa"
+	scopesKey            = "scopes"
+	apiKeyIDKey          = "api_key_id"
+	accessTokenDuration  = time.Minute * 15    // 15 minutes
+	refreshTokenDuration = time.Hour * 24 * 30 // 30 days
 )
 
-// AuthMiddleware creates a gin middleware for JWT authentication
+// AuthMiddleware authenticates requests with an access token or an API key
 func (sessMgr *SessionManager) AuthMiddleware(c *gin.Context) {
+	sessMgr.authenticate(c, true)
+}
+
+// SessionMiddleware authenticates requests with an access token only. It
+// protects account management, e.g. creating API keys, from API keys.
+func (sessMgr *SessionManager) SessionMiddleware(c *gin.Context) {
+	sessMgr.authenticate(c, false)
+}
+
+func (sessMgr *SessionManager) authenticate(c *gin.Context, allowAPIKeys bool) {
 	authHeader := c.GetHeader("Authorization")
 	if authHeader == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Authorization header is required",
-		})
+		core.AbortWithError(c, core.Unauthorized("Authorization header is required"))
 		return
 	}
 
 	if !strings.HasPrefix(authHeader, bearerSchema) {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Authorization header must start with 'Bearer'",
-		})
+		core.AbortWithError(c, core.Unauthorized("Authorization header must start with 'Bearer'"))
 		return
 	}
 
 	tokenString := strings.TrimPrefix(authHeader, bearerSchema)
 	if tokenString == "" {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Token is required",
-		})
+		core.AbortWithError(c, core.Unauthorized("Token is required"))
 		return
 	}
 
-	// Create temporary session for token validation
-	dummyUser := &SessionUser{}
-	session, err := NewSession(sessMgr.secretKey, dummyUser, c.ClientIP(), c.Request.UserAgent())
-	if err != nil {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-			"error": "Invalid token",
-		})
+	if strings.HasPrefix(tokenString, apiKeyPrefix) {
+		if !allowAPIKeys {
+			core.AbortWithError(c, core.Forbidden("API keys can't be used here, log in instead"))
+			return
+		}
+		sessMgr.authenticateAPIKey(c, tokenString)
 		return
 	}
-	session.Token = tokenString
+
+	// Create temporary session for token validation
+	session := &Session{
+		Keyring: sessMgr.keyring,
+		Token:   tokenString,
+	}
 
 	claims, err := session.parseToken()
 	if err != nil {
-		status := http.StatusUnauthorized
 		message := "Invalid token"
-
 		if err == errExpiredToken {
 			message = "Token has expired"
 		}
 
-		c.AbortWithStatusJSON(status, gin.H{
-			"error": message,
-		})
+		core.AbortWithError(c, core.Unauthorized(message))
+		return
+	}
+
+	// Reject tokens whose session has been logged out or revoked
+	if err = sessMgr.checkSession(claims.ID, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		core.AbortWithError(c, err)
 		return
 	}
 
-	// Store user ID in context
+	// Store user ID in context and scope owned records to the user
 	c.Set(userKey, claims.UserID)
+	c.Set(adminKey, claims.Admin)
+	c.Set(tokenIDKey, claims.ID)
+	c.Set(mfaKey, claims.MFA)
+	c.Set(scopesKey, []string{ScopeAll})
+	core.SetOwner(c, core.Owner{ID: ownerID(claims.UserID), Admin: claims.Admin})
+	c.Next()
+}
+
+// authenticateAPIKey authenticates the request as the API key's user,
+// within the key's scopes
+func (sessMgr *SessionManager) authenticateAPIKey(c *gin.Context, key string) {
+	apiKey, err := sessMgr.checkAPIKey(key, c.ClientIP())
+	if err != nil {
+		if errors.Is(err, errInvalidAPIKey) {
+			core.AbortWithError(c, core.Unauthorized("Invalid API key"))
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to check API key", err))
+		return
+	}
+
+	c.Set(userKey, apiKey.UserID)
+	c.Set(adminKey, apiKey.User.IsAdmin)
+	c.Set(apiKeyIDKey, apiKey.ID)
+	c.Set(scopesKey, apiKey.scopeList())
+	core.SetOwner(c, core.Owner{ID: ownerID(apiKey.UserID), Admin: apiKey.User.IsAdmin})
 	c.Next()
 }
 
@@ -80,3 +124,24 @@ func (sessMgr *SessionManager) GetUserID(c *gin.Context) uint {
 	}
 	return 0
 }
+
+// IsAdmin reports whether the authenticated user is an admin, i.e. a
+// superadmin when they logged in or last refreshed their session
+func (sessMgr *SessionManager) IsAdmin(c *gin.Context) bool {
+	return c.GetBool(adminKey)
+}
+
+// RequireAdmin only lets admins through, and with WithRequireAdminMFA only
+// when their session passed two-factor authentication. It must run after
+// AuthMiddleware.
+func (sessMgr *SessionManager) RequireAdmin(c *gin.Context) {
+	if !sessMgr.IsAdmin(c) {
+		core.AbortWithError(c, core.Forbidden("Admin access required"))
+		return
+	}
+	if sessMgr.requireAdminMFA && !sessMgr.HasMFA(c) {
+		core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeMFARequired, "Admin access requires two-factor authentication"))
+		return
+	}
+	c.Next()
+}
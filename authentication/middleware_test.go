@@ -11,7 +11,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"gorm.io/gorm"
+	"github.com/gsarmaonline/goweb/core"
+	"github.com/stretchr/testify/assert"
 )
 
 func setupTestSessionManager(t *testing.T) *SessionManager {
@@ -25,7 +26,7 @@ func setupTestSessionManager(t *testing.T) *SessionManager {
 	engine := gin.New()
 
 	// Create session manager
-	sessMgr, err := NewSessionManager(context.Background(), &gorm.DB{}, engine)
+	sessMgr, err := NewSessionManager(context.Background(), setupTestDB(t), engine)
 	if err != nil {
 		t.Fatalf("Failed to create session manager: %v", err)
 	}
@@ -35,7 +36,8 @@ func setupTestSessionManager(t *testing.T) *SessionManager {
 
 func TestAuthMiddleware(t *testing.T) {
 	sessMgr := setupTestSessionManager(t)
-	secretKey := sessMgr.secretKey
+	keyring := sessMgr.keyring
+	secretKey := []byte("test-secret-key")
 
 	tests := []struct {
 		name           string
@@ -49,10 +51,11 @@ func TestAuthMiddleware(t *testing.T) {
 			setupAuth: func(req *http.Request) {
 				user := &SessionUser{Email: "test@example.com"}
 				user.ID = 123
-				session, err := NewSession(secretKey, user, "127.0.0.1", "test-agent")
+				session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
 				if err != nil {
 					t.Fatalf("Failed to create session: %v", err)
 				}
+				sessMgr.db.Create(session)
 				req.Header.Set("Authorization", bearerSchema+session.Token)
 			},
 			expectedCode:   http.StatusOK,
@@ -103,6 +106,7 @@ func TestAuthMiddleware(t *testing.T) {
 					},
 				}
 				token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+				token.Header["kid"] = NewHMACKey(secretKey).ID()
 				tokenString, err := token.SignedString(secretKey)
 				if err != nil {
 					t.Fatalf("Failed to create expired token: %v", err)
@@ -171,3 +175,82 @@ func TestGetUserID(t *testing.T) {
 		t.Errorf("Expected user ID 0 for invalid type, got %d", id)
 	}
 }
+
+func TestAuthMiddlewareSetsOwner(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+
+	for _, isAdmin := range []bool{false, true} {
+		user := &SessionUser{Email: "test@example.com", IsAdmin: isAdmin}
+		user.ID = 42
+		session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		sessMgr.db.Create(session)
+
+		var owner core.Owner
+		var capturedAdmin bool
+		router := gin.New()
+		router.GET("/test", sessMgr.AuthMiddleware, func(c *gin.Context) {
+			owner, _ = core.OwnerFromContext(c.Request.Context())
+			capturedAdmin = sessMgr.IsAdmin(c)
+			c.Status(http.StatusOK)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.Header.Set("Authorization", bearerSchema+session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, core.Owner{ID: "42", Admin: isAdmin}, owner)
+		assert.Equal(t, isAdmin, capturedAdmin)
+		assert.Equal(t, "42", session.OwnedBy)
+	}
+}
+
+func TestAuthMiddlewareRejectsRevokedSessions(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+
+	router := gin.New()
+	router.GET("/test", sessMgr.AuthMiddleware, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.POST("/logout", sessMgr.AuthMiddleware, sessMgr.LogoutHandler)
+
+	request := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", bearerSchema+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A valid token whose session was never saved
+	unsaved, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/test", unsaved.Token).Code)
+
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	sessMgr.db.Create(session)
+
+	// The session is cached after the first request
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/test", session.Token).Code)
+	assert.True(t, sessMgr.sessions.active(session.TokenID))
+
+	// Logging out revokes the token immediately
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/logout", session.Token).Code)
+	assert.False(t, sessMgr.sessions.active(session.TokenID))
+
+	w := request(http.MethodGet, "/test", session.Token)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "Session has been revoked")
+}
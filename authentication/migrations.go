@@ -0,0 +1,491 @@
+package authentication
+
+import (
+	"time"
+
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+// The migrations work on snapshots of the models as they were when the
+// migration was written, so that later model changes don't alter them.
+type (
+	sessionUserV1 struct {
+		core.BaseModel
+
+		Email    string `gorm:"uniqueIndex;not null"`
+		Password string `gorm:"not null"`
+	}
+
+	sessionV1 struct {
+		core.BaseModel
+
+		User        *sessionUserV1 `gorm:"foreignKey:UserID"`
+		UserID      uint           `gorm:"not null"`
+		ExpiresAt   time.Time
+		LastUsedAt  time.Time
+		LastUsedIP  string
+		LastUsedLoc string
+	}
+
+	sessionUserV2 struct {
+		IsAdmin bool `gorm:"not null;default:false"`
+	}
+
+	sessionV3 struct {
+		RefreshTokenHash string `gorm:"index"`
+		RefreshExpiresAt time.Time
+		FamilyID         string `gorm:"index"`
+		RevokedAt        *time.Time
+		RevokedReason    string
+	}
+
+	sessionV4 struct {
+		TokenID string `gorm:"index"`
+	}
+
+	sessionUserV5 struct {
+		EmailVerifiedAt *time.Time
+	}
+
+	userTokenV5 struct {
+		core.BaseModel
+
+		UserID    uint   `gorm:"not null;index"`
+		Purpose   string `gorm:"not null;index"`
+		TokenHash string `gorm:"uniqueIndex;not null"`
+		ExpiresAt time.Time
+		UsedAt    *time.Time
+	}
+
+	sessionUserV6 struct {
+		TOTPSecret      string
+		TOTPLastCounter int64 `gorm:"not null;default:0"`
+		MFAEnabledAt    *time.Time
+	}
+
+	sessionV6 struct {
+		MFA bool `gorm:"not null;default:false"`
+	}
+
+	userTokenV6 struct {
+		Attempts int `gorm:"not null;default:0"`
+	}
+
+	recoveryCodeV6 struct {
+		core.BaseModel
+
+		UserID   uint   `gorm:"not null;index"`
+		CodeHash string `gorm:"uniqueIndex;not null"`
+		UsedAt   *time.Time
+	}
+
+	passkeyV7 struct {
+		core.BaseModel
+
+		UserID       uint `gorm:"not null;index"`
+		Name         string
+		CredentialID string `gorm:"uniqueIndex;not null"`
+		PublicKey    []byte `gorm:"not null"`
+		Algorithm    int64
+		SignCount    uint32
+		AAGUID       string
+		LastUsedAt   *time.Time
+	}
+
+	userIdentityV8 struct {
+		core.BaseModel
+
+		UserID   uint   `gorm:"not null;index"`
+		Provider string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+		Subject  string `gorm:"not null;uniqueIndex:idx_user_identities_provider_subject"`
+		Email    string
+	}
+
+	oidcStateV8 struct {
+		core.BaseModel
+
+		Provider     string `gorm:"not null"`
+		StateHash    string `gorm:"uniqueIndex;not null"`
+		Nonce        string `gorm:"not null"`
+		CodeVerifier string `gorm:"not null"`
+		UserID       uint
+		ExpiresAt    time.Time `gorm:"not null"`
+	}
+
+	apiKeyV9 struct {
+		core.BaseModel
+
+		UserID     uint   `gorm:"not null;index"`
+		Name       string `gorm:"not null"`
+		Prefix     string `gorm:"uniqueIndex;not null"`
+		KeyHash    string `gorm:"not null"`
+		Scopes     string `gorm:"not null"`
+		ExpiresAt  *time.Time
+		LastUsedAt *time.Time
+		LastUsedIP string
+		RevokedAt  *time.Time
+	}
+
+	permissionV10 struct {
+		core.BaseModel
+
+		Name        string `gorm:"uniqueIndex;not null"`
+		Description string
+		Plugin      string
+	}
+
+	roleV10 struct {
+		core.BaseModel
+
+		Name        string `gorm:"uniqueIndex;not null"`
+		Description string
+	}
+
+	rolePermissionV10 struct {
+		RoleID       uint `gorm:"primaryKey"`
+		PermissionID uint `gorm:"primaryKey"`
+	}
+
+	userRoleV10 struct {
+		core.BaseModel
+
+		UserID uint `gorm:"not null;uniqueIndex:idx_user_roles_user_role"`
+		RoleID uint `gorm:"not null;uniqueIndex:idx_user_roles_user_role;index"`
+	}
+
+	sessionUserV11 struct {
+		FailedLogins int `gorm:"not null;default:0"`
+		LockedUntil  *time.Time
+	}
+
+	loginAttemptV11 struct {
+		core.BaseModel
+
+		UserID    uint   `gorm:"index"`
+		Email     string `gorm:"not null;index"`
+		IP        string `gorm:"index"`
+		UserAgent string
+		Succeeded bool `gorm:"not null;default:false"`
+		Reason    string
+	}
+
+	sessionV13 struct {
+		UserAgent string
+	}
+)
+
+// sessionUserV6Columns are the MFA columns added in version 6
+var sessionUserV6Columns = []string{"TOTPSecret", "TOTPLastCounter", "MFAEnabledAt"}
+
+// sessionUserV11Columns are the lockout columns added in version 11
+var sessionUserV11Columns = []string{"FailedLogins", "LockedUntil"}
+
+// sessionV3Columns are the refresh token columns added in version 3
+var sessionV3Columns = []string{"RefreshTokenHash", "RefreshExpiresAt", "FamilyID", "RevokedAt", "RevokedReason"}
+
+func (sessionUserV1) TableName() string { return "session_users" }
+func (sessionV1) TableName() string     { return "sessions" }
+func (sessionUserV2) TableName() string { return "session_users" }
+func (sessionV3) TableName() string     { return "sessions" }
+func (sessionV4) TableName() string     { return "sessions" }
+func (sessionUserV5) TableName() string { return "session_users" }
+func (userTokenV5) TableName() string   { return "user_tokens" }
+func (sessionUserV6) TableName() string { return "session_users" }
+func (sessionV6) TableName() string     { return "sessions" }
+func (userTokenV6) TableName() string   { return "user_tokens" }
+func (recoveryCodeV6) TableName() string {
+	return "recovery_codes"
+}
+func (passkeyV7) TableName() string         { return "passkeys" }
+func (userIdentityV8) TableName() string    { return "user_identities" }
+func (oidcStateV8) TableName() string       { return "oidc_states" }
+func (apiKeyV9) TableName() string          { return "api_keys" }
+func (permissionV10) TableName() string     { return "permissions" }
+func (roleV10) TableName() string           { return "roles" }
+func (rolePermissionV10) TableName() string { return "role_permissions" }
+func (userRoleV10) TableName() string       { return "user_roles" }
+func (sessionUserV11) TableName() string    { return "session_users" }
+func (loginAttemptV11) TableName() string   { return "login_attempts" }
+func (sessionV13) TableName() string        { return "sessions" }
+
+// backfillOwners makes users own their record and their sessions
+func backfillOwners(tx *gorm.DB) error {
+	var users []sessionUserV1
+	err := tx.Where("owned_by = '' OR owned_by IS NULL").FindInBatches(&users, 500, func(*gorm.DB, int) error {
+		for _, user := range users {
+			if err := tx.Model(&sessionUserV1{}).Where("id = ?", user.ID).
+				UpdateColumn("owned_by", ownerID(user.ID)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	var sessions []sessionV1
+	return tx.Where("owned_by = '' OR owned_by IS NULL").FindInBatches(&sessions, 500, func(*gorm.DB, int) error {
+		for _, session := range sessions {
+			if err := tx.Model(&sessionV1{}).Where("id = ?", session.ID).
+				UpdateColumn("owned_by", ownerID(session.UserID)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+}
+
+// seedSuperadminRole creates the superadmin role and grants it to the
+// existing admins, so that they keep managing the application
+func seedSuperadminRole(tx *gorm.DB) error {
+	role := &roleV10{Name: RoleSuperadmin, Description: "Every permission"}
+	if err := tx.Create(role).Error; err != nil {
+		return err
+	}
+
+	var adminIDs []uint
+	if err := tx.Model(&sessionUserV1{}).Where("is_admin = ?", true).Pluck("id", &adminIDs).Error; err != nil {
+		return err
+	}
+	for _, adminID := range adminIDs {
+		userRole := &userRoleV10{UserID: adminID, RoleID: role.ID}
+		userRole.OwnedBy = ownerID(adminID)
+		if err := tx.Create(userRole).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSuperadmins makes the superadmins admins and the admins superadmins,
+// now that the IsAdmin flag mirrors the superadmin role
+func syncSuperadmins(tx *gorm.DB) error {
+	var role roleV10
+	if err := tx.Where("name = ?", RoleSuperadmin).First(&role).Error; err != nil {
+		return err
+	}
+	superadmins := tx.Model(&userRoleV10{}).Select("user_id").Where("role_id = ?", role.ID)
+	if err := tx.Model(&sessionUserV1{}).Where("id IN (?)", superadmins).UpdateColumn("is_admin", true).Error; err != nil {
+		return err
+	}
+
+	var adminIDs []uint
+	if err := tx.Model(&sessionUserV1{}).Where("is_admin = ? AND id NOT IN (?)", true, superadmins).Pluck("id", &adminIDs).Error; err != nil {
+		return err
+	}
+	for _, adminID := range adminIDs {
+		userRole := &userRoleV10{UserID: adminID, RoleID: role.ID}
+		userRole.OwnedBy = ownerID(adminID)
+		if err := tx.Create(userRole).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Migrations returns the schema migrations of the authentication plugin
+func (sessionMgr *SessionManager) Migrations() []core.Migration {
+	return []core.Migration{
+		{
+			Version: 1,
+			Name:    "create_session_users_and_sessions",
+			Up:      core.CreateTables(&sessionUserV1{}, &sessionV1{}),
+			Down:    core.DropTables(&sessionV1{}, &sessionUserV1{}),
+		},
+		{
+			Version: 2,
+			Name:    "add_session_users_is_admin_and_backfill_owners",
+			Up: func(tx *gorm.DB) error {
+				if err := tx.Migrator().AddColumn(&sessionUserV2{}, "IsAdmin"); err != nil {
+					return err
+				}
+				return backfillOwners(tx)
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropColumn(&sessionUserV2{}, "IsAdmin")
+			},
+		},
+		{
+			Version: 3,
+			Name:    "add_sessions_refresh_tokens",
+			Up: func(tx *gorm.DB) error {
+				for _, column := range sessionV3Columns {
+					if err := tx.Migrator().AddColumn(&sessionV3{}, column); err != nil {
+						return err
+					}
+				}
+				for _, index := range []string{"RefreshTokenHash", "FamilyID"} {
+					if err := tx.Migrator().CreateIndex(&sessionV3{}, index); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			Down: func(tx *gorm.DB) error {
+				for _, index := range []string{"RefreshTokenHash", "FamilyID"} {
+					if err := tx.Migrator().DropIndex(&sessionV3{}, index); err != nil {
+						return err
+					}
+				}
+				for _, column := range sessionV3Columns {
+					if err := tx.Migrator().DropColumn(&sessionV3{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 4,
+			Name:    "add_sessions_token_id",
+			Up: func(tx *gorm.DB) error {
+				if err := tx.Migrator().AddColumn(&sessionV4{}, "TokenID"); err != nil {
+					return err
+				}
+				return tx.Migrator().CreateIndex(&sessionV4{}, "TokenID")
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Migrator().DropIndex(&sessionV4{}, "TokenID"); err != nil {
+					return err
+				}
+				return tx.Migrator().DropColumn(&sessionV4{}, "TokenID")
+			},
+		},
+		{
+			Version: 5,
+			Name:    "add_email_verification",
+			Up: func(tx *gorm.DB) error {
+				if err := tx.Migrator().AddColumn(&sessionUserV5{}, "EmailVerifiedAt"); err != nil {
+					return err
+				}
+				// Users registered before verification existed are trusted
+				err := tx.Model(&sessionUserV5{}).Where("email_verified_at IS NULL").
+					UpdateColumn("email_verified_at", gorm.Expr("created_at")).Error
+				if err != nil {
+					return err
+				}
+				return core.CreateTables(&userTokenV5{})(tx)
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := core.DropTables(&userTokenV5{})(tx); err != nil {
+					return err
+				}
+				return tx.Migrator().DropColumn(&sessionUserV5{}, "EmailVerifiedAt")
+			},
+		},
+		{
+			Version: 6,
+			Name:    "add_totp_mfa",
+			Up: func(tx *gorm.DB) error {
+				for _, column := range sessionUserV6Columns {
+					if err := tx.Migrator().AddColumn(&sessionUserV6{}, column); err != nil {
+						return err
+					}
+				}
+				if err := tx.Migrator().AddColumn(&sessionV6{}, "MFA"); err != nil {
+					return err
+				}
+				if err := tx.Migrator().AddColumn(&userTokenV6{}, "Attempts"); err != nil {
+					return err
+				}
+				return core.CreateTables(&recoveryCodeV6{})(tx)
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := core.DropTables(&recoveryCodeV6{})(tx); err != nil {
+					return err
+				}
+				if err := tx.Migrator().DropColumn(&userTokenV6{}, "Attempts"); err != nil {
+					return err
+				}
+				if err := tx.Migrator().DropColumn(&sessionV6{}, "MFA"); err != nil {
+					return err
+				}
+				for _, column := range sessionUserV6Columns {
+					if err := tx.Migrator().DropColumn(&sessionUserV6{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 7,
+			Name:    "create_passkeys",
+			Up:      core.CreateTables(&passkeyV7{}),
+			Down:    core.DropTables(&passkeyV7{}),
+		},
+		{
+			Version: 8,
+			Name:    "create_user_identities",
+			Up:      core.CreateTables(&userIdentityV8{}, &oidcStateV8{}),
+			Down:    core.DropTables(&oidcStateV8{}, &userIdentityV8{}),
+		},
+		{
+			Version: 9,
+			Name:    "create_api_keys",
+			Up:      core.CreateTables(&apiKeyV9{}),
+			Down:    core.DropTables(&apiKeyV9{}),
+		},
+		{
+			Version: 10,
+			Name:    "create_roles_and_permissions",
+			Up: func(tx *gorm.DB) error {
+				if err := core.CreateTables(&permissionV10{}, &roleV10{}, &rolePermissionV10{}, &userRoleV10{})(tx); err != nil {
+					return err
+				}
+				return seedSuperadminRole(tx)
+			},
+			Down: core.DropTables(&userRoleV10{}, &rolePermissionV10{}, &roleV10{}, &permissionV10{}),
+		},
+		{
+			Version: 11,
+			Name:    "add_login_attempts_and_lockout",
+			Up: func(tx *gorm.DB) error {
+				for _, column := range sessionUserV11Columns {
+					if err := tx.Migrator().AddColumn(&sessionUserV11{}, column); err != nil {
+						return err
+					}
+				}
+				return core.CreateTables(&loginAttemptV11{})(tx)
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := core.DropTables(&loginAttemptV11{})(tx); err != nil {
+					return err
+				}
+				for _, column := range sessionUserV11Columns {
+					if err := tx.Migrator().DropColumn(&sessionUserV11{}, column); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			Version: 12,
+			Name:    "sync_admins_and_superadmins",
+			Up:      syncSuperadmins,
+			// Admins synced with the superadmin role stay valid
+			Down: func(tx *gorm.DB) error { return nil },
+		},
+		{
+			Version: 13,
+			Name:    "add_sessions_user_agent",
+			Up: func(tx *gorm.DB) error {
+				if err := tx.Migrator().AddColumn(&sessionV13{}, "UserAgent"); err != nil {
+					return err
+				}
+				// last_used_loc held the user agent until now
+				return tx.Model(&sessionV1{}).Where("1 = 1").
+					UpdateColumns(map[string]interface{}{"user_agent": gorm.Expr("last_used_loc"), "last_used_loc": ""}).Error
+			},
+			Down: func(tx *gorm.DB) error {
+				if err := tx.Model(&sessionV1{}).Where("1 = 1").UpdateColumn("last_used_loc", gorm.Expr("user_agent")).Error; err != nil {
+					return err
+				}
+				return tx.Migrator().DropColumn(&sessionV13{}, "UserAgent")
+			},
+		},
+	}
+}
@@ -2,6 +2,7 @@ package authentication
 
 import (
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,8 +16,20 @@ var (
 	errExpiredToken = errors.New("token has expired")
 )
 
+// Reasons a session was revoked
+const (
+	revokedRotated        = "rotated"
+	revokedReuseDetected  = "reuse_detected"
+	revokedLoggedOut      = "logged_out"
+	revokedByUser         = "revoked_by_user"
+	revokedPasswordReset  = "password_reset"
+	revokedPasswordChange = "password_changed"
+)
+
 type claims struct {
 	UserID uint `json:"user_id"`
+	Admin  bool `json:"admin,omitempty"`
+	MFA    bool `json:"mfa,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -26,20 +39,48 @@ type (
 
 		Email    string `json:"email" gorm:"uniqueIndex;not null"`
 		Password string `json:"password,omitempty" gorm:"not null"`
+		IsAdmin  bool   `json:"is_admin" gorm:"not null;default:false"`
+
+		EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+		// TOTPSecret is set on enrollment; MFA is enabled once the user
+		// confirmed it with a code. TOTPLastCounter is the time step of
+		// the last accepted code, so that codes can't be replayed.
+		TOTPSecret      string     `json:"-"`
+		TOTPLastCounter int64      `json:"-" gorm:"not null;default:0"`
+		MFAEnabledAt    *time.Time `json:"mfa_enabled_at"`
+
+		// FailedLogins counts the failed password logins in a row, which
+		// delay the next login until LockedUntil
+		FailedLogins int        `json:"-" gorm:"not null;default:0"`
+		LockedUntil  *time.Time `json:"locked_until"`
 	}
 
 	Session struct {
 		core.BaseModel
 
-		User      *SessionUser `json:"-" gorm:"foreignKey:UserID"`
-		UserID    uint         `json:"user_id" gorm:"not null"`
-		Token     string       `json:"token" gorm:"-"`
-		SecretKey []byte       `json:"-" gorm:"-"`
+		User    *SessionUser `json:"-" gorm:"foreignKey:UserID"`
+		UserID  uint         `json:"user_id" gorm:"not null"`
+		Token   string       `json:"token" gorm:"-"`
+		TokenID string       `json:"-" gorm:"index"` // jti claim of Token
+		Keyring *Keyring     `json:"-" gorm:"-"`
 
+		MFA         bool      `json:"mfa" gorm:"not null;default:false"` // the user passed a second factor
 		ExpiresAt   time.Time `json:"expires_at"`
 		LastUsedAt  time.Time `json:"last_used_at"`
 		LastUsedIP  string    `json:"last_used_ip"`
 		LastUsedLoc string    `json:"last_used_loc"`
+		UserAgent   string    `json:"user_agent"`
+
+		// RefreshToken is only set when the session is issued; the
+		// database only keeps its hash. Sessions rotated from the same
+		// login share a FamilyID.
+		RefreshToken     string     `json:"refresh_token,omitempty" gorm:"-"`
+		RefreshTokenHash string     `json:"-" gorm:"index"`
+		RefreshExpiresAt time.Time  `json:"refresh_expires_at"`
+		FamilyID         string     `json:"-" gorm:"index"`
+		RevokedAt        *time.Time `json:"-"`
+		RevokedReason    string     `json:"-"`
 	}
 )
 
@@ -58,40 +99,42 @@ func (u *SessionUser) BeforeSave(tx *gorm.DB) error {
 	return nil
 }
 
+// AfterCreate hook for SessionUser to make the user the owner of their own record
+func (u *SessionUser) AfterCreate(tx *gorm.DB) error {
+	if u.OwnedBy != "" {
+		return nil
+	}
+	u.OwnedBy = ownerID(u.ID)
+	return tx.Model(u).UpdateColumn("owned_by", u.OwnedBy).Error
+}
+
 // ComparePassword compares the given password with the hashed password
 func (u *SessionUser) ComparePassword(password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
 }
 
-// NewSession creates and initializes a new session for the user
-func NewSession(secretKey []byte, user *SessionUser, clientIP, userAgent string) (*Session, error) {
+// NewSession creates and initializes a new session for the user, starting
+// a new refresh token family
+func NewSession(keyring *Keyring, user *SessionUser, clientIP, userAgent string) (*Session, error) {
+	return newSession(keyring, user, false, clientIP, userAgent)
+}
+
+// newSession creates a session, recording whether the user passed a
+// second factor
+func newSession(keyring *Keyring, user *SessionUser, mfa bool, clientIP, userAgent string) (*Session, error) {
 	session := &Session{
-		SecretKey: secretKey,
-		User:      user,
-		UserID:    user.ID,
+		Keyring: keyring,
+		MFA:     mfa,
 	}
-
-	// Create JWT token
-	claims := claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(defaultTokenDuration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-		},
+	if err := session.InitializeSession(user, clientIP, userAgent); err != nil {
+		return nil, err
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(secretKey)
+	familyID, err := generateOpaqueToken()
 	if err != nil {
 		return nil, err
 	}
-
-	session.Token = tokenString
-	session.ExpiresAt = time.Now().Add(defaultTokenDuration)
-
-	// Update session with client info
-	session.UpdateLastUsed(clientIP, userAgent)
+	session.FamilyID = familyID
 	return session, nil
 }
 
@@ -99,9 +142,13 @@ func NewSession(secretKey []byte, user *SessionUser, clientIP, userAgent string)
 func (s *Session) InitializeSession(user *SessionUser, clientIP, userAgent string) error {
 	s.User = user
 	s.UserID = user.ID
+	s.OwnedBy = ownerID(user.ID)
 
 	// Create JWT token
-	if err := s.createToken(defaultTokenDuration); err != nil {
+	if err := s.createToken(accessTokenDuration); err != nil {
+		return err
+	}
+	if err := s.createRefreshToken(refreshTokenDuration); err != nil {
 		return err
 	}
 
@@ -109,3 +156,23 @@ func (s *Session) InitializeSession(user *SessionUser, clientIP, userAgent strin
 	s.UpdateLastUsed(clientIP, userAgent)
 	return nil
 }
+
+// IsEmailVerified reports whether the user proved they own their email
+func (u *SessionUser) IsEmailVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// IsMFAEnabled reports whether logins need a second factor
+func (u *SessionUser) IsMFAEnabled() bool {
+	return u.MFAEnabledAt != nil
+}
+
+// IsRevoked reports whether the session has been revoked
+func (s *Session) IsRevoked() bool {
+	return s.RevokedAt != nil
+}
+
+// ownerID converts a user ID to the BaseModel.OwnedBy representation
+func ownerID(userID uint) string {
+	return strconv.FormatUint(uint64(userID), 10)
+}
@@ -0,0 +1,291 @@
+package authentication
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	oidcHTTPTimeout = time.Second * 10
+	// oidcKeysRefreshInterval bounds how often the provider's JWKS is
+	// fetched again for tokens signed with an unknown key
+	oidcKeysRefreshInterval = time.Minute
+	// oidcClockSkew is the leeway allowed on the ID token's time claims
+	oidcClockSkew = time.Minute
+)
+
+var (
+	errInvalidIDToken = errors.New("invalid ID token")
+	errOIDCProvider   = errors.New("identity provider error")
+)
+
+type (
+	// OIDCProvider configures an OpenID Connect identity provider users
+	// can log in with, e.g. Google. Its endpoints are discovered from the
+	// issuer's /.well-known/openid-configuration.
+	OIDCProvider struct {
+		// Name identifies the provider in the URLs, e.g. "google"
+		Name         string
+		Issuer       string
+		ClientID     string
+		ClientSecret string
+		// RedirectURL is where the provider sends users back with the
+		// code and state to pass to the finish endpoint
+		RedirectURL string
+		// Scopes default to openid, email and profile
+		Scopes     []string
+		HTTPClient *http.Client
+	}
+
+	oidcDiscovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	// oidcClient talks to an identity provider, caching its configuration
+	// and keys
+	oidcClient struct {
+		provider OIDCProvider
+
+		mu            sync.Mutex
+		discovery     *oidcDiscovery
+		keys          map[string]*SigningKey
+		keysFetchedAt time.Time
+	}
+
+	idTokenClaims struct {
+		Nonce           string `json:"nonce"`
+		Email           string `json:"email"`
+		EmailVerified   bool   `json:"email_verified"`
+		Name            string `json:"name"`
+		AuthorizedParty string `json:"azp"`
+		jwt.RegisteredClaims
+	}
+)
+
+func newOIDCClient(provider OIDCProvider) *oidcClient {
+	if len(provider.Scopes) == 0 {
+		provider.Scopes = []string{"openid", "email", "profile"}
+	}
+	if provider.HTTPClient == nil {
+		provider.HTTPClient = &http.Client{Timeout: oidcHTTPTimeout}
+	}
+	provider.Issuer = strings.TrimSuffix(provider.Issuer, "/")
+	return &oidcClient{provider: provider}
+}
+
+// discover fetches the provider's configuration
+func (client *oidcClient) discover(ctx context.Context) (discovery *oidcDiscovery, err error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.discovery != nil {
+		return client.discovery, nil
+	}
+
+	discovery = &oidcDiscovery{}
+	if err = client.getJSON(ctx, client.provider.Issuer+"/.well-known/openid-configuration", discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != client.provider.Issuer {
+		return nil, fmt.Errorf("%w: discovered issuer %s doesn't match", errOIDCProvider, discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: incomplete discovery document", errOIDCProvider)
+	}
+	client.discovery = discovery
+	return
+}
+
+// authorizationURL returns the URL sending the user to the provider for an
+// authorization code, bound to state and nonce and protected by PKCE
+func (client *oidcClient) authorizationURL(ctx context.Context, state, nonce, codeVerifier string) (string, error) {
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	authURL, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errOIDCProvider, err)
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", client.provider.ClientID)
+	query.Set("redirect_uri", client.provider.RedirectURL)
+	query.Set("scope", strings.Join(client.provider.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// exchange redeems an authorization code for the user's ID token
+func (client *oidcClient) exchange(ctx context.Context, code, codeVerifier string) (idToken string, err error) {
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		return
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", client.provider.RedirectURL)
+	form.Set("client_id", client.provider.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if client.provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(client.provider.ClientID), url.QueryEscape(client.provider.ClientSecret))
+	}
+
+	resp, err := client.provider.HTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errOIDCProvider, err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return "", fmt.Errorf("%w: token response: %v", errOIDCProvider, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("%w: token response %d: %s %s", errOIDCProvider, resp.StatusCode, body.Error, body.ErrorDescription)
+	}
+	return body.IDToken, nil
+}
+
+// verifyIDToken checks the ID token was signed by the provider for this
+// client and the login started with nonce
+func (client *oidcClient) verifyIDToken(ctx context.Context, idToken, nonce string) (*idTokenClaims, error) {
+	discovery, err := client.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &idTokenClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := client.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm() {
+			return nil, errInvalidIDToken
+		}
+		return key.public, nil
+	},
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(client.provider.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcClockSkew),
+	)
+	if err != nil {
+		if errors.Is(err, errOIDCProvider) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %v", errInvalidIDToken, err)
+	}
+
+	if claims.Subject == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errInvalidIDToken
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != client.provider.ClientID {
+		return nil, errInvalidIDToken
+	}
+	return claims, nil
+}
+
+// key returns the provider's signing key with the kid, fetching its JWKS
+// again when the key is unknown, e.g. after a rotation
+func (client *oidcClient) key(ctx context.Context, kid string) (*SigningKey, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if key, ok := client.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(client.keysFetchedAt) < oidcKeysRefreshInterval {
+		return nil, errInvalidIDToken
+	}
+
+	var jwks JSONWebKeySet
+	if err := client.getJSON(ctx, client.discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	client.keys = map[string]*SigningKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types can't have signed a valid token
+		if key, err := ParseJSONWebKey(jwk); err == nil {
+			client.keys[jwk.KeyID] = key
+		}
+	}
+	client.keysFetchedAt = time.Now()
+
+	if key, ok := client.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, errInvalidIDToken
+}
+
+// lookupKey finds a cached key. Tokens without a kid are accepted when the
+// provider has a single key.
+func (client *oidcClient) lookupKey(kid string) (*SigningKey, bool) {
+	if kid == "" && len(client.keys) == 1 {
+		for _, key := range client.keys {
+			return key, true
+		}
+	}
+	key, ok := client.keys[kid]
+	return key, ok
+}
+
+func (client *oidcClient) getJSON(ctx context.Context, url string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errOIDCProvider, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.provider.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errOIDCProvider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s: %s", errOIDCProvider, url, resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(target); err != nil {
+		return fmt.Errorf("%w: GET %s: %v", errOIDCProvider, url, err)
+	}
+	return nil
+}
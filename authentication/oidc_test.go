@@ -0,0 +1,340 @@
+package authentication
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testOIDCClientID    = "goweb-client"
+	testOIDCSecret      = "goweb-secret"
+	testOIDCRedirectURL = "https://app.example.com/oidc/callback"
+)
+
+type (
+	// fakeOIDCProvider is an OpenID Connect provider issuing codes for
+	// the users tests log in as
+	fakeOIDCProvider struct {
+		t      *testing.T
+		server *httptest.Server
+		key    *SigningKey
+
+		mu    sync.Mutex
+		codes map[string]fakeOIDCGrant
+	}
+
+	fakeOIDCGrant struct {
+		nonce         string
+		codeChallenge string
+		claims        jwt.MapClaims
+	}
+)
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	key, err := NewPrivateKey(private)
+	assert.NoError(t, err)
+
+	provider := &fakeOIDCProvider{t: t, key: key, codes: map[string]fakeOIDCGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                provider.server.URL,
+			AuthorizationEndpoint: provider.server.URL + "/authorize",
+			TokenEndpoint:         provider.server.URL + "/token",
+			JWKSURI:               provider.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		jwk, _ := provider.key.jwk()
+		json.NewEncoder(w).Encode(JSONWebKeySet{Keys: []JSONWebKey{jwk}})
+	})
+	mux.HandleFunc("/token", provider.token)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func (provider *fakeOIDCProvider) config() OIDCProvider {
+	return OIDCProvider{
+		Name:         "fake",
+		Issuer:       provider.server.URL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCSecret,
+		RedirectURL:  testOIDCRedirectURL,
+	}
+}
+
+// authorize plays the user logging in at the provider, returning the code
+// the provider redirects them back with
+func (provider *fakeOIDCProvider) authorize(authURL, subject, email string, emailVerified bool) string {
+	parsed, err := url.Parse(authURL)
+	assert.NoError(provider.t, err)
+	query := parsed.Query()
+	assert.Equal(provider.t, testOIDCClientID, query.Get("client_id"))
+	assert.Equal(provider.t, testOIDCRedirectURL, query.Get("redirect_uri"))
+	assert.Equal(provider.t, "S256", query.Get("code_challenge_method"))
+	assert.Contains(provider.t, query.Get("scope"), "openid")
+
+	code, _ := generateOpaqueToken()
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	provider.codes[code] = fakeOIDCGrant{
+		nonce:         query.Get("nonce"),
+		codeChallenge: query.Get("code_challenge"),
+		claims: jwt.MapClaims{
+			"sub":            subject,
+			"email":          email,
+			"email_verified": emailVerified,
+		},
+	}
+	return code
+}
+
+func (provider *fakeOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok || clientID != testOIDCClientID || secret != testOIDCSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	provider.mu.Lock()
+	grant, found := provider.codes[r.PostFormValue("code")]
+	delete(provider.codes, r.PostFormValue("code"))
+	provider.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !found || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.codeChallenge ||
+		r.PostFormValue("redirect_uri") != testOIDCRedirectURL {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	grant.claims["nonce"] = grant.nonce
+	json.NewEncoder(w).Encode(map[string]string{"id_token": provider.idToken(grant.claims)})
+}
+
+// idToken signs an ID token for the client, with claims overriding the
+// defaults
+func (provider *fakeOIDCProvider) idToken(claims jwt.MapClaims) string {
+	now := time.Now()
+	tokenClaims := jwt.MapClaims{
+		"iss": provider.server.URL,
+		"aud": testOIDCClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute * 5).Unix(),
+	}
+	for name, value := range claims {
+		tokenClaims[name] = value
+	}
+	token := jwt.NewWithClaims(provider.key.method, tokenClaims)
+	token.Header["kid"] = provider.key.ID()
+	signed, err := token.SignedString(provider.key.private)
+	assert.NoError(provider.t, err)
+	return signed
+}
+
+// oidcLogin logs in through the fake provider
+func oidcLogin(t *testing.T, router *gin.Engine, provider *fakeOIDCProvider, subject, email string, emailVerified bool) *httptest.ResponseRecorder {
+	w := postJSON(router, "/oidc/fake/login/begin", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var begin OIDCBeginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+
+	code := provider.authorize(begin.AuthorizationURL, subject, email, emailVerified)
+	return postJSON(router, "/oidc/fake/login/finish", OIDCFinishRequest{Code: code, State: begin.State})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	provider := newFakeOIDCProvider(t)
+	WithOIDCProvider(provider.config())(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	// The first login creates a user with the verified email
+	w := oidcLogin(t, router, provider, "subject-1", "new@example.com", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var first LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+	assert.Equal(t, "new@example.com", first.User.Email)
+	assert.True(t, first.User.IsEmailVerified())
+
+	// The next ones log the same user in, even when the email changed
+	w = oidcLogin(t, router, provider, "subject-1", "renamed@example.com", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var second LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+	assert.Equal(t, first.User.ID, second.User.ID)
+
+	// Locked accounts can't log in with a provider, and every login is recorded
+	sessMgr.db.Model(&SessionUser{}).Where("id = ?", first.User.ID).UpdateColumn("locked_until", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusTooManyRequests, oidcLogin(t, router, provider, "subject-1", "renamed@example.com", true).Code)
+	sessMgr.db.Model(&SessionUser{}).Where("id = ?", first.User.ID).UpdateColumn("locked_until", nil)
+	var reasons []string
+	sessMgr.db.Model(&LoginAttempt{}).Where("user_id = ?", first.User.ID).Order("id").Pluck("reason", &reasons)
+	assert.Equal(t, []string{"", "", loginLocked}, reasons)
+
+	// Unverified emails aren't trusted
+	assert.Equal(t, http.StatusForbidden, oidcLogin(t, router, provider, "subject-2", "other@example.com", false).Code)
+
+	// States are single use
+	w = postJSON(router, "/oidc/fake/login/begin", nil)
+	var begin OIDCBeginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+	code := provider.authorize(begin.AuthorizationURL, "subject-1", "new@example.com", true)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/oidc/fake/login/finish", OIDCFinishRequest{Code: code, State: begin.State}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/oidc/fake/login/finish", OIDCFinishRequest{Code: code, State: begin.State}).Code)
+
+	// Codes not bound to the state's PKCE verifier are refused by the provider
+	w = postJSON(router, "/oidc/fake/login/begin", nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+	w = postJSON(router, "/oidc/fake/login/finish", OIDCFinishRequest{Code: code, State: begin.State})
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Contains(t, w.Body.String(), CodeIdentityProviderError)
+
+	assert.Equal(t, http.StatusNotFound, postJSON(router, "/oidc/unknown/login/begin", nil).Code)
+}
+
+func TestOIDCLoginLinksExistingEmails(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	provider := newFakeOIDCProvider(t)
+	WithOIDCProvider(provider.config())(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	now := time.Now()
+	verified := &SessionUser{Email: "verified@example.com", Password: "password123", EmailVerifiedAt: &now}
+	sessMgr.db.Create(verified)
+	unverified := &SessionUser{Email: "unverified@example.com", Password: "password123"}
+	sessMgr.db.Create(unverified)
+
+	w := oidcLogin(t, router, provider, "subject-1", "verified@example.com", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, verified.ID, resp.User.ID)
+
+	// Whoever registered an unverified email doesn't get the identity
+	assert.Equal(t, http.StatusConflict, oidcLogin(t, router, provider, "subject-2", "unverified@example.com", true).Code)
+
+	// Users with MFA still need their second factor
+	mfaUser(t, sessMgr, "mfa@example.com")
+	sessMgr.db.Model(&SessionUser{}).Where("email = ?", "mfa@example.com").UpdateColumn("email_verified_at", now)
+	w = oidcLogin(t, router, provider, "subject-3", "mfa@example.com", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "mfa_token")
+}
+
+func TestOIDCLinkIdentity(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	provider := newFakeOIDCProvider(t)
+	WithOIDCProvider(provider.config())(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	authRequest := func(session *Session, method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(payload)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	link := func(session *Session, subject string) *httptest.ResponseRecorder {
+		w := authRequest(session, http.MethodPost, "/oidc/fake/link/begin", nil)
+		assert.Equal(t, http.StatusOK, w.Code)
+		var begin OIDCBeginResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+		code := provider.authorize(begin.AuthorizationURL, subject, "someone@example.com", false)
+		return authRequest(session, http.MethodPost, "/oidc/fake/link/finish", OIDCFinishRequest{Code: code, State: begin.State})
+	}
+	newUserSession := func(email string) *Session {
+		user := &SessionUser{Email: email, Password: "password123"}
+		sessMgr.db.Create(user)
+		session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+		assert.NoError(t, err)
+		sessMgr.db.Create(session)
+		return session
+	}
+	alice, bob := newUserSession("alice@example.com"), newUserSession("bob@example.com")
+
+	// Linking doesn't need a verified email
+	w := link(alice, "subject-1")
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var identity UserIdentity
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &identity))
+	assert.Equal(t, http.StatusOK, link(alice, "subject-1").Code)
+	assert.Equal(t, http.StatusConflict, link(bob, "subject-1").Code)
+
+	// The linked identity logs alice in
+	w = oidcLogin(t, router, provider, "subject-1", "someone@example.com", false)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, alice.UserID, resp.User.ID)
+
+	// A state started by one user can't be finished by another
+	w = authRequest(alice, http.MethodPost, "/oidc/fake/link/begin", nil)
+	var begin OIDCBeginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &begin))
+	code := provider.authorize(begin.AuthorizationURL, "subject-2", "", false)
+	assert.Equal(t, http.StatusBadRequest, authRequest(bob, http.MethodPost, "/oidc/fake/link/finish", OIDCFinishRequest{Code: code, State: begin.State}).Code)
+
+	assert.Contains(t, authRequest(alice, http.MethodGet, "/identities", nil).Body.String(), "subject-1")
+	assert.Equal(t, http.StatusNotFound, authRequest(bob, http.MethodDelete, fmt.Sprintf("/identities/%d", identity.ID), nil).Code)
+	assert.Equal(t, http.StatusNoContent, authRequest(alice, http.MethodDelete, fmt.Sprintf("/identities/%d", identity.ID), nil).Code)
+	assert.Equal(t, http.StatusCreated, link(bob, "subject-1").Code)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	client := newOIDCClient(provider.config())
+	ctx := context.Background()
+
+	claims, err := client.verifyIDToken(ctx, provider.idToken(jwt.MapClaims{"sub": "subject-1", "nonce": "nonce"}), "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, "subject-1", claims.Subject)
+
+	for name, override := range map[string]jwt.MapClaims{
+		"wrong nonce":    {"nonce": "other"},
+		"wrong audience": {"aud": "other-client"},
+		"wrong issuer":   {"iss": "https://evil.example.com"},
+		"expired":        {"exp": time.Now().Add(-time.Hour).Unix()},
+		"no subject":     {"sub": ""},
+		"foreign azp":    {"aud": []string{testOIDCClientID, "other-client"}, "azp": "other-client"},
+	} {
+		tokenClaims := jwt.MapClaims{"sub": "subject-1", "nonce": "nonce"}
+		for name, value := range override {
+			tokenClaims[name] = value
+		}
+		_, err := client.verifyIDToken(ctx, provider.idToken(tokenClaims), "nonce")
+		assert.ErrorIs(t, err, errInvalidIDToken, name)
+	}
+
+	// Tokens signed by another key
+	other := newFakeOIDCProvider(t)
+	other.server.URL = provider.server.URL
+	_, err = client.verifyIDToken(ctx, other.idToken(jwt.MapClaims{"sub": "subject-1", "nonce": "nonce"}), "nonce")
+	assert.ErrorIs(t, err, errInvalidIDToken)
+}
@@ -0,0 +1,409 @@
+package authentication
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const passkeyChallengeDuration = time.Minute * 5
+
+type (
+	// Passkey is a WebAuthn credential registered by a user to log in
+	// without a password
+	Passkey struct {
+		core.BaseModel
+
+		UserID       uint       `json:"user_id" gorm:"not null;index"`
+		Name         string     `json:"name"`
+		CredentialID string     `json:"credential_id" gorm:"uniqueIndex;not null"` // base64url
+		PublicKey    []byte     `json:"-" gorm:"not null"`                         // COSE_Key
+		Algorithm    int64      `json:"algorithm"`
+		SignCount    uint32     `json:"sign_count"`
+		AAGUID       string     `json:"aaguid"`
+		LastUsedAt   *time.Time `json:"last_used_at"`
+	}
+
+	// PasskeyCredential is a PublicKeyCredential in the WebAuthn JSON
+	// serialization, as returned by its toJSON method
+	PasskeyCredential struct {
+		ID       string `json:"id" binding:"required"`
+		Type     string `json:"type" binding:"required,eq=public-key"`
+		Response struct {
+			ClientDataJSON    base64URL `json:"clientDataJSON"`
+			AttestationObject base64URL `json:"attestationObject,omitempty"`
+			AuthenticatorData base64URL `json:"authenticatorData,omitempty"`
+			Signature         base64URL `json:"signature,omitempty"`
+			UserHandle        base64URL `json:"userHandle,omitempty"`
+		} `json:"response"`
+	}
+
+	PasskeyRegistrationRequest struct {
+		Name       string            `json:"name"`
+		Credential PasskeyCredential `json:"credential"`
+	}
+
+	PasskeyLoginBeginRequest struct {
+		Email string `json:"email" binding:"omitempty,email"`
+	}
+
+	PasskeyLoginRequest struct {
+		Credential PasskeyCredential `json:"credential"`
+	}
+
+	// PasskeyCreationOptions are the PublicKeyCredentialCreationOptions to
+	// pass to navigator.credentials.create
+	PasskeyCreationOptions struct {
+		Challenge              string               `json:"challenge"`
+		RP                     passkeyEntity        `json:"rp"`
+		User                   passkeyEntity        `json:"user"`
+		PubKeyCredParams       []passkeyParameter   `json:"pubKeyCredParams"`
+		Timeout                int64                `json:"timeout"`
+		ExcludeCredentials     []passkeyDescriptor  `json:"excludeCredentials"`
+		AuthenticatorSelection passkeyAuthSelection `json:"authenticatorSelection"`
+		Attestation            string               `json:"attestation"`
+	}
+
+	// PasskeyRequestOptions are the PublicKeyCredentialRequestOptions to
+	// pass to navigator.credentials.get
+	PasskeyRequestOptions struct {
+		Challenge        string              `json:"challenge"`
+		RPID             string              `json:"rpId"`
+		Timeout          int64               `json:"timeout"`
+		AllowCredentials []passkeyDescriptor `json:"allowCredentials"`
+		UserVerification string              `json:"userVerification"`
+	}
+
+	passkeyEntity struct {
+		ID          string `json:"id,omitempty"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName,omitempty"`
+	}
+
+	passkeyParameter struct {
+		Type string `json:"type"`
+		Alg  int64  `json:"alg"`
+	}
+
+	passkeyDescriptor struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+
+	passkeyAuthSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	}
+)
+
+// BeginPasskeyRegistrationHandler returns the options to create a passkey
+// for the user with
+func (sessMgr *SessionManager) BeginPasskeyRegistrationHandler(c *gin.Context) {
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+
+	passkeys, err := sessMgr.userPasskeys(user.ID)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch passkeys", err))
+		return
+	}
+	challenge, err := issueUserToken(sessMgr.db, user.ID, purposePasskeyCreation, passkeyChallengeDuration)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to create passkey challenge", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, PasskeyCreationOptions{
+		Challenge: challenge,
+		RP:        passkeyEntity{ID: sessMgr.relyingParty.ID, Name: sessMgr.relyingParty.Name},
+		User: passkeyEntity{
+			ID:          base64.RawURLEncoding.EncodeToString(userHandle(user.ID)),
+			Name:        user.Email,
+			DisplayName: user.Email,
+		},
+		PubKeyCredParams: []passkeyParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+		},
+		Timeout:            passkeyChallengeDuration.Milliseconds(),
+		ExcludeCredentials: passkeyDescriptors(passkeys),
+		AuthenticatorSelection: passkeyAuthSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	})
+}
+
+// FinishPasskeyRegistrationHandler verifies the credential created by the
+// authenticator and saves it
+func (sessMgr *SessionManager) FinishPasskeyRegistrationHandler(c *gin.Context) {
+	var req PasskeyRegistrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	user, ok := sessMgr.currentUser(c)
+	if !ok {
+		return
+	}
+
+	rp := sessMgr.relyingParty
+	response := req.Credential.Response
+	clientData, err := rp.verifyClientData(response.ClientDataJSON, webauthnCreate)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("Invalid passkey registration"))
+		return
+	}
+	challenge, err := consumeUserToken(sessMgr.db, purposePasskeyCreation, clientData.Challenge)
+	if err != nil || challenge.UserID != user.ID {
+		core.AbortWithError(c, core.BadRequest("Invalid or expired passkey challenge"))
+		return
+	}
+
+	authData, err := attestedAuthenticatorData(response.AttestationObject)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("Invalid passkey registration"))
+		return
+	}
+	data, err := rp.verifyAuthenticatorData(authData)
+	if err != nil || data.credentialID == nil {
+		core.AbortWithError(c, core.BadRequest("Invalid passkey registration"))
+		return
+	}
+	credentialID := base64.RawURLEncoding.EncodeToString(data.credentialID)
+	if credentialID != req.Credential.ID {
+		core.AbortWithError(c, core.BadRequest("Invalid passkey registration"))
+		return
+	}
+	_, alg, err := parseCOSEKey(data.publicKey)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("Unsupported passkey algorithm"))
+		return
+	}
+
+	var count int64
+	if err := sessMgr.db.Model(&Passkey{}).Where("credential_id = ?", credentialID).Count(&count).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to check passkey", err))
+		return
+	}
+	if count > 0 {
+		core.AbortWithError(c, core.Conflict("Passkey already registered"))
+		return
+	}
+
+	passkey := &Passkey{
+		UserID:       user.ID,
+		Name:         req.Name,
+		CredentialID: credentialID,
+		PublicKey:    data.publicKey,
+		Algorithm:    alg,
+		SignCount:    data.signCount,
+		AAGUID:       hex.EncodeToString(data.aaguid),
+	}
+	passkey.OwnedBy = ownerID(user.ID)
+	if err := sessMgr.db.Create(passkey).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to save passkey", err))
+		return
+	}
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// GetPasskeysHandler lists the user's passkeys
+func (sessMgr *SessionManager) GetPasskeysHandler(c *gin.Context) {
+	passkeys, err := sessMgr.userPasskeys(sessMgr.GetUserID(c))
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch passkeys", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"passkeys": passkeys})
+}
+
+// DeletePasskeyHandler deletes one of the user's passkeys
+func (sessMgr *SessionManager) DeletePasskeyHandler(c *gin.Context) {
+	passkeyID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid passkey ID"))
+		return
+	}
+
+	// Passkeys are deleted for good, so that they can be registered again
+	result := sessMgr.db.Unscoped().Where("id = ? AND user_id = ?", passkeyID, sessMgr.GetUserID(c)).Delete(&Passkey{})
+	if result.Error != nil {
+		core.AbortWithError(c, core.Internal("Failed to delete passkey", result.Error))
+		return
+	}
+	if result.RowsAffected == 0 {
+		core.AbortWithError(c, core.NotFound("passkey not found"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// BeginPasskeyLoginHandler returns the options to sign in with a passkey.
+// Without an email, any discoverable passkey of the site can be used.
+func (sessMgr *SessionManager) BeginPasskeyLoginHandler(c *gin.Context) {
+	var req PasskeyLoginBeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var userID uint
+	allowCredentials := []passkeyDescriptor{}
+	if req.Email != "" {
+		var user SessionUser
+		err := sessMgr.db.Where("email = ?", req.Email).First(&user).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			core.AbortWithError(c, core.Internal("Failed to find user", err))
+			return
+		}
+		if err == nil {
+			passkeys, err := sessMgr.userPasskeys(user.ID)
+			if err != nil {
+				core.AbortWithError(c, core.Internal("Failed to fetch passkeys", err))
+				return
+			}
+			userID, allowCredentials = user.ID, passkeyDescriptors(passkeys)
+		}
+	}
+
+	// Challenges of different login attempts don't replace each other,
+	// as they may not be bound to a user
+	challenge, err := createUserToken(sessMgr.db, userID, purposePasskeyLogin, passkeyChallengeDuration)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to create passkey challenge", err))
+		return
+	}
+	// Drop the challenges that were used or never answered
+	err = sessMgr.db.Unscoped().
+		Where("purpose = ? AND (used_at IS NOT NULL OR expires_at < ?)", purposePasskeyLogin, time.Now()).
+		Delete(&UserToken{}).Error
+	if err != nil {
+		_ = c.Error(fmt.Errorf("failed to delete expired passkey challenges: %w", err))
+	}
+
+	c.JSON(http.StatusOK, PasskeyRequestOptions{
+		Challenge:        challenge,
+		RPID:             sessMgr.relyingParty.ID,
+		Timeout:          passkeyChallengeDuration.Milliseconds(),
+		AllowCredentials: allowCredentials,
+		UserVerification: "preferred",
+	})
+}
+
+// FinishPasskeyLoginHandler verifies the assertion signed by the
+// authenticator and starts a session. Assertions with user verification
+// (PIN or biometrics) count as multi-factor.
+func (sessMgr *SessionManager) FinishPasskeyLoginHandler(c *gin.Context) {
+	var req PasskeyLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	passkey, data, err := sessMgr.verifyPasskeyAssertion(&req.Credential)
+	if err != nil {
+		if errors.Is(err, errInvalidWebAuthn) {
+			core.AbortWithError(c, core.Unauthorized("Invalid passkey"))
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to verify passkey", err))
+		return
+	}
+
+	var user SessionUser
+	if err := sessMgr.db.First(&user, passkey.UserID).Error; err != nil {
+		core.AbortWithError(c, core.Unauthorized("Invalid passkey"))
+		return
+	}
+	sessMgr.completeLogin(c, &user, data.userVerified())
+}
+
+// verifyPasskeyAssertion checks an assertion against its challenge and the
+// stored passkey, and records the passkey's use
+func (sessMgr *SessionManager) verifyPasskeyAssertion(credential *PasskeyCredential) (passkey *Passkey, data *authenticatorData, err error) {
+	rp := sessMgr.relyingParty
+	response := credential.Response
+	clientData, err := rp.verifyClientData(response.ClientDataJSON, webauthnGet)
+	if err != nil {
+		return
+	}
+	challenge, err := consumeUserToken(sessMgr.db, purposePasskeyLogin, clientData.Challenge)
+	if errors.Is(err, errInvalidUserToken) || errors.Is(err, errExpiredUserToken) {
+		return nil, nil, errInvalidWebAuthn
+	} else if err != nil {
+		return
+	}
+
+	passkey = &Passkey{}
+	err = sessMgr.db.Where("credential_id = ?", credential.ID).First(passkey).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, errInvalidWebAuthn
+	} else if err != nil {
+		return
+	}
+	if challenge.UserID != 0 && challenge.UserID != passkey.UserID {
+		return nil, nil, errInvalidWebAuthn
+	}
+	if response.UserHandle != nil && string(response.UserHandle) != string(userHandle(passkey.UserID)) {
+		return nil, nil, errInvalidWebAuthn
+	}
+
+	if data, err = rp.verifyAuthenticatorData(response.AuthenticatorData); err != nil {
+		return
+	}
+	if err = verifyAssertion(passkey.PublicKey, response.AuthenticatorData, response.ClientDataJSON, response.Signature); err != nil {
+		return
+	}
+
+	// A counter that doesn't increase reveals a cloned authenticator.
+	// Authenticators without a counter always report 0.
+	if (data.signCount != 0 || passkey.SignCount != 0) && data.signCount <= passkey.SignCount {
+		return nil, nil, errInvalidWebAuthn
+	}
+	result := sessMgr.db.Model(&Passkey{}).
+		Where("id = ? AND sign_count = ?", passkey.ID, passkey.SignCount).
+		UpdateColumns(map[string]interface{}{
+			"sign_count":   data.signCount,
+			"last_used_at": time.Now(),
+		})
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil, errInvalidWebAuthn
+	}
+	return
+}
+
+// userPasskeys returns the passkeys of the user
+func (sessMgr *SessionManager) userPasskeys(userID uint) (passkeys []Passkey, err error) {
+	err = sessMgr.db.Where("user_id = ?", userID).Order("created_at").Find(&passkeys).Error
+	return
+}
+
+// passkeyDescriptors lists passkeys to the authenticator
+func passkeyDescriptors(passkeys []Passkey) []passkeyDescriptor {
+	descriptors := make([]passkeyDescriptor, len(passkeys))
+	for idx, passkey := range passkeys {
+		descriptors[idx] = passkeyDescriptor{Type: "public-key", ID: passkey.CredentialID}
+	}
+	return descriptors
+}
+
+// userHandle is the WebAuthn user ID of a user
+func userHandle(userID uint) []byte {
+	return []byte(strconv.FormatUint(uint64(userID), 10))
+}
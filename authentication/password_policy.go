@@ -0,0 +1,247 @@
+package authentication
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gsarmaonline/goweb/core"
+)
+
+// bcryptMaxBytes is the length past which bcrypt ignores passwords
+const bcryptMaxBytes = 72
+
+// Password policy rules
+const (
+	PasswordRuleMinLength = "min_length"
+	PasswordRuleMaxLength = "max_length"
+	PasswordRuleUpper     = "uppercase"
+	PasswordRuleLower     = "lowercase"
+	PasswordRuleDigit     = "digit"
+	PasswordRuleSymbol    = "symbol"
+	PasswordRuleEmail     = "email"
+	PasswordRuleBreached  = "breached"
+)
+
+// minEmailSubstring is the shortest email local part refused in passwords
+const minEmailSubstring = 3
+
+type (
+	// PasswordPolicy decides which passwords users may choose when they
+	// register, reset or change their password. Zero values disable the
+	// corresponding rule.
+	PasswordPolicy struct {
+		// MinLength counts characters, MaxBytes bytes: bcrypt ignores
+		// everything past 72 bytes
+		MinLength int
+		MaxBytes  int
+		// Character classes passwords must contain
+		RequireUpper  bool
+		RequireLower  bool
+		RequireDigit  bool
+		RequireSymbol bool
+		// DisallowEmail refuses passwords containing the local part of the
+		// user's email
+		DisallowEmail bool
+		// Breached refuses passwords known to have leaked, see
+		// LoadBreachedPasswords and BreachedPasswordRanges
+		Breached BreachedPasswords
+		// Rules are extra checks, run after the built-in ones
+		Rules []PasswordRule
+	}
+
+	// PasswordRule is a custom password check. Check returns why the
+	// password is refused, or an empty string.
+	PasswordRule struct {
+		Name  string
+		Check func(password, email string) string
+	}
+
+	// BreachedPasswords reports whether passwords are known to have leaked.
+	// Implementations get the password's uppercase hex SHA-1 hash.
+	BreachedPasswords interface {
+		Contains(sha1Hash string) (bool, error)
+	}
+
+	// breachedHashes is a breached password list held in memory
+	breachedHashes map[string]struct{}
+
+	// breachedRanges is a breached password list split in range files
+	breachedRanges string
+)
+
+// DefaultPasswordPolicy requires 8 characters, at most 72 bytes, and refuses
+// passwords containing the email
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:     8,
+	MaxBytes:      bcryptMaxBytes,
+	DisallowEmail: true,
+}
+
+// WithPasswordPolicy replaces DefaultPasswordPolicy
+func WithPasswordPolicy(policy PasswordPolicy) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.passwordPolicy = policy
+	}
+}
+
+// Validate checks the password of the user with email against every rule of
+// the policy. Broken rules are reported together as core.ErrInvalidFields on
+// field, one per rule.
+func (policy PasswordPolicy) Validate(field, password, email string) error {
+	var fieldErrs core.ErrInvalidFields
+	violate := func(rule, message string) {
+		fieldErrs = append(fieldErrs, core.ErrInvalidField{Field: field, Message: message, Rule: rule})
+	}
+
+	if policy.MinLength > 0 && utf8.RuneCountInString(password) < policy.MinLength {
+		violate(PasswordRuleMinLength, fmt.Sprintf("must be at least %d characters long", policy.MinLength))
+	}
+	if policy.MaxBytes > 0 && len(password) > policy.MaxBytes {
+		violate(PasswordRuleMaxLength, fmt.Sprintf("must be at most %d bytes long", policy.MaxBytes))
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			upper = true
+		case unicode.IsLower(char):
+			lower = true
+		case unicode.IsDigit(char):
+			digit = true
+		case !unicode.IsLetter(char) && !unicode.IsSpace(char):
+			symbol = true
+		}
+	}
+	if policy.RequireUpper && !upper {
+		violate(PasswordRuleUpper, "must contain an uppercase letter")
+	}
+	if policy.RequireLower && !lower {
+		violate(PasswordRuleLower, "must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !digit {
+		violate(PasswordRuleDigit, "must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		violate(PasswordRuleSymbol, "must contain a symbol")
+	}
+
+	if policy.DisallowEmail && email != "" {
+		local, _, _ := strings.Cut(strings.ToLower(email), "@")
+		if utf8.RuneCountInString(local) >= minEmailSubstring && strings.Contains(strings.ToLower(password), local) {
+			violate(PasswordRuleEmail, "must not contain your email")
+		}
+	}
+
+	if policy.Breached != nil {
+		breached, err := policy.Breached.Contains(passwordSHA1(password))
+		if err != nil {
+			return fmt.Errorf("failed to check breached passwords: %w", err)
+		}
+		if breached {
+			violate(PasswordRuleBreached, "appeared in a data breach, choose another one")
+		}
+	}
+
+	for _, rule := range policy.Rules {
+		if message := rule.Check(password, email); message != "" {
+			violate(rule.Name, message)
+		}
+	}
+
+	if len(fieldErrs) == 0 {
+		return nil
+	}
+	return fieldErrs
+}
+
+// LoadBreachedPasswords loads a list of breached passwords from a file of
+// SHA-1 hashes, one per line, like the Pwned Passwords downloads. Counts
+// after a colon are ignored, except for the zero counts padding responses.
+func LoadBreachedPasswords(path string) (BreachedPasswords, error) {
+	hashes := breachedHashes{}
+	err := readBreachedHashes(path, func(hash string) error {
+		if len(hash) != sha1.Size*2 {
+			return errors.New("not a SHA-1 hash")
+		}
+		hashes[hash] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// BreachedPasswordRanges checks passwords against breached password hashes
+// split by their first 5 hex characters, the k-anonymity ranges of Pwned
+// Passwords: dir/ABCDE.txt lists the remaining 35 characters of the hashes
+// starting with ABCDE. Only the range of a password is read, when it is
+// checked, and missing ranges hold no breached password.
+func BreachedPasswordRanges(dir string) BreachedPasswords {
+	return breachedRanges(dir)
+}
+
+func (hashes breachedHashes) Contains(sha1Hash string) (bool, error) {
+	_, found := hashes[sha1Hash]
+	return found, nil
+}
+
+func (dir breachedRanges) Contains(sha1Hash string) (found bool, err error) {
+	prefix, suffix := sha1Hash[:5], sha1Hash[5:]
+	err = readBreachedHashes(filepath.Join(string(dir), prefix+".txt"), func(hash string) error {
+		if hash == suffix {
+			found = true
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return
+}
+
+// readBreachedHashes calls add with the uppercase hashes of a breached
+// password file, skipping blank lines, comments and zero counts
+func readBreachedHashes(path string, add func(hash string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		hash, count, _ := strings.Cut(text, ":")
+		if strings.TrimSpace(count) == "0" {
+			continue
+		}
+		hash = strings.ToUpper(strings.TrimSpace(hash))
+		if strings.Trim(hash, "0123456789ABCDEF") != "" {
+			return fmt.Errorf("%s:%d: not a hex hash", path, line)
+		}
+		if err := add(hash); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// passwordSHA1 returns the uppercase hex SHA-1 hash breached password lists
+// are keyed by
+func passwordSHA1(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
@@ -0,0 +1,166 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{
+		MinLength:     10,
+		MaxBytes:      bcryptMaxBytes,
+		RequireUpper:  true,
+		RequireLower:  true,
+		RequireDigit:  true,
+		RequireSymbol: true,
+		DisallowEmail: true,
+		Rules: []PasswordRule{{Name: "no_repeats", Check: func(password, email string) string {
+			if strings.Contains(password, "aaa") {
+				return "must not repeat characters"
+			}
+			return ""
+		}}},
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		rules    []string
+	}{
+		{"strong", "Correct-Horse-7", nil},
+		{"unicode", "Éléphant-Rose-7", nil},
+		{"short", "Ab1-", []string{PasswordRuleMinLength}},
+		{"too long for bcrypt", "Aa1-" + strings.Repeat("x", 69), []string{PasswordRuleMaxLength}},
+		{"letters only", "correcthorsebattery", []string{PasswordRuleUpper, PasswordRuleDigit, PasswordRuleSymbol}},
+		{"email", "Jane.Doe-2024", []string{PasswordRuleEmail}},
+		{"custom rule", "Baaad-Horse-7", []string{"no_repeats"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Validate("password", tt.password, "jane.doe@example.com")
+			if tt.rules == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var fieldErrs core.ErrInvalidFields
+			assert.ErrorAs(t, err, &fieldErrs)
+			var rules []string
+			for _, fieldErr := range fieldErrs {
+				assert.Equal(t, "password", fieldErr.Field)
+				rules = append(rules, fieldErr.Rule)
+			}
+			assert.Equal(t, tt.rules, rules)
+		})
+	}
+
+	// Short email local parts are allowed in passwords
+	assert.NoError(t, DefaultPasswordPolicy.Validate("password", "joseph-and-co", "jo@example.com"))
+}
+
+func TestBreachedPasswords(t *testing.T) {
+	dir := t.TempDir()
+	list := filepath.Join(dir, "breached.txt")
+	assert.NoError(t, os.WriteFile(list, []byte("# Pwned Passwords\n"+
+		passwordSHA1("password123")+":2254650\n"+
+		strings.ToLower(passwordSHA1("qwertyuiop"))+"\n\n"+
+		passwordSHA1("padding-entry")+":0\n"), 0o600))
+
+	// A range holds the hash suffixes of its prefix
+	hash := passwordSHA1("letmein2024")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, hash[:5]+".txt"), []byte(hash[5:]+":12\r\n"), 0o600))
+
+	hashes, err := LoadBreachedPasswords(list)
+	assert.NoError(t, err)
+	lists := map[string]struct {
+		breached BreachedPasswords
+		found    map[string]bool
+	}{
+		"hash list": {hashes, map[string]bool{"password123": true, "qwertyuiop": true}},
+		"ranges":    {BreachedPasswordRanges(dir), map[string]bool{"letmein2024": true}},
+	}
+	for name, list := range lists {
+		policy := PasswordPolicy{Breached: list.breached}
+		for _, password := range []string{"password123", "qwertyuiop", "letmein2024", "padding-entry", "Correct-Horse"} {
+			err := policy.Validate("password", password, "")
+			if list.found[password] {
+				assert.Equal(t, core.ErrInvalidFields{{Field: "password", Message: "appeared in a data breach, choose another one", Rule: PasswordRuleBreached}}, err, name+": "+password)
+			} else {
+				assert.NoError(t, err, name+": "+password)
+			}
+		}
+	}
+
+	assert.NoError(t, os.WriteFile(list, []byte("ABCDEF\n"), 0o600))
+	_, err = LoadBreachedPasswords(list)
+	assert.ErrorContains(t, err, "breached.txt:1: not a SHA-1 hash")
+	_, err = LoadBreachedPasswords(filepath.Join(dir, "missing.txt"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPasswordPolicyEndpoints(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	mailer := &recordingMailer{}
+	WithMailer(mailer)(sessMgr)
+	WithPasswordResetURL("https://app.example.com/reset")(sessMgr)
+	WithPasswordPolicy(PasswordPolicy{MinLength: 8, DisallowEmail: true, RequireDigit: true})(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	fields := func(body []byte) []core.FieldError {
+		var envelope struct {
+			Error core.Error `json:"error"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &envelope))
+		return envelope.Error.Fields
+	}
+
+	// Every broken rule is reported
+	w := postJSON(router, "/register", map[string]string{"email": "test@example.com", "password": "test"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, []core.FieldError{
+		{Field: "password", Message: "must be at least 8 characters long", Rule: PasswordRuleMinLength},
+		{Field: "password", Message: "must contain a digit", Rule: PasswordRuleDigit},
+		{Field: "password", Message: "must not contain your email", Rule: PasswordRuleEmail},
+	}, fields(w.Body.Bytes()))
+	assert.Equal(t, http.StatusCreated, postJSON(router, "/register", map[string]string{"email": "test@example.com", "password": "password123"}).Code)
+
+	// Resets keep the token usable when the password is refused
+	assert.Equal(t, http.StatusOK, postJSON(router, "/forgot-password", map[string]string{"email": "test@example.com"}).Code)
+	token := mailer.lastLinkToken(t)
+	w = postJSON(router, "/reset-password", map[string]string{"token": token, "password": "my-test-password1"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, []core.FieldError{{Field: "password", Message: "must not contain your email", Rule: PasswordRuleEmail}}, fields(w.Body.Bytes()))
+	assert.Equal(t, http.StatusOK, postJSON(router, "/reset-password", map[string]string{"token": token, "password": "newpassword1"}).Code)
+
+	// Changes report the new_password field
+	w = postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "newpassword1"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var response LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	req := httptest.NewRequest(http.MethodPost, "/change-password", strings.NewReader(`{"current_password": "newpassword1", "new_password": "newpassword"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", bearerSchema+response.Session.Token)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, []core.FieldError{{Field: "new_password", Message: "must contain a digit", Rule: PasswordRuleDigit}}, fields(w.Body.Bytes()))
+
+	// Logins don't apply the policy, so that older passwords keep working
+	sessMgr.db.Create(&SessionUser{Email: "legacy@example.com", Password: "abc1"})
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login", map[string]string{"email": "legacy@example.com", "password": "abc1"}).Code)
+
+	// The superadmin bootstrap password follows the policy too
+	WithSuperadmin("root@example.com", "rootpassword")(sessMgr)
+	err := sessMgr.Init(context.Background(), nil)
+	assert.ErrorContains(t, err, "superadmin root@example.com: password: must contain a digit; password: must not contain your email")
+}
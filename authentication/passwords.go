@@ -0,0 +1,197 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const passwordResetTokenDuration = time.Hour
+
+type (
+	ForgotPasswordRequest struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	// ResetPasswordRequest and ChangePasswordRequest's new passwords must
+	// satisfy the PasswordPolicy
+	ResetPasswordRequest struct {
+		Token    string `json:"token" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+
+	ChangePasswordRequest struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+)
+
+// ForgotPasswordHandler mails a password reset token, at most once a minute
+// per user. The response doesn't reveal whether the email is registered:
+// throttled and failed emails are only logged.
+func (sessMgr *SessionManager) ForgotPasswordHandler(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var user SessionUser
+	err := sessMgr.db.Where("email = ?", req.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		core.AbortWithError(c, core.Internal("Failed to find user", err))
+		return
+	}
+
+	if err == nil {
+		err := sessMgr.mailUserTokenOnce(c, &user, tokenEmail{
+			purpose:  purposePasswordReset,
+			duration: passwordResetTokenDuration,
+			url:      sessMgr.passwordResetURL,
+			subject:  "Reset your password",
+			action:   "reset your password",
+		})
+		if err != nil {
+			_ = c.Error(fmt.Errorf("failed to send password reset email: %w", err))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered, a password reset email has been sent"})
+}
+
+// ResetPasswordHandler sets a new password with the token the user was
+// mailed and logs out all their sessions. Resetting the password also
+// proves the user owns their email.
+func (sessMgr *SessionManager) ResetPasswordHandler(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var user SessionUser
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, purposePasswordReset, req.Token)
+		if err != nil {
+			return err
+		}
+		// Tokens of deleted users are as good as unknown ones
+		err = tx.First(&user, userToken.UserID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errInvalidUserToken
+		} else if err != nil {
+			return err
+		}
+		// Refused passwords leave the token usable
+		if err := sessMgr.passwordPolicy.Validate("password", req.Password, user.Email); err != nil {
+			return err
+		}
+
+		// BeforeSave hashes the new password. Proving they own the email
+		// also unlocks the account.
+		user.Password = req.Password
+		user.FailedLogins, user.LockedUntil = 0, nil
+		if user.EmailVerifiedAt == nil {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+		}
+		return tx.Save(&user).Error
+	})
+	switch {
+	case errors.Is(err, errInvalidUserToken):
+		core.AbortWithError(c, core.BadRequest("Invalid or already used password reset token"))
+		return
+	case errors.Is(err, errExpiredUserToken):
+		core.AbortWithError(c, core.BadRequest("Password reset token has expired"))
+		return
+	case errors.As(err, new(core.ErrInvalidFields)):
+		core.AbortWithError(c, err)
+		return
+	case err != nil:
+		core.AbortWithError(c, core.Internal("Failed to reset password", err))
+		return
+	}
+
+	err = sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ?", user.ID)
+	}, revokedPasswordReset)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke sessions", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// ChangePasswordHandler changes the authenticated user's password and logs
+// out their other sessions. Wrong current passwords count as failed logins,
+// see LoginThrottle.
+func (sessMgr *SessionManager) ChangePasswordHandler(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var user SessionUser
+	if err := sessMgr.db.First(&user, sessMgr.GetUserID(c)).Error; err != nil {
+		core.AbortWithError(c, core.Unauthorized("Not authenticated"))
+		return
+	}
+	if err := sessMgr.checkCurrentPassword(c, &user, req.CurrentPassword); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	if err := sessMgr.passwordPolicy.Validate("new_password", req.NewPassword, user.Email); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	// BeforeSave hashes the new password
+	user.Password = req.NewPassword
+	if err := sessMgr.db.Save(&user).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to change password", err))
+		return
+	}
+
+	tokenID := c.GetString(tokenIDKey)
+	err := sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ? AND token_id <> ?", user.ID, tokenID)
+	}, revokedPasswordChange)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke sessions", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been changed"})
+}
+
+// checkCurrentPassword verifies the password of a logged in user through
+// the login throttle, so that stolen sessions can't brute-force it. Wrong
+// passwords are recorded and count as failed logins.
+func (sessMgr *SessionManager) checkCurrentPassword(c *gin.Context, user *SessionUser, password string) error {
+	if err := sessMgr.checkIPThrottle(c.ClientIP()); err != nil {
+		sessMgr.recordLoginAttempt(c, user.Email, user.ID, loginIPThrottled)
+		return err
+	}
+	if err := sessMgr.checkLocked(c, user); err != nil {
+		sessMgr.recordLoginAttempt(c, user.Email, user.ID, loginLocked)
+		return err
+	}
+	if err := user.ComparePassword(password); err != nil {
+		sessMgr.recordLoginAttempt(c, user.Email, user.ID, loginInvalidPassword)
+		if err := sessMgr.failLogin(c, user); err != nil {
+			return core.Internal("Failed to record failed login", err)
+		}
+		return core.ErrInvalidField{Field: "current_password", Message: "is incorrect"}
+	}
+	if err := sessMgr.clearFailedLogins(user); err != nil {
+		return core.Internal("Failed to reset failed logins", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package authentication
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordReset(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	mailer := &recordingMailer{}
+	WithMailer(mailer)(sessMgr)
+	WithPasswordResetURL("https://app.example.com/reset")(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+
+	// Unknown emails get the same response, without an email
+	assert.Equal(t, http.StatusOK, postJSON(router, "/forgot-password", map[string]string{"email": "unknown@example.com"}).Code)
+	assert.Empty(t, mailer.messages)
+
+	// Requests are throttled silently, like for unknown emails
+	assert.Equal(t, http.StatusOK, postJSON(router, "/forgot-password", map[string]string{"email": "test@example.com"}).Code)
+	w := postJSON(router, "/forgot-password", map[string]string{"email": "test@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, postJSON(router, "/forgot-password", map[string]string{"email": "unknown@example.com"}).Body.String(), w.Body.String())
+	assert.Len(t, mailer.messages, 1)
+	assert.Equal(t, "Reset your password", mailer.last().Subject)
+	token := mailer.lastLinkToken(t)
+
+	w = postJSON(router, "/reset-password", map[string]string{"token": token, "password": "short"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/reset-password", map[string]string{"token": token, "password": "newpassword"}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/reset-password", map[string]string{"token": token, "password": "otherpassword"}).Code)
+
+	// Existing sessions are logged out and only the new password works
+	var revoked Session
+	sessMgr.db.First(&revoked, session.ID)
+	assert.True(t, revoked.IsRevoked())
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "password123"}).Code)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "newpassword"}).Code)
+
+	var reset SessionUser
+	sessMgr.db.First(&reset, user.ID)
+	assert.True(t, reset.IsEmailVerified())
+
+	// Tokens of deleted users are invalid
+	mailer.messages = nil
+	deleted := &SessionUser{Email: "deleted@example.com", Password: "password123"}
+	sessMgr.db.Create(deleted)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/forgot-password", map[string]string{"email": "deleted@example.com"}).Code)
+	token = mailer.lastLinkToken(t)
+	sessMgr.db.Delete(deleted)
+	w = postJSON(router, "/reset-password", map[string]string{"token": token, "password": "newpassword"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "Invalid or already used password reset token")
+}
+
+func TestChangePassword(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	newSession := func() *Session {
+		session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+		assert.NoError(t, err)
+		sessMgr.db.Create(session)
+		return session
+	}
+	current, other := newSession(), newSession()
+
+	changePassword := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/change-password", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+current.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := changePassword(`{"current_password": "wrongpassword", "new_password": "newpassword"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "current_password")
+
+	assert.Equal(t, http.StatusOK, changePassword(`{"current_password": "password123", "new_password": "newpassword"}`).Code)
+
+	// The other sessions are logged out, the current one stays
+	var currentAfter, otherAfter Session
+	sessMgr.db.First(&currentAfter, current.ID)
+	sessMgr.db.First(&otherAfter, other.ID)
+	assert.False(t, currentAfter.IsRevoked())
+	assert.True(t, otherAfter.IsRevoked())
+
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login", map[string]string{"email": "test@example.com", "password": "newpassword"}).Code)
+
+	// Wrong current passwords are throttled like logins
+	WithLoginThrottle(LoginThrottle{LockoutAfter: 2, LockoutDuration: time.Hour})(sessMgr)
+	for range 2 {
+		assert.Equal(t, http.StatusBadRequest, changePassword(`{"current_password": "wrongpassword", "new_password": "otherpassword"}`).Code)
+	}
+	w = changePassword(`{"current_password": "newpassword", "new_password": "otherpassword"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), CodeAccountLocked)
+	var reasons []string
+	sessMgr.db.Model(&LoginAttempt{}).Where("user_id = ? AND reason <> ?", user.ID, "").Order("id").Pluck("reason", &reasons)
+	assert.Equal(t, []string{loginInvalidPassword, loginInvalidPassword, loginInvalidPassword, loginLocked}, reasons)
+}
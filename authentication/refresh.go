@@ -0,0 +1,116 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+type (
+	RefreshRequest struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+)
+
+// RefreshHandler exchanges a refresh token for a new access and refresh
+// token. The old refresh token is revoked; presenting it again revokes
+// every session rotated from the same login.
+func (sessMgr *SessionManager) RefreshHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var current Session
+	err := sessMgr.db.Preload("User").
+		Where("refresh_token_hash = ?", hashToken(req.RefreshToken)).
+		First(&current).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			core.AbortWithError(c, core.Unauthorized("Invalid refresh token"))
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to find session", err))
+		return
+	}
+
+	if current.IsRevoked() {
+		if current.RevokedReason == revokedRotated {
+			sessMgr.revokeReusedFamily(c, &current)
+			return
+		}
+		core.AbortWithError(c, core.Unauthorized("Invalid refresh token"))
+		return
+	}
+	if time.Now().After(current.RefreshExpiresAt) {
+		core.AbortWithError(c, core.Unauthorized("Refresh token has expired"))
+		return
+	}
+	if current.User == nil {
+		core.AbortWithError(c, core.Unauthorized("Invalid refresh token"))
+		return
+	}
+
+	session, err := sessMgr.rotateSession(&current, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			sessMgr.revokeReusedFamily(c, &current)
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to refresh session", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session": session})
+}
+
+// rotateSession revokes current and issues its successor in the same
+// family. Revoking only succeeds once, so concurrent refreshes with the
+// same token can't both rotate it.
+func (sessMgr *SessionManager) rotateSession(current *Session, clientIP, userAgent string) (session *Session, err error) {
+	session = &Session{
+		Keyring:  sessMgr.keyring,
+		FamilyID: current.FamilyID,
+		MFA:      current.MFA,
+	}
+	if err = session.InitializeSession(current.User, clientIP, userAgent); err != nil {
+		return
+	}
+
+	err = sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&Session{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Updates(map[string]interface{}{
+				"revoked_at":     time.Now(),
+				"revoked_reason": revokedRotated,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errRefreshTokenReused
+		}
+		return tx.Create(session).Error
+	})
+	if err == nil {
+		sessMgr.sessions.invalidate(current.TokenID)
+	}
+	return
+}
+
+// revokeReusedFamily revokes the whole family of a replayed refresh token
+// and rejects the request
+func (sessMgr *SessionManager) revokeReusedFamily(c *gin.Context, session *Session) {
+	if err := sessMgr.revokeFamily(session.FamilyID, revokedReuseDetected); err != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke sessions", err))
+		return
+	}
+	core.AbortWithError(c, core.Unauthorized("Refresh token has already been used"))
+}
@@ -0,0 +1,129 @@
+package authentication
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func doRefresh(sessMgr *SessionManager, refreshToken string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	body, _ := json.Marshal(map[string]string{"refresh_token": refreshToken})
+	c.Request = httptest.NewRequest(http.MethodPost, "/refresh", bytes.NewBuffer(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	sessMgr.RefreshHandler(c)
+	return w
+}
+
+func TestRefresh(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+	sessMgr := setupTestSessionManager(t)
+	sessMgr.db = db
+
+	testUser := &SessionUser{
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+	db.Create(testUser)
+
+	session, err := NewSession(sessMgr.keyring, testUser, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	assert.NoError(t, db.Create(session).Error)
+	assert.NotEmpty(t, session.RefreshToken)
+	assert.Equal(t, hashToken(session.RefreshToken), session.RefreshTokenHash)
+	assert.WithinDuration(t, time.Now().Add(accessTokenDuration), session.ExpiresAt, time.Minute)
+
+	// The refresh token is rotated
+	w := doRefresh(sessMgr, session.RefreshToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var response struct {
+		Session Session `json:"session"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.Session.Token)
+	assert.NotEmpty(t, response.Session.RefreshToken)
+	assert.NotEqual(t, session.RefreshToken, response.Session.RefreshToken)
+
+	var rotated Session
+	assert.NoError(t, db.First(&rotated, session.ID).Error)
+	assert.True(t, rotated.IsRevoked())
+	assert.Equal(t, revokedRotated, rotated.RevokedReason)
+
+	var successor Session
+	assert.NoError(t, db.First(&successor, response.Session.ID).Error)
+	assert.False(t, successor.IsRevoked())
+	assert.Equal(t, session.FamilyID, successor.FamilyID)
+
+	// Replaying the old token revokes the whole family
+	w = doRefresh(sessMgr, session.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.NoError(t, db.First(&successor, response.Session.ID).Error)
+	assert.True(t, successor.IsRevoked())
+	assert.Equal(t, revokedReuseDetected, successor.RevokedReason)
+
+	w = doRefresh(sessMgr, response.Session.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRefreshRejectsInvalidTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db := setupTestDB(t)
+	sessMgr := setupTestSessionManager(t)
+	sessMgr.db = db
+
+	testUser := &SessionUser{
+		Email:    "test@example.com",
+		Password: "password123",
+	}
+	db.Create(testUser)
+
+	expired, err := NewSession(sessMgr.keyring, testUser, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	expired.RefreshExpiresAt = time.Now().Add(-time.Minute)
+	assert.NoError(t, db.Create(expired).Error)
+
+	tests := []struct {
+		name         string
+		refreshToken string
+		expectedCode int
+	}{
+		{
+			name:         "missing token",
+			refreshToken: "",
+			expectedCode: http.StatusBadRequest,
+		},
+		{
+			name:         "unknown token",
+			refreshToken: "unknown",
+			expectedCode: http.StatusUnauthorized,
+		},
+		{
+			name:         "expired token",
+			refreshToken: expired.RefreshToken,
+			expectedCode: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRefresh(sessMgr, tt.refreshToken)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
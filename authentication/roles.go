@@ -0,0 +1,612 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RoleSuperadmin is granted every permission, including the ones declared
+// after it was assigned. Its users are the admins: their IsAdmin flag
+// mirrors the role.
+const RoleSuperadmin = "superadmin"
+
+// Permissions of the authentication plugin
+const (
+	PermissionRolesRead   = "roles:read"
+	PermissionRolesWrite  = "roles:write"
+	PermissionSigningKeys = "signing_keys:manage"
+)
+
+const permissionsKey = "permissions"
+
+var _ core.PermissionProvider = (*SessionManager)(nil)
+
+type (
+	// Permission is an action roles can allow, declared by a plugin
+	Permission struct {
+		core.BaseModel
+
+		Name        string `json:"name" gorm:"uniqueIndex;not null"`
+		Description string `json:"description"`
+		Plugin      string `json:"plugin"`
+	}
+
+	// Role groups the permissions granted to the users it is assigned to
+	Role struct {
+		core.BaseModel
+
+		Name        string        `json:"name" gorm:"uniqueIndex;not null"`
+		Description string        `json:"description"`
+		Permissions []*Permission `json:"permissions" gorm:"many2many:role_permissions"`
+	}
+
+	// UserRole assigns a role to a user
+	UserRole struct {
+		core.BaseModel
+
+		UserID uint  `json:"user_id" gorm:"not null;uniqueIndex:idx_user_roles_user_role"`
+		RoleID uint  `json:"role_id" gorm:"not null;uniqueIndex:idx_user_roles_user_role;index"`
+		Role   *Role `json:"role,omitempty" gorm:"foreignKey:RoleID"`
+	}
+
+	CreateRoleRequest struct {
+		Name        string   `json:"name" binding:"required,max=100,excludesall= "`
+		Description string   `json:"description" binding:"max=500"`
+		Permissions []string `json:"permissions"`
+	}
+
+	// UpdateRoleRequest only changes the fields that are sent. Permissions
+	// replace the role's permissions.
+	UpdateRoleRequest struct {
+		Description *string   `json:"description" binding:"omitempty,max=500"`
+		Permissions *[]string `json:"permissions"`
+	}
+
+	AssignRoleRequest struct {
+		Role string `json:"role" binding:"required"`
+	}
+
+	superadminBootstrap struct {
+		email    string
+		password string
+	}
+)
+
+// SharedAcrossOwners makes permissions visible to every user
+func (p *Permission) SharedAcrossOwners() bool { return true }
+
+// SharedAcrossOwners makes roles visible to every user
+func (r *Role) SharedAcrossOwners() bool { return true }
+
+// WithSuperadmin grants the superadmin role to the user with email when the
+// plugin is initialised, creating the user with password if they don't
+// exist yet. It bootstraps the first administrator of a deployment.
+func WithSuperadmin(email, password string) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.superadmin = &superadminBootstrap{email: email, password: password}
+	}
+}
+
+// Permissions declares the permissions of the admin endpoints
+func (sessionMgr *SessionManager) Permissions() []core.Permission {
+	return []core.Permission{
+		{Name: PermissionRolesRead, Description: "List roles, permissions and the roles of users"},
+		{Name: PermissionRolesWrite, Description: "Create, update and delete roles and assign them to users"},
+		{Name: PermissionUsersUnlock, Description: "Unlock accounts locked by failed logins"},
+		{Name: PermissionLoginAttemptsRead, Description: "List login attempts"},
+		{Name: PermissionSigningKeys, Description: "List, rotate and retire the token signing keys"},
+	}
+}
+
+// GetPermissionsHandler lists the permissions declared by the plugins
+func (sessMgr *SessionManager) GetPermissionsHandler(c *gin.Context) {
+	var permissions []Permission
+	if err := sessMgr.adminDB(c).Order("name").Find(&permissions).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch permissions", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"permissions": permissions})
+}
+
+// GetRolesHandler lists the roles with their permissions
+func (sessMgr *SessionManager) GetRolesHandler(c *gin.Context) {
+	var roles []Role
+	if err := sessMgr.adminDB(c).Preload("Permissions").Order("name").Find(&roles).Error; err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch roles", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+// CreateRoleHandler creates a role granting the given permissions
+func (sessMgr *SessionManager) CreateRoleHandler(c *gin.Context) {
+	var req CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	role := &Role{Name: req.Name, Description: req.Description}
+	err := sessMgr.adminDB(c).Transaction(func(tx *gorm.DB) (err error) {
+		if role.Permissions, err = findPermissions(tx, req.Permissions); err != nil {
+			return
+		}
+		return tx.Create(role).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"role": role})
+}
+
+// UpdateRoleHandler changes the description and permissions of a role. The
+// superadmin role can't be changed.
+func (sessMgr *SessionManager) UpdateRoleHandler(c *gin.Context) {
+	var req UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var role Role
+	err := sessMgr.adminDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := findRole(tx, c.Param("id"), &role); err != nil {
+			return err
+		}
+		if req.Description != nil {
+			if err := tx.Model(&role).Update("description", *req.Description).Error; err != nil {
+				return err
+			}
+		}
+		if req.Permissions != nil {
+			permissions, err := findPermissions(tx, *req.Permissions)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(&role).Association("Permissions").Replace(permissions); err != nil {
+				return err
+			}
+		}
+		return tx.Preload("Permissions").First(&role, role.ID).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"role": role})
+}
+
+// DeleteRoleHandler deletes a role, unassigning it from its users. The
+// superadmin role can't be deleted.
+func (sessMgr *SessionManager) DeleteRoleHandler(c *gin.Context) {
+	err := sessMgr.adminDB(c).Transaction(func(tx *gorm.DB) error {
+		var role Role
+		if err := findRole(tx, c.Param("id"), &role); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("role_id = ?", role.ID).Delete(&UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&role).Association("Permissions").Clear(); err != nil {
+			return err
+		}
+		// Roles are deleted for good, so that their name can be reused
+		return tx.Unscoped().Delete(&role).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetUserRolesHandler lists the roles assigned to a user
+func (sessMgr *SessionManager) GetUserRolesHandler(c *gin.Context) {
+	user, ok := sessMgr.paramUser(c)
+	if !ok {
+		return
+	}
+
+	var userRoles []UserRole
+	err := sessMgr.adminDB(c).Preload("Role.Permissions").Where("user_id = ?", user.ID).Order("created_at").Find(&userRoles).Error
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch roles", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": userRoles})
+}
+
+// AssignRoleHandler assigns a role to a user
+func (sessMgr *SessionManager) AssignRoleHandler(c *gin.Context) {
+	var req AssignRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	if req.Role == RoleSuperadmin && !sessMgr.isSuperadmin(c) {
+		core.AbortWithError(c, core.Forbidden("Only superadmins can assign the superadmin role"))
+		return
+	}
+	user, ok := sessMgr.paramUser(c)
+	if !ok {
+		return
+	}
+
+	userRole, created, err := assignRole(sessMgr.adminDB(c), user.ID, req.Role)
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	c.JSON(status, gin.H{"role": userRole})
+}
+
+// UnassignRoleHandler removes a role from a user. The last superadmin keeps
+// their role, so that roles can still be managed.
+func (sessMgr *SessionManager) UnassignRoleHandler(c *gin.Context) {
+	user, ok := sessMgr.paramUser(c)
+	if !ok {
+		return
+	}
+
+	err := sessMgr.adminDB(c).Transaction(func(tx *gorm.DB) error {
+		var userRole UserRole
+		err := tx.Preload("Role").Where("user_id = ? AND role_id = ?", user.ID, c.Param("role_id")).First(&userRole).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return core.NotFound("role not assigned")
+		} else if err != nil {
+			return err
+		}
+
+		superadmin := userRole.Role != nil && userRole.Role.Name == RoleSuperadmin
+		if superadmin {
+			if !sessMgr.isSuperadmin(c) {
+				return core.Forbidden("Only superadmins can remove the superadmin role")
+			}
+			var superadmins int64
+			if err := tx.Model(&UserRole{}).Where("role_id = ?", userRole.RoleID).Count(&superadmins).Error; err != nil {
+				return err
+			}
+			if superadmins <= 1 {
+				return core.Conflict("The last superadmin can't be removed")
+			}
+		}
+		if err := tx.Unscoped().Delete(&userRole).Error; err != nil {
+			return err
+		}
+		if superadmin {
+			return tx.Model(&SessionUser{}).Where("id = ?", user.ID).UpdateColumn("is_admin", false).Error
+		}
+		return nil
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// AssignRole assigns the named role to a user, e.g. when seeding an
+// application. Assigning a role twice is a no-op.
+func (sessMgr *SessionManager) AssignRole(userID uint, role string) (err error) {
+	_, _, err = assignRole(sessMgr.db, userID, role)
+	return
+}
+
+// GetPermissions returns the permissions granted to the authenticated user
+// by their roles. Superadmins and admins are granted core.PermissionAll.
+// They are looked up once per request.
+func (sessMgr *SessionManager) GetPermissions(c *gin.Context) (permissions []string, err error) {
+	if cached, exists := c.Get(permissionsKey); exists {
+		return cached.([]string), nil
+	}
+	user := &SessionUser{}
+	if err = sessMgr.db.Where("id = ?", sessMgr.GetUserID(c)).Limit(1).Find(user).Error; err != nil {
+		return
+	}
+	roles, err := userRoles(sessMgr.db, user.ID)
+	if err != nil {
+		return
+	}
+	permissions = grantedPermissions(user, roles)
+	c.Set(permissionsKey, permissions)
+	return
+}
+
+// HasPermission reports whether the authenticated user's roles grant
+// permission
+func (sessMgr *SessionManager) HasPermission(c *gin.Context, permission string) (bool, error) {
+	permissions, err := sessMgr.GetPermissions(c)
+	if err != nil {
+		return false, err
+	}
+	return core.Subject{Permissions: permissions}.HasPermission(permission), nil
+}
+
+// RequirePermission only lets users through whose roles grant permission.
+// API keys must also have been granted permission as a scope, and with
+// WithRequireAdminMFA sessions must have passed two-factor authentication.
+// It must run after AuthMiddleware.
+func (sessMgr *SessionManager) RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !sessMgr.HasScope(c, permission) {
+			core.AbortWithError(c, core.Forbidden("The API key lacks the "+permission+" scope"))
+			return
+		}
+		allowed, err := sessMgr.HasPermission(c, permission)
+		if err != nil {
+			core.AbortWithError(c, core.Internal("Failed to check permissions", err))
+			return
+		}
+		if !allowed {
+			core.AbortWithError(c, core.Forbidden("The "+permission+" permission is required"))
+			return
+		}
+		if sessMgr.requireAdminMFA && !sessMgr.HasMFA(c) {
+			core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeMFARequired, "The "+permission+" permission requires two-factor authentication"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// policySubject is the subject of policy decisions: the authenticated user
+// with their roles and permissions. The permissions of API keys are limited
+// to their scopes, and deleted users are anonymous.
+func (sessionMgr *SessionManager) policySubject(ctx context.Context) (subject core.Subject, err error) {
+	owner, found := core.OwnerFromContext(ctx)
+	if !found {
+		return
+	}
+	userID, err := strconv.ParseUint(owner.ID, 10, 32)
+	if err != nil {
+		return subject, fmt.Errorf("invalid owner %q: %w", owner.ID, err)
+	}
+
+	user := &SessionUser{}
+	err = sessionMgr.db.First(user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return core.Subject{}, nil
+	} else if err != nil {
+		return
+	}
+	roles, err := userRoles(sessionMgr.db, user.ID)
+	if err != nil {
+		return
+	}
+
+	subject = core.Subject{ID: owner.ID, Admin: owner.Admin, Permissions: grantedPermissions(user, roles), User: user}
+	for _, role := range roles {
+		subject.Roles = append(subject.Roles, role.Name)
+	}
+	if c, ok := ctx.(*gin.Context); ok && !sessionMgr.HasScope(c, ScopeAll) {
+		var scoped []string
+		for _, scope := range sessionMgr.GetScopes(c) {
+			if subject.HasPermission(scope) {
+				scoped = append(scoped, scope)
+			}
+		}
+		subject.Permissions = scoped
+	}
+	return
+}
+
+// isSuperadmin reports whether the authenticated user is a superadmin
+func (sessMgr *SessionManager) isSuperadmin(c *gin.Context) bool {
+	permissions, err := sessMgr.GetPermissions(c)
+	return err == nil && len(permissions) == 1 && permissions[0] == core.PermissionAll
+}
+
+// syncPermissions records the permissions declared by the registered
+// plugins. Permissions declared by several plugins are kept once.
+func (sessionMgr *SessionManager) syncPermissions(reg *core.Registry) error {
+	providers := map[string]core.PermissionProvider{PluginName: sessionMgr}
+	names := []string{PluginName}
+	if reg != nil {
+		for _, plugin := range reg.Plugins() {
+			if provider, ok := plugin.(core.PermissionProvider); ok && plugin.Name() != PluginName {
+				providers[plugin.Name()] = provider
+				names = append(names, plugin.Name())
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	var permissions []Permission
+	for _, name := range names {
+		for _, declared := range providers[name].Permissions() {
+			if seen[declared.Name] {
+				continue
+			}
+			seen[declared.Name] = true
+			permissions = append(permissions, Permission{Name: declared.Name, Description: declared.Description, Plugin: name})
+		}
+	}
+
+	return sessionMgr.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"description", "plugin", "updated_at", "deleted_at"}),
+	}).Create(&permissions).Error
+}
+
+// bootstrapSuperadmin makes the user configured with WithSuperadmin a
+// superadmin, creating them if needed
+func (sessionMgr *SessionManager) bootstrapSuperadmin() error {
+	bootstrap := sessionMgr.superadmin
+	if bootstrap == nil {
+		return nil
+	}
+
+	return sessionMgr.db.Transaction(func(tx *gorm.DB) error {
+		var user SessionUser
+		err := tx.Where("email = ?", bootstrap.email).First(&user).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if bootstrap.password == "" {
+				return fmt.Errorf("superadmin %s doesn't exist and has no password", bootstrap.email)
+			}
+			if err := sessionMgr.passwordPolicy.Validate("password", bootstrap.password, bootstrap.email); err != nil {
+				return fmt.Errorf("superadmin %s: %w", bootstrap.email, err)
+			}
+			now := time.Now()
+			user = SessionUser{Email: bootstrap.email, Password: bootstrap.password, EmailVerifiedAt: &now}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+
+		_, _, err = assignRole(tx, user.ID, RoleSuperadmin)
+		return err
+	})
+}
+
+// adminDB is the database of the admin endpoints, bound to the request and
+// reaching every user's rows
+func (sessMgr *SessionManager) adminDB(c *gin.Context) *gorm.DB {
+	return sessMgr.db.WithContext(core.WithoutOwnerScope(c))
+}
+
+// paramUser finds the user in the URL, aborting when they don't exist
+func (sessMgr *SessionManager) paramUser(c *gin.Context) (user *SessionUser, ok bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid user ID"))
+		return
+	}
+
+	user = &SessionUser{}
+	err = sessMgr.adminDB(c).First(user, userID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		core.AbortWithError(c, core.NotFound("user not found"))
+		return nil, false
+	} else if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to find user", err))
+		return nil, false
+	}
+	return user, true
+}
+
+// findRole finds the role with the ID, refusing the superadmin role which
+// can't be changed
+func findRole(tx *gorm.DB, id string, role *Role) error {
+	roleID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return core.BadRequest("invalid role ID")
+	}
+	err = tx.First(role, roleID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return core.NotFound("role not found")
+	} else if err != nil {
+		return err
+	}
+	if role.Name == RoleSuperadmin {
+		return core.Forbidden("The superadmin role can't be changed")
+	}
+	return nil
+}
+
+// findPermissions finds the named permissions, reporting the unknown ones
+func findPermissions(tx *gorm.DB, names []string) (permissions []*Permission, err error) {
+	if len(names) == 0 {
+		return
+	}
+	if err = tx.Where("name IN ?", names).Find(&permissions).Error; err != nil {
+		return
+	}
+
+	found := map[string]bool{}
+	for _, permission := range permissions {
+		found[permission.Name] = true
+	}
+	for _, name := range names {
+		if !found[name] {
+			return nil, core.ErrInvalidField{Field: "permissions", Message: "unknown permission " + name}
+		}
+	}
+	return
+}
+
+// assignRole assigns the named role to a user unless they already have it.
+// Superadmins are made admins.
+func assignRole(db *gorm.DB, userID uint, roleName string) (userRole *UserRole, created bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var role Role
+		err := tx.Where("name = ?", roleName).First(&role).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return core.NotFound("role not found")
+		} else if err != nil {
+			return err
+		}
+
+		userRole = &UserRole{UserID: userID, RoleID: role.ID}
+		userRole.OwnedBy = ownerID(userID)
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(userRole)
+		if result.Error != nil {
+			return result.Error
+		}
+		if created = result.RowsAffected > 0; !created {
+			if err := tx.Where("user_id = ? AND role_id = ?", userID, role.ID).First(userRole).Error; err != nil {
+				return err
+			}
+		}
+		userRole.Role = &role
+
+		if role.Name == RoleSuperadmin {
+			return tx.Model(&SessionUser{}).Where("id = ?", userID).UpdateColumn("is_admin", true).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return
+}
+
+// userRoles returns the roles assigned to a user, with their permissions
+func userRoles(tx *gorm.DB, userID uint) (roles []Role, err error) {
+	err = tx.Preload("Permissions").
+		Joins("JOIN user_roles ON user_roles.role_id = roles.id AND user_roles.deleted_at IS NULL").
+		Where("user_roles.user_id = ?", userID).
+		Order("roles.name").
+		Find(&roles).Error
+	return
+}
+
+// grantedPermissions returns the permissions granted to a user,
+// core.PermissionAll for admins
+func grantedPermissions(user *SessionUser, roles []Role) []string {
+	if user.IsAdmin {
+		return []string{core.PermissionAll}
+	}
+	return rolePermissions(roles)
+}
+
+// rolePermissions returns the permissions granted by roles,
+// core.PermissionAll for superadmins
+func rolePermissions(roles []Role) []string {
+	permissions := []string{}
+	for _, role := range roles {
+		if role.Name == RoleSuperadmin {
+			return []string{core.PermissionAll}
+		}
+		for _, permission := range role.Permissions {
+			permissions = append(permissions, permission.Name)
+		}
+	}
+	return permissions
+}
@@ -0,0 +1,220 @@
+package authentication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// reportsPlugin declares a permission like any plugin would
+type reportsPlugin struct{}
+
+func (reportsPlugin) Name() string                               { return "reports" }
+func (reportsPlugin) Dependencies() []string                     { return []string{PluginName} }
+func (reportsPlugin) Migrations() []core.Migration               { return nil }
+func (reportsPlugin) Init(context.Context, *core.Registry) error { return nil }
+func (reportsPlugin) RegisterRoutes(gin.IRouter) error           { return nil }
+func (reportsPlugin) Shutdown(context.Context) error             { return nil }
+func (reportsPlugin) Permissions() []core.Permission {
+	return []core.Permission{
+		{Name: "reports:write", Description: "Write reports"},
+		{Name: PermissionRolesRead, Description: "Declared twice"},
+	}
+}
+
+func TestRoles(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	// Scope queries to their owner like server.NewServer
+	assert.NoError(t, core.RegisterOwnership(sessMgr.db))
+	WithSuperadmin("root@example.com", "password123")(sessMgr)
+	reg := core.NewRegistry()
+	assert.NoError(t, reg.Register(sessMgr, reportsPlugin{}))
+	assert.NoError(t, sessMgr.Init(context.Background(), reg))
+	// Initialising again keeps the permissions and the superadmin
+	assert.NoError(t, sessMgr.Init(context.Background(), reg))
+
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+	router.POST("/reports", sessMgr.AuthMiddleware, sessMgr.RequirePermission("reports:write"), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+
+	login := func(email string) (*SessionUser, string) {
+		user := &SessionUser{}
+		if err := sessMgr.db.Where("email = ?", email).First(user).Error; err != nil {
+			user = &SessionUser{Email: email, Password: "password123"}
+			sessMgr.db.Create(user)
+		}
+		session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+		assert.NoError(t, err)
+		sessMgr.db.Create(session)
+		return user, session.Token
+	}
+	request := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	root, rootToken := login("root@example.com")
+	assert.True(t, root.IsAdmin)
+	alice, aliceToken := login("alice@example.com")
+
+	// The plugins' permissions are recorded once
+	w := request(rootToken, http.MethodGet, "/admin/permissions", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var permissions struct {
+		Permissions []Permission `json:"permissions"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &permissions))
+	var names []string
+	for _, permission := range permissions.Permissions {
+		names = append(names, permission.Plugin+"/"+permission.Name)
+	}
+	assert.Equal(t, []string{"authentication/login_attempts:read", "reports/reports:write", "authentication/roles:read", "authentication/roles:write", "authentication/signing_keys:manage", "authentication/users:unlock"}, names)
+
+	// Roles grant their permissions to the users they are assigned to
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodPost, "/reports", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(rootToken, http.MethodPost, "/admin/roles", `{"name": "editor", "permissions": ["reports:delete"]}`).Code)
+	w = request(rootToken, http.MethodPost, "/admin/roles", `{"name": "editor", "permissions": ["reports:write"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		Role Role `json:"role"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	editor := created.Role
+	assert.Equal(t, http.StatusConflict, request(rootToken, http.MethodPost, "/admin/roles", `{"name": "editor"}`).Code)
+
+	alicePath := fmt.Sprintf("/admin/users/%d/roles", alice.ID)
+	assert.Equal(t, http.StatusCreated, request(rootToken, http.MethodPost, alicePath, `{"role": "editor"}`).Code)
+	assert.Equal(t, http.StatusOK, request(rootToken, http.MethodPost, alicePath, `{"role": "editor"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(rootToken, http.MethodPost, alicePath, `{"role": "viewer"}`).Code)
+	assert.Equal(t, http.StatusNotFound, request(rootToken, http.MethodPost, "/admin/users/999/roles", `{"role": "editor"}`).Code)
+	assert.Equal(t, http.StatusCreated, request(aliceToken, http.MethodPost, "/reports", "").Code)
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodGet, "/admin/roles", "").Code)
+
+	// API keys also need the permission as a scope
+	for scopes, code := range map[string]int{`["billing"]`: http.StatusForbidden, `["reports:write"]`: http.StatusCreated} {
+		w = request(aliceToken, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": `+scopes+`}`)
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var info APIKeyInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+		assert.Equal(t, code, request(info.Key, http.MethodPost, "/reports", "").Code)
+	}
+
+	// Changing a role's permissions applies to its users right away
+	editorPath := fmt.Sprintf("/admin/roles/%d", editor.ID)
+	w = request(rootToken, http.MethodPatch, editorPath, `{"permissions": ["roles:write"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"roles:write"`)
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodPost, "/reports", "").Code)
+
+	// Role managers reach the other users
+	assert.Equal(t, http.StatusCreated, request(aliceToken, http.MethodPost, fmt.Sprintf("/admin/users/%d/roles", root.ID), `{"role": "editor"}`).Code)
+
+	// Only superadmins hand out the superadmin role, and the last one keeps it
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodPost, alicePath, `{"role": "superadmin"}`).Code)
+	var superadmin Role
+	sessMgr.db.Where("name = ?", RoleSuperadmin).First(&superadmin)
+	rootRolePath := fmt.Sprintf("/admin/users/%d/roles/%d", root.ID, superadmin.ID)
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodDelete, rootRolePath, "").Code)
+	assert.Equal(t, http.StatusConflict, request(rootToken, http.MethodDelete, rootRolePath, "").Code)
+	assert.Equal(t, http.StatusForbidden, request(rootToken, http.MethodDelete, fmt.Sprintf("/admin/roles/%d", superadmin.ID), "").Code)
+
+	// Superadmins are the admins
+	isAdmin := func(user *SessionUser) bool {
+		var reloaded SessionUser
+		sessMgr.db.First(&reloaded, user.ID)
+		return reloaded.IsAdmin
+	}
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodGet, "/admin/signing-keys", "").Code)
+	assert.Equal(t, http.StatusCreated, request(rootToken, http.MethodPost, alicePath, `{"role": "superadmin"}`).Code)
+	assert.True(t, isAdmin(alice))
+	assert.Equal(t, http.StatusOK, request(aliceToken, http.MethodGet, "/admin/signing-keys", "").Code)
+	assert.Equal(t, http.StatusNoContent, request(aliceToken, http.MethodDelete, rootRolePath, "").Code)
+	assert.False(t, isAdmin(root))
+	assert.Equal(t, http.StatusCreated, request(aliceToken, http.MethodPost, fmt.Sprintf("/admin/users/%d/roles", root.ID), `{"role": "superadmin"}`).Code)
+	assert.Equal(t, http.StatusNoContent, request(rootToken, http.MethodDelete, fmt.Sprintf("%s/%d", alicePath, superadmin.ID), "").Code)
+	assert.False(t, isAdmin(alice))
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodGet, "/admin/signing-keys", "").Code)
+
+	// Deleting a role unassigns it
+	assert.Equal(t, http.StatusNoContent, request(rootToken, http.MethodDelete, editorPath, "").Code)
+	assert.Equal(t, http.StatusNotFound, request(rootToken, http.MethodDelete, editorPath, "").Code)
+	w = request(rootToken, http.MethodGet, alicePath, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"roles": []}`, w.Body.String())
+	assert.Equal(t, http.StatusForbidden, request(aliceToken, http.MethodPost, alicePath, `{"role": "editor"}`).Code)
+}
+
+func TestPolicySubject(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	reg := core.NewRegistry()
+	assert.NoError(t, reg.Register(sessMgr, reportsPlugin{}))
+	assert.NoError(t, sessMgr.Init(context.Background(), reg))
+
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+	router.GET("/subject", sessMgr.AuthMiddleware, func(c *gin.Context) {
+		subject, err := reg.Policy().Subject(c)
+		assert.NoError(t, err)
+		c.JSON(http.StatusOK, gin.H{
+			"id":          subject.ID,
+			"email":       subject.User.(*SessionUser).Email,
+			"roles":       subject.Roles,
+			"permissions": subject.Permissions,
+		})
+	})
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	permissions := []*Permission{}
+	sessMgr.db.Where("name IN ?", []string{"reports:write", PermissionRolesRead}).Find(&permissions)
+	sessMgr.db.Create(&Role{Name: "editor", Permissions: permissions})
+	assert.NoError(t, sessMgr.AssignRole(user.ID, "editor"))
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+
+	request := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request(session.Token, http.MethodGet, "/subject", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"id": "%d", "email": "test@example.com", "roles": ["editor"], "permissions": ["roles:read", "reports:write"]}`, user.ID), w.Body.String())
+
+	// API keys only get the permissions in their scopes
+	w = request(session.Token, http.MethodPost, "/api-keys", `{"name": "CI", "scopes": ["reports:write", "billing:read"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var info APIKeyInfo
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info))
+	w = request(info.Key, http.MethodGet, "/subject", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"id": "%d", "email": "test@example.com", "roles": ["editor"], "permissions": ["reports:write"]}`, user.ID), w.Body.String())
+
+	// Deleted users are denied rather than failing the decision
+	reg.Policy().AddRules(core.AllowPermission("reports_writer", "reports:write", "reports:write"))
+	router.POST("/reports", sessMgr.AuthMiddleware, reg.Policy().Require("reports:write", nil), func(c *gin.Context) {
+		c.Status(http.StatusCreated)
+	})
+	assert.Equal(t, http.StatusCreated, request(session.Token, http.MethodPost, "/reports", "").Code)
+	sessMgr.db.Delete(user)
+	assert.Equal(t, http.StatusForbidden, request(session.Token, http.MethodPost, "/reports", "").Code)
+}
@@ -0,0 +1,76 @@
+package authentication
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	sessionCacheTTL        = time.Second * 30
+	sessionCacheMaxEntries = 10000
+)
+
+type (
+	// sessionCache remembers the token IDs of sessions recently found to
+	// be active, so AuthMiddleware doesn't hit the database on every
+	// request. Revocations through the SessionManager evict their entries
+	// immediately; revocations made elsewhere, e.g. by another instance,
+	// are picked up once the entry expires.
+	sessionCache struct {
+		mu      sync.Mutex
+		ttl     time.Duration
+		entries map[string]time.Time
+	}
+)
+
+func newSessionCache(ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		ttl:     ttl,
+		entries: make(map[string]time.Time),
+	}
+}
+
+// active reports whether tokenID was cached as active and hasn't expired
+func (cache *sessionCache) active(tokenID string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	expiresAt, found := cache.entries[tokenID]
+	if !found {
+		return false
+	}
+	if time.Now().After(expiresAt) {
+		delete(cache.entries, tokenID)
+		return false
+	}
+	return true
+}
+
+// add caches tokenID as active
+func (cache *sessionCache) add(tokenID string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := time.Now()
+	if len(cache.entries) >= sessionCacheMaxEntries {
+		for id, expiresAt := range cache.entries {
+			if now.After(expiresAt) {
+				delete(cache.entries, id)
+			}
+		}
+		if len(cache.entries) >= sessionCacheMaxEntries {
+			cache.entries = make(map[string]time.Time)
+		}
+	}
+	cache.entries[tokenID] = now.Add(cache.ttl)
+}
+
+// invalidate evicts the given token IDs
+func (cache *sessionCache) invalidate(tokenIDs ...string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	for _, tokenID := range tokenIDs {
+		delete(cache.entries, tokenID)
+	}
+}
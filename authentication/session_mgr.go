@@ -3,38 +3,295 @@ package authentication
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
 	"gorm.io/gorm"
 )
 
+// PluginName is the name the authentication plugin is registered under
+const PluginName = "authentication"
+
+var _ core.Plugin = (*SessionManager)(nil)
+
 type (
 	SessionManager struct {
 		ctx       context.Context
 		db        *gorm.DB
 		apiEngine *gin.Engine
 
-		secretKey []byte
+		keyring  *Keyring
+		sessions *sessionCache
+
+		mailer               Mailer
+		verificationURL      string
+		passwordResetURL     string
+		requireVerifiedEmail bool
+		mfaIssuer            string
+		requireAdminMFA      bool
+		relyingParty         *RelyingParty
+		oidcProviders        map[string]*oidcClient
+		superadmin           *superadminBootstrap
+		loginThrottle        LoginThrottle
+		unlockURL            string
+		passwordPolicy       PasswordPolicy
 	}
+
+	// Option configures a SessionManager
+	Option func(*SessionManager)
 )
 
-func NewSessionManager(ctx context.Context, db *gorm.DB, apiEngine *gin.Engine) (sessionMgr *SessionManager, err error) {
-	secretKey := []byte(os.Getenv("JWT_SECRET_KEY"))
-	if len(secretKey) == 0 {
-		return nil, errors.New("JWT_SECRET_KEY environment variable is not set")
+// WithMailer sends the authentication emails with mailer. Without one, they
+// fail with ErrNoMailer rather than leak their tokens.
+func WithMailer(mailer Mailer) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.mailer = mailer
+	}
+}
+
+// WithVerificationURL mails verification links to url, with the token in
+// the token query parameter, instead of the bare token
+func WithVerificationURL(url string) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.verificationURL = url
+	}
+}
+
+// WithPasswordResetURL mails password reset links to url, with the token in
+// the token query parameter, instead of the bare token
+func WithPasswordResetURL(url string) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.passwordResetURL = url
+	}
+}
+
+// WithRequireVerifiedEmail refuses logins until the user verified their email
+func WithRequireVerifiedEmail() Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.requireVerifiedEmail = true
+	}
+}
+
+// NewSessionManager signs tokens with the keys configured in the
+// environment, see keyringFromEnv
+func NewSessionManager(ctx context.Context, db *gorm.DB, apiEngine *gin.Engine, opts ...Option) (sessionMgr *SessionManager, err error) {
+	keyring, err := keyringFromEnv()
+	if err != nil {
+		return
 	}
 
 	sessionMgr = &SessionManager{
-		ctx:       ctx,
-		db:        db,
-		apiEngine: apiEngine,
-		secretKey: secretKey,
+		ctx:            ctx,
+		db:             db,
+		apiEngine:      apiEngine,
+		keyring:        keyring,
+		sessions:       newSessionCache(sessionCacheTTL),
+		mailer:         noMailer{},
+		mfaIssuer:      defaultMFAIssuer,
+		loginThrottle:  DefaultLoginThrottle,
+		passwordPolicy: DefaultPasswordPolicy,
+	}
+	for _, opt := range opts {
+		opt(sessionMgr)
 	}
 	return
 }
 
-func (sessionMgr *SessionManager) RegisterModels(db *gorm.DB) (err error) {
-	err = db.AutoMigrate(&SessionUser{}, &Session{})
+// WithMFAIssuer names the application in authenticator apps
+func WithMFAIssuer(issuer string) Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.mfaIssuer = issuer
+	}
+}
+
+// WithRequireAdminMFA only lets users through RequireAdmin and
+// RequirePermission when their session passed two-factor authentication.
+// API keys can't pass it.
+func WithRequireAdminMFA() Option {
+	return func(sessionMgr *SessionManager) {
+		sessionMgr.requireAdminMFA = true
+	}
+}
+
+// WithRelyingParty enables passkeys for the site with the domain id.
+// Browsers must report one of origins, https://id by default.
+func WithRelyingParty(id, name string, origins ...string) Option {
+	return func(sessionMgr *SessionManager) {
+		if len(origins) == 0 {
+			origins = []string{"https://" + id}
+		}
+		sessionMgr.relyingParty = &RelyingParty{ID: id, Name: name, Origins: origins}
+	}
+}
+
+// WithOIDCProvider lets users log in with an OpenID Connect identity
+// provider. It can be given once per provider.
+func WithOIDCProvider(provider OIDCProvider) Option {
+	return func(sessionMgr *SessionManager) {
+		if sessionMgr.oidcProviders == nil {
+			sessionMgr.oidcProviders = map[string]*oidcClient{}
+		}
+		sessionMgr.oidcProviders[provider.Name] = newOIDCClient(provider)
+	}
+}
+
+// keyringFromEnv builds the keyring from the environment. JWT_SIGNING_KEY_FILE,
+// a PEM private key, takes precedence over the JWT_SECRET_KEY HMAC secret.
+// JWT_PREVIOUS_SIGNING_KEY_FILES and JWT_PREVIOUS_SECRET_KEYS, comma separated
+// lists, keep verifying tokens signed before a rotation.
+func keyringFromEnv() (keyring *Keyring, err error) {
+	var previous []*SigningKey
+	for _, secret := range envList("JWT_PREVIOUS_SECRET_KEYS") {
+		previous = append(previous, NewHMACKey([]byte(secret)))
+	}
+	for _, path := range envList("JWT_PREVIOUS_SIGNING_KEY_FILES") {
+		key, err := LoadPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+		}
+		previous = append(previous, key)
+	}
+
+	secretKey := os.Getenv("JWT_SECRET_KEY")
+	if path := os.Getenv("JWT_SIGNING_KEY_FILE"); path != "" {
+		active, err := LoadPEMKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load signing key %s: %w", path, err)
+		}
+		if secretKey != "" {
+			previous = append(previous, NewHMACKey([]byte(secretKey)))
+		}
+		return NewKeyringWithKeys(active, previous...)
+	}
+
+	if secretKey == "" {
+		return nil, errors.New("JWT_SECRET_KEY environment variable is not set")
+	}
+	return NewKeyringWithKeys(NewHMACKey([]byte(secretKey)), previous...)
+}
+
+// envList splits a comma separated environment variable
+func envList(name string) (values []string) {
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return
+}
+
+// Keyring returns the keys tokens are signed and verified with
+func (sessionMgr *SessionManager) Keyring() *Keyring {
+	return sessionMgr.keyring
+}
+
+func (sessionMgr *SessionManager) Name() string {
+	return PluginName
+}
+
+func (sessionMgr *SessionManager) Dependencies() []string {
+	return nil
+}
+
+// Init records the permissions declared by the plugins, bootstraps the
+// superadmin configured with WithSuperadmin and makes the authenticated
+// user the subject of the registry's policy
+func (sessionMgr *SessionManager) Init(ctx context.Context, reg *core.Registry) (err error) {
+	if reg != nil {
+		reg.Policy().SetSubjectResolver(sessionMgr.policySubject)
+	}
+	if err = sessionMgr.syncPermissions(reg); err != nil {
+		return fmt.Errorf("failed to record permissions: %w", err)
+	}
+	if err = sessionMgr.bootstrapSuperadmin(); err != nil {
+		return fmt.Errorf("failed to bootstrap superadmin: %w", err)
+	}
+	return
+}
+
+// RegisterRoutes mounts the registration, email verification, login, MFA,
+// refresh, password, unlock, logout, session, API key, role, login attempt
+// and signing key endpoints,
+// the JWKS and, when configured, the passkey and identity provider
+// endpoints. Account management is only reachable with a session, not with
+// an API key.
+func (sessionMgr *SessionManager) RegisterRoutes(router gin.IRouter) (err error) {
+	router.GET("/.well-known/jwks.json", sessionMgr.JWKSHandler)
+	router.POST("/register", sessionMgr.RegisterHandler)
+	router.POST("/verify-email", sessionMgr.VerifyEmailHandler)
+	router.POST("/verify-email/resend", sessionMgr.ResendVerificationHandler)
+	router.POST("/login", sessionMgr.LoginHandler)
+	router.POST("/login/mfa", sessionMgr.MFALoginHandler)
+	router.POST("/refresh", sessionMgr.RefreshHandler)
+	router.POST("/forgot-password", sessionMgr.ForgotPasswordHandler)
+	router.POST("/reset-password", sessionMgr.ResetPasswordHandler)
+	router.POST("/unlock", sessionMgr.UnlockAccountHandler)
+	router.POST("/change-password", sessionMgr.SessionMiddleware, sessionMgr.ChangePasswordHandler)
+	router.POST("/logout", sessionMgr.SessionMiddleware, sessionMgr.LogoutHandler)
+
+	mfa := router.Group("/mfa", sessionMgr.SessionMiddleware)
+	mfa.POST("/totp/enroll", sessionMgr.EnrollTOTPHandler)
+	mfa.POST("/totp/confirm", sessionMgr.ConfirmTOTPHandler)
+	mfa.POST("/totp/disable", sessionMgr.DisableTOTPHandler)
+	mfa.POST("/recovery-codes", sessionMgr.RegenerateRecoveryCodesHandler)
+
+	if sessionMgr.relyingParty != nil {
+		router.POST("/login/passkey/begin", sessionMgr.BeginPasskeyLoginHandler)
+		router.POST("/login/passkey/finish", sessionMgr.FinishPasskeyLoginHandler)
+
+		passkeys := router.Group("/passkeys", sessionMgr.SessionMiddleware)
+		passkeys.GET("", sessionMgr.GetPasskeysHandler)
+		passkeys.POST("/register/begin", sessionMgr.BeginPasskeyRegistrationHandler)
+		passkeys.POST("/register/finish", sessionMgr.FinishPasskeyRegistrationHandler)
+		passkeys.DELETE("/:id", sessionMgr.DeletePasskeyHandler)
+	}
+
+	if len(sessionMgr.oidcProviders) > 0 {
+		router.POST("/oidc/:provider/login/begin", sessionMgr.BeginOIDCLoginHandler)
+		router.POST("/oidc/:provider/login/finish", sessionMgr.FinishOIDCLoginHandler)
+		router.POST("/oidc/:provider/link/begin", sessionMgr.SessionMiddleware, sessionMgr.BeginOIDCLinkHandler)
+		router.POST("/oidc/:provider/link/finish", sessionMgr.SessionMiddleware, sessionMgr.FinishOIDCLinkHandler)
+
+		identities := router.Group("/identities", sessionMgr.SessionMiddleware)
+		identities.GET("", sessionMgr.GetIdentitiesHandler)
+		identities.DELETE("/:id", sessionMgr.UnlinkIdentityHandler)
+	}
+
+	apiKeys := router.Group("/api-keys", sessionMgr.SessionMiddleware)
+	apiKeys.GET("", sessionMgr.GetAPIKeysHandler)
+	apiKeys.POST("", sessionMgr.CreateAPIKeyHandler)
+	apiKeys.DELETE("/:id", sessionMgr.RevokeAPIKeyHandler)
+
+	sessions := router.Group("/sessions", sessionMgr.SessionMiddleware)
+	sessions.GET("", sessionMgr.GetSessionsHandler)
+	sessions.DELETE("/:id", sessionMgr.RevokeSessionHandler)
+	sessions.POST("/revoke-others", sessionMgr.RevokeOtherSessionsHandler)
+
+	readRoles := router.Group("/admin", sessionMgr.SessionMiddleware, sessionMgr.RequirePermission(PermissionRolesRead))
+	readRoles.GET("/permissions", sessionMgr.GetPermissionsHandler)
+	readRoles.GET("/roles", sessionMgr.GetRolesHandler)
+	readRoles.GET("/users/:id/roles", sessionMgr.GetUserRolesHandler)
+
+	writeRoles := router.Group("/admin", sessionMgr.SessionMiddleware, sessionMgr.RequirePermission(PermissionRolesWrite))
+	writeRoles.POST("/roles", sessionMgr.CreateRoleHandler)
+	writeRoles.PATCH("/roles/:id", sessionMgr.UpdateRoleHandler)
+	writeRoles.DELETE("/roles/:id", sessionMgr.DeleteRoleHandler)
+	writeRoles.POST("/users/:id/roles", sessionMgr.AssignRoleHandler)
+	writeRoles.DELETE("/users/:id/roles/:role_id", sessionMgr.UnassignRoleHandler)
+
+	router.POST("/admin/users/:id/unlock", sessionMgr.SessionMiddleware, sessionMgr.RequirePermission(PermissionUsersUnlock), sessionMgr.AdminUnlockUserHandler)
+	router.GET("/admin/login-attempts", sessionMgr.SessionMiddleware, sessionMgr.RequirePermission(PermissionLoginAttemptsRead), sessionMgr.GetLoginAttemptsHandler)
+
+	signingKeys := router.Group("/admin/signing-keys", sessionMgr.SessionMiddleware, sessionMgr.RequirePermission(PermissionSigningKeys))
+	signingKeys.GET("", sessionMgr.GetSigningKeysHandler)
+	signingKeys.POST("/rotate", sessionMgr.RotateSigningKeyHandler)
+	signingKeys.DELETE("/:kid", sessionMgr.RetireSigningKeyHandler)
+	return
+}
+
+func (sessionMgr *SessionManager) Shutdown(ctx context.Context) (err error) {
 	return
 }
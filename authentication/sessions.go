@@ -0,0 +1,168 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+type (
+	// SessionInfo describes one of the user's active sessions
+	SessionInfo struct {
+		ID         uint      `json:"id"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		LastUsedIP string    `json:"last_used_ip"`
+		UserAgent  string    `json:"user_agent"`
+		CreatedAt  time.Time `json:"created_at"`
+		Current    bool      `json:"current"`
+	}
+)
+
+// GetSessionsHandler lists the user's active sessions, most recently used first
+func (sessMgr *SessionManager) GetSessionsHandler(c *gin.Context) {
+	userID := sessMgr.GetUserID(c)
+	now := time.Now()
+
+	var sessions []Session
+	err := sessMgr.db.Where("user_id = ? AND revoked_at IS NULL", userID).
+		Where("expires_at > ? OR refresh_expires_at > ?", now, now).
+		Order("last_used_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to fetch sessions", err))
+		return
+	}
+
+	tokenID := c.GetString(tokenIDKey)
+	infos := make([]SessionInfo, len(sessions))
+	for idx, session := range sessions {
+		infos[idx] = SessionInfo{
+			ID:         session.ID,
+			LastUsedAt: session.LastUsedAt,
+			LastUsedIP: session.LastUsedIP,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			Current:    session.TokenID == tokenID,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": infos})
+}
+
+// RevokeSessionHandler revokes one of the user's sessions, e.g. a lost device
+func (sessMgr *SessionManager) RevokeSessionHandler(c *gin.Context) {
+	userID := sessMgr.GetUserID(c)
+	sessionID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid session ID"))
+		return
+	}
+
+	var session Session
+	err = sessMgr.db.Where("id = ? AND user_id = ? AND revoked_at IS NULL", sessionID, userID).
+		First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			core.AbortWithError(c, core.NotFound("session not found"))
+			return
+		}
+		core.AbortWithError(c, core.Internal("Failed to find session", err))
+		return
+	}
+
+	err = sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id = ?", session.ID)
+	}, revokedByUser)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke session", err))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeOtherSessionsHandler revokes every session of the user except the current one
+func (sessMgr *SessionManager) RevokeOtherSessionsHandler(c *gin.Context) {
+	userID := sessMgr.GetUserID(c)
+	tokenID := c.GetString(tokenIDKey)
+
+	err := sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("user_id = ? AND token_id <> ?", userID, tokenID)
+	}, revokedByUser)
+	if err != nil {
+		core.AbortWithError(c, core.Internal("Failed to revoke sessions", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Successfully logged out other sessions"})
+}
+
+// checkSession verifies that the session of an access token, identified
+// by its jti claim, exists and hasn't been revoked. Sessions that aren't
+// cached have their last use recorded.
+func (sessMgr *SessionManager) checkSession(tokenID, clientIP, userAgent string) error {
+	if tokenID == "" {
+		return core.Unauthorized("Invalid token")
+	}
+	if sessMgr.sessions.active(tokenID) {
+		return nil
+	}
+
+	var session Session
+	if err := sessMgr.db.Where("token_id = ?", tokenID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return core.Unauthorized("Invalid token")
+		}
+		return core.Internal("Failed to find session", err)
+	}
+	if session.IsRevoked() {
+		return core.Unauthorized("Session has been revoked")
+	}
+
+	session.UpdateLastUsed(clientIP, userAgent)
+	err := sessMgr.db.Model(&session).UpdateColumns(map[string]interface{}{
+		"last_used_at": session.LastUsedAt,
+		"last_used_ip": session.LastUsedIP,
+		"user_agent":   session.UserAgent,
+	}).Error
+	if err != nil {
+		return core.Internal("Failed to update session", err)
+	}
+
+	sessMgr.sessions.add(tokenID)
+	return nil
+}
+
+// revokeSessions revokes the active sessions matched by scope and evicts
+// them from the session cache, so their tokens stop working immediately
+func (sessMgr *SessionManager) revokeSessions(scope func(*gorm.DB) *gorm.DB, reason string) error {
+	var tokenIDs []string
+	err := sessMgr.db.Model(&Session{}).Scopes(scope).
+		Where("revoked_at IS NULL").
+		Pluck("token_id", &tokenIDs).Error
+	if err != nil {
+		return err
+	}
+
+	err = sessMgr.db.Model(&Session{}).Scopes(scope).
+		Where("revoked_at IS NULL").
+		Updates(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": reason,
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	sessMgr.sessions.invalidate(tokenIDs...)
+	return nil
+}
+
+// revokeFamily revokes every session of the family that is still active
+func (sessMgr *SessionManager) revokeFamily(familyID, reason string) error {
+	return sessMgr.revokeSessions(func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("family_id = ?", familyID)
+	}, reason)
+}
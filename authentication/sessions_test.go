@@ -0,0 +1,89 @@
+package authentication
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionManagement(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	otherUser := &SessionUser{Email: "other@example.com", Password: "password123"}
+	sessMgr.db.Create(otherUser)
+
+	newSession := func(user *SessionUser, ip string) *Session {
+		session, err := NewSession(sessMgr.keyring, user, ip, "test-agent")
+		if err != nil {
+			t.Fatalf("Failed to create session: %v", err)
+		}
+		sessMgr.db.Create(session)
+		return session
+	}
+	current := newSession(user, "10.0.0.1")
+	laptop := newSession(user, "10.0.0.2")
+	phone := newSession(user, "10.0.0.3")
+	foreign := newSession(otherUser, "10.0.0.4")
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", bearerSchema+current.Token)
+		req.Header.Set("User-Agent", "test-browser")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	activeSessions := func() map[uint]SessionInfo {
+		w := request(http.MethodGet, "/sessions")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		var response struct {
+			Sessions []SessionInfo `json:"sessions"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		byID := make(map[uint]SessionInfo)
+		for _, info := range response.Sessions {
+			byID[info.ID] = info
+		}
+		return byID
+	}
+
+	// Only the user's sessions are listed
+	sessions := activeSessions()
+	assert.Len(t, sessions, 3)
+	assert.True(t, sessions[current.ID].Current)
+	assert.False(t, sessions[laptop.ID].Current)
+	assert.Equal(t, "10.0.0.2", sessions[laptop.ID].LastUsedIP)
+	assert.Equal(t, "test-agent", sessions[laptop.ID].UserAgent)
+	assert.Equal(t, "test-browser", sessions[current.ID].UserAgent)
+
+	// Revoking a single session
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, fmt.Sprintf("/sessions/%d", laptop.ID)).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, fmt.Sprintf("/sessions/%d", laptop.ID)).Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, fmt.Sprintf("/sessions/%d", foreign.ID)).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/sessions/abc").Code)
+
+	sessions = activeSessions()
+	assert.Len(t, sessions, 2)
+	assert.NotContains(t, sessions, laptop.ID)
+
+	// Revoking every other session keeps the current one
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/sessions/revoke-others").Code)
+	sessions = activeSessions()
+	assert.Len(t, sessions, 1)
+	assert.Contains(t, sessions, current.ID)
+	assert.NotContains(t, sessions, phone.ID)
+
+	var stillActive Session
+	sessMgr.db.First(&stillActive, foreign.ID)
+	assert.False(t, stillActive.IsRevoked())
+}
@@ -0,0 +1,314 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnsupportedKey   = errors.New("unsupported signing key")
+	ErrVerificationOnly = errors.New("the signing key can only verify tokens")
+)
+
+type (
+	// SigningKey is a key tokens are signed or verified with. HMAC keys
+	// sign with HS256; RSA, ECDSA and Ed25519 keys with RS256, ES256/384/512
+	// and EdDSA. Keys built from a public key can only verify tokens.
+	SigningKey struct {
+		id        string
+		method    jwt.SigningMethod
+		private   interface{}
+		public    interface{}
+		createdAt time.Time
+	}
+
+	// JSONWebKey is the public part of an asymmetric signing key, as
+	// published in the JWKS
+	JSONWebKey struct {
+		KeyType   string `json:"kty"`
+		KeyID     string `json:"kid"`
+		Use       string `json:"use"`
+		Algorithm string `json:"alg"`
+		Curve     string `json:"crv,omitempty"`
+		N         string `json:"n,omitempty"`
+		E         string `json:"e,omitempty"`
+		X         string `json:"x,omitempty"`
+		Y         string `json:"y,omitempty"`
+	}
+
+	JSONWebKeySet struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+)
+
+// NewHMACKey returns a key signing with the shared secret
+func NewHMACKey(secret []byte) *SigningKey {
+	sum := sha256.Sum256(secret)
+	return &SigningKey{
+		id:        hex.EncodeToString(sum[:8]),
+		method:    jwt.SigningMethodHS256,
+		private:   secret,
+		public:    secret,
+		createdAt: time.Now(),
+	}
+}
+
+// NewPrivateKey returns a key signing with an RSA, ECDSA or Ed25519 private key
+func NewPrivateKey(private crypto.Signer) (key *SigningKey, err error) {
+	if key, err = NewPublicKey(private.Public()); err != nil {
+		return
+	}
+	key.private = private
+	return
+}
+
+// NewPublicKey returns a key only verifying tokens signed by the private
+// key of an RSA, ECDSA or Ed25519 public key
+func NewPublicKey(public crypto.PublicKey) (key *SigningKey, err error) {
+	key = &SigningKey{public: public, createdAt: time.Now()}
+	switch public := public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case *ecdsa.PublicKey:
+		switch public.Curve {
+		case elliptic.P256():
+			key.method = jwt.SigningMethodES256
+		case elliptic.P384():
+			key.method = jwt.SigningMethodES384
+		case elliptic.P521():
+			key.method = jwt.SigningMethodES512
+		default:
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, public.Curve.Params().Name)
+		}
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, public)
+	}
+
+	// The ID of a key is derived from its public key, so that the same key
+	// gets the same ID across restarts and instances
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.id = hex.EncodeToString(sum[:8])
+	return
+}
+
+// ParsePEMKey parses a PKCS #8, PKCS #1 or SEC 1 private key, or a PKIX
+// public key, from PEM data
+func ParsePEMKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := private.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, private)
+		}
+		return NewPrivateKey(signer)
+	case "RSA PRIVATE KEY":
+		private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrivateKey(private)
+	case "EC PRIVATE KEY":
+		private, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrivateKey(private)
+	case "PUBLIC KEY":
+		public, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewPublicKey(public)
+	}
+	return nil, fmt.Errorf("%w: PEM block %q", ErrUnsupportedKey, block.Type)
+}
+
+// LoadPEMKey reads a key from a PEM file
+func LoadPEMKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePEMKey(data)
+}
+
+// ID returns the kid of the key
+func (key *SigningKey) ID() string {
+	return key.id
+}
+
+// Algorithm returns the JWT alg the key signs with
+func (key *SigningKey) Algorithm() string {
+	return key.method.Alg()
+}
+
+// CanSign reports whether the key has its private part
+func (key *SigningKey) CanSign() bool {
+	return key.private != nil
+}
+
+// isSymmetric reports whether the key is a shared HMAC secret
+func (key *SigningKey) isSymmetric() bool {
+	_, ok := key.method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// generateLike generates a random key of the same type as key
+func generateLike(key *SigningKey) (*SigningKey, error) {
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		private, err := rsa.GenerateKey(rand.Reader, public.N.BitLen())
+		if err != nil {
+			return nil, err
+		}
+		return NewPrivateKey(private)
+	case *ecdsa.PublicKey:
+		private, err := ecdsa.GenerateKey(public.Curve, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrivateKey(private)
+	case ed25519.PublicKey:
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return NewPrivateKey(private)
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return NewHMACKey(secret), nil
+}
+
+// jwk returns the public JWK of an asymmetric key
+func (key *SigningKey) jwk() (jwk JSONWebKey, ok bool) {
+	jwk = JSONWebKey{
+		KeyID:     key.id,
+		Use:       "sig",
+		Algorithm: key.method.Alg(),
+	}
+	switch public := key.public.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = public.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	default:
+		return jwk, false
+	}
+	return jwk, true
+}
+
+// ParseJSONWebKey returns a key verifying tokens with a public JWK, e.g.
+// from the JWKS of an identity provider
+func ParseJSONWebKey(jwk JSONWebKey) (key *SigningKey, err error) {
+	decode := func(value string) (*big.Int, error) {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("%w: malformed JWK", ErrUnsupportedKey)
+		}
+		return new(big.Int).SetBytes(data), nil
+	}
+
+	var public crypto.PublicKey
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("%w: malformed JWK", ErrUnsupportedKey)
+		}
+		public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Curve]
+		if !ok {
+			return nil, fmt.Errorf("%w: curve %s", ErrUnsupportedKey, jwk.Curve)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("%w: malformed JWK", ErrUnsupportedKey)
+		}
+		public = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("%w: malformed JWK", ErrUnsupportedKey)
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("%w: key type %s", ErrUnsupportedKey, jwk.KeyType)
+	}
+
+	if key, err = NewPublicKey(public); err != nil {
+		return
+	}
+	if jwk.KeyID != "" {
+		key.id = jwk.KeyID
+	}
+	if jwk.Algorithm == "" || jwk.Algorithm == key.Algorithm() {
+		return
+	}
+	// RSA keys may sign with another hash or with PSS
+	switch method := jwt.GetSigningMethod(jwk.Algorithm).(type) {
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		if _, ok := public.(*rsa.PublicKey); ok {
+			key.method = method
+			return
+		}
+	}
+	return nil, fmt.Errorf("%w: algorithm %s", ErrUnsupportedKey, jwk.Algorithm)
+}
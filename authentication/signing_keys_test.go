@@ -0,0 +1,223 @@
+package authentication
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAsymmetricSigningKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	user := &SessionUser{Email: "test@example.com"}
+	user.ID = 123
+
+	tests := []struct {
+		name         string
+		private      crypto.Signer
+		expectedAlg  string
+		expectedType string
+	}{
+		{name: "RSA", private: rsaKey, expectedAlg: "RS256", expectedType: "RSA"},
+		{name: "ECDSA", private: ecKey, expectedAlg: "ES256", expectedType: "EC"},
+		{name: "Ed25519", private: edKey, expectedAlg: "EdDSA", expectedType: "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := NewPrivateKey(tt.private)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedAlg, key.Algorithm())
+
+			keyring, err := NewKeyringWithKeys(key)
+			assert.NoError(t, err)
+			session, err := NewSession(keyring, user, "127.0.0.1", "test-agent")
+			assert.NoError(t, err)
+			assert.NoError(t, session.validateToken())
+
+			token, _, err := jwt.NewParser().ParseUnverified(session.Token, &claims{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedAlg, token.Method.Alg())
+
+			jwks := keyring.JWKS()
+			assert.Len(t, jwks.Keys, 1)
+			assert.Equal(t, key.ID(), jwks.Keys[0].KeyID)
+			assert.Equal(t, tt.expectedType, jwks.Keys[0].KeyType)
+
+			// A keyring with only the public key verifies the token
+			public, err := NewPublicKey(tt.private.Public())
+			assert.NoError(t, err)
+			assert.Equal(t, key.ID(), public.ID())
+			session.Keyring = &Keyring{active: public.ID(), keys: []*SigningKey{public}}
+			assert.NoError(t, session.validateToken())
+		})
+	}
+}
+
+func TestVerificationOnlyKeysCantSign(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	public, err := NewPublicKey(ecKey.Public())
+	assert.NoError(t, err)
+
+	_, err = NewKeyringWithKeys(public)
+	assert.ErrorIs(t, err, ErrVerificationOnly)
+	_, err = NewKeyring([]byte("test-secret-key")).RotateKey(public)
+	assert.ErrorIs(t, err, ErrVerificationOnly)
+}
+
+func TestAlgorithmIsFixedByKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	key, err := NewPrivateKey(rsaKey)
+	assert.NoError(t, err)
+	keyring, err := NewKeyringWithKeys(key)
+	assert.NoError(t, err)
+
+	// An HS256 token using the public key as secret must not verify
+	publicDER, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+	assert.NoError(t, err)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{UserID: 123})
+	token.Header["kid"] = key.ID()
+	tokenString, err := token.SignedString(publicDER)
+	assert.NoError(t, err)
+
+	session := &Session{Keyring: keyring, Token: tokenString}
+	assert.Equal(t, errInvalidToken, session.validateToken())
+}
+
+func TestKeyringFromEnv(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "signing-key.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600))
+
+	t.Setenv("JWT_SIGNING_KEY_FILE", path)
+	t.Setenv("JWT_SECRET_KEY", "test-secret-key")
+
+	keyring, err := keyringFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, "ES256", keyring.activeKey().Algorithm())
+
+	// Tokens signed with the former HMAC secret keep working
+	user := &SessionUser{Email: "test@example.com"}
+	user.ID = 123
+	session, err := NewSession(NewKeyring([]byte("test-secret-key")), user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	session.Keyring = keyring
+	assert.NoError(t, session.validateToken())
+
+	t.Setenv("JWT_SIGNING_KEY_FILE", filepath.Join(t.TempDir(), "missing.pem"))
+	_, err = keyringFromEnv()
+	assert.Error(t, err)
+}
+
+func TestJWKSHandler(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	key, err := NewPrivateKey(ecKey)
+	assert.NoError(t, err)
+	_, err = sessMgr.keyring.RotateKey(key)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// The HMAC secret is not published
+	var jwks JSONWebKeySet
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	assert.Len(t, jwks.Keys, 1)
+	jwk := jwks.Keys[0]
+	assert.Equal(t, "ES256", jwk.Algorithm)
+	assert.Equal(t, "P-256", jwk.Curve)
+
+	// A downstream service verifies tokens with the published key only
+	user := &SessionUser{Email: "test@example.com"}
+	user.ID = 123
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+
+	decode := func(value string) *big.Int {
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		assert.NoError(t, err)
+		return new(big.Int).SetBytes(raw)
+	}
+	public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: decode(jwk.X), Y: decode(jwk.Y)}
+	token, err := jwt.Parse(session.Token, func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, jwk.KeyID, token.Header["kid"])
+		return public, nil
+	}, jwt.WithValidMethods([]string{jwk.Algorithm}))
+	assert.NoError(t, err)
+	assert.True(t, token.Valid)
+}
+
+func TestParseJSONWebKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	for _, private := range []crypto.Signer{rsaKey, ecKey, edKey} {
+		key, err := NewPrivateKey(private)
+		assert.NoError(t, err)
+		jwk, ok := key.jwk()
+		assert.True(t, ok)
+
+		parsed, err := ParseJSONWebKey(jwk)
+		assert.NoError(t, err)
+		assert.Equal(t, key.ID(), parsed.ID())
+		assert.Equal(t, key.Algorithm(), parsed.Algorithm())
+		assert.False(t, parsed.CanSign())
+		assert.Equal(t, private.Public(), parsed.public)
+	}
+
+	// RSA keys may use other algorithms, other keys only their own
+	key, _ := NewPrivateKey(rsaKey)
+	jwk, _ := key.jwk()
+	jwk.Algorithm = "PS256"
+	parsed, err := ParseJSONWebKey(jwk)
+	assert.NoError(t, err)
+	assert.Equal(t, "PS256", parsed.Algorithm())
+	jwk.Algorithm = "HS256"
+	_, err = ParseJSONWebKey(jwk)
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	key, _ = NewPrivateKey(ecKey)
+	jwk, _ = key.jwk()
+	jwk.Algorithm = "ES256"
+	_, err = ParseJSONWebKey(jwk)
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+	_, err = ParseJSONWebKey(JSONWebKey{KeyType: "oct"})
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+}
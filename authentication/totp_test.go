@@ -0,0 +1,45 @@
+package authentication
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHOTPCode(t *testing.T) {
+	// RFC 4226 appendix D test values
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for counter, expected := range []string{"755224", "287082", "359152", "969429"} {
+		code, err := hotpCode(secret, int64(counter))
+		assert.NoError(t, err)
+		assert.Equal(t, expected, code)
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	assert.NoError(t, err)
+	now := time.Now()
+	current := totpCounter(now)
+
+	for _, step := range []int64{current - 1, current, current + 1} {
+		code, _ := hotpCode(secret, step)
+		counter, ok := matchTOTP(secret, code, now)
+		assert.True(t, ok)
+		assert.Equal(t, step, counter)
+	}
+
+	code, _ := hotpCode(secret, current+2)
+	_, ok := matchTOTP(secret, code, now)
+	assert.False(t, ok)
+	_, ok = matchTOTP(secret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("goweb", "test@example.com", "SECRET")
+	assert.Contains(t, uri, "otpauth://totp/goweb:test@example.com?")
+	assert.Contains(t, uri, "secret=SECRET")
+	assert.Contains(t, uri, "issuer=goweb")
+}
@@ -0,0 +1,190 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+// Purposes of user tokens
+const (
+	purposeEmailVerification = "email_verification"
+	purposePasswordReset     = "password_reset"
+	purposeMFAChallenge      = "mfa_challenge"
+	purposePasskeyCreation   = "passkey_creation"
+	purposePasskeyLogin      = "passkey_login"
+	purposeAccountUnlock     = "account_unlock"
+)
+
+// userTokenResendInterval is how long a user waits before being mailed
+// another token for the same purpose
+const userTokenResendInterval = time.Minute
+
+var (
+	errInvalidUserToken = errors.New("invalid or already used token")
+	errExpiredUserToken = errors.New("token has expired")
+)
+
+type (
+	// UserToken is a single-use token mailed to a user to prove they own
+	// their email address, e.g. to verify it or to reset their password.
+	// Only its hash is stored.
+	UserToken struct {
+		core.BaseModel
+
+		UserID    uint       `json:"user_id" gorm:"not null;index"`
+		Purpose   string     `json:"purpose" gorm:"not null;index"`
+		TokenHash string     `json:"-" gorm:"uniqueIndex;not null"`
+		ExpiresAt time.Time  `json:"expires_at"`
+		UsedAt    *time.Time `json:"used_at"`
+		Attempts  int        `json:"-" gorm:"not null;default:0"` // failed uses, for tokens allowing retries
+	}
+
+	// tokenEmail describes the email carrying a user token
+	tokenEmail struct {
+		purpose  string
+		duration time.Duration
+		// url, when set, is the link mailed with the token as the token
+		// query parameter
+		url     string
+		subject string
+		action  string
+	}
+)
+
+// issueUserToken creates a token for purpose, replacing the user's unused
+// tokens for the same purpose
+func issueUserToken(tx *gorm.DB, userID uint, purpose string, duration time.Duration) (token string, err error) {
+	err = tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Delete(&UserToken{}).Error
+	if err != nil {
+		return
+	}
+	return createUserToken(tx, userID, purpose, duration)
+}
+
+// createUserToken creates a token for purpose. userID is 0 for tokens not
+// bound to a user yet.
+func createUserToken(tx *gorm.DB, userID uint, purpose string, duration time.Duration) (token string, err error) {
+	if token, err = generateOpaqueToken(); err != nil {
+		return
+	}
+	userToken := &UserToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(duration),
+	}
+	if userID != 0 {
+		userToken.OwnedBy = ownerID(userID)
+	}
+	err = tx.Create(userToken).Error
+	return
+}
+
+// findUserToken returns the token when it is unused and hasn't expired
+func findUserToken(tx *gorm.DB, purpose, token string) (userToken *UserToken, err error) {
+	userToken = &UserToken{}
+	err = tx.Where("token_hash = ? AND purpose = ?", hashToken(token), purpose).First(userToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errInvalidUserToken
+	} else if err != nil {
+		return nil, err
+	}
+	if userToken.UsedAt != nil {
+		return nil, errInvalidUserToken
+	}
+	if time.Now().After(userToken.ExpiresAt) {
+		return nil, errExpiredUserToken
+	}
+	return
+}
+
+// consumeUserToken marks the token as used and returns it. A token can only
+// be consumed once, even by concurrent requests.
+func consumeUserToken(tx *gorm.DB, purpose, token string) (userToken *UserToken, err error) {
+	if userToken, err = findUserToken(tx, purpose, token); err != nil {
+		return
+	}
+
+	now := time.Now()
+	result := tx.Model(&UserToken{}).
+		Where("id = ? AND used_at IS NULL", userToken.ID).
+		Update("used_at", now)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errInvalidUserToken
+	}
+	userToken.UsedAt = &now
+	return
+}
+
+// failUserToken records a failed use of the token, using it up after
+// maxAttempts failures
+func failUserToken(tx *gorm.DB, userToken *UserToken, maxAttempts int) error {
+	updates := map[string]interface{}{"attempts": gorm.Expr("attempts + 1")}
+	if userToken.Attempts+1 >= maxAttempts {
+		updates["used_at"] = time.Now()
+	}
+	return tx.Model(userToken).UpdateColumns(updates).Error
+}
+
+// lastUserToken returns when the user was last issued a token for purpose
+func lastUserToken(tx *gorm.DB, userID uint, purpose string) (issuedAt time.Time, found bool, err error) {
+	var userToken UserToken
+	err = tx.Unscoped().Where("user_id = ? AND purpose = ?", userID, purpose).
+		Order("created_at DESC").
+		First(&userToken).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return issuedAt, false, nil
+	} else if err != nil {
+		return
+	}
+	return userToken.CreatedAt, true, nil
+}
+
+// mailUserTokenOnce mails the user a token unless they were mailed one for
+// the same purpose shortly before, in which case it silently does nothing
+func (sessMgr *SessionManager) mailUserTokenOnce(c *gin.Context, user *SessionUser, email tokenEmail) error {
+	issuedAt, found, err := lastUserToken(sessMgr.db, user.ID, email.purpose)
+	if err != nil {
+		return fmt.Errorf("failed to find previous token: %w", err)
+	}
+	if found && time.Since(issuedAt) < userTokenResendInterval {
+		return nil
+	}
+	return sessMgr.mailUserToken(c, user, email)
+}
+
+// mailUserToken issues a token and mails it to the user
+func (sessMgr *SessionManager) mailUserToken(c *gin.Context, user *SessionUser, email tokenEmail) error {
+	token, err := issueUserToken(sessMgr.db, user.ID, email.purpose, email.duration)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Use this token to %s: %s", email.action, token)
+	if email.url != "" {
+		link, err := url.Parse(email.url)
+		if err != nil {
+			return err
+		}
+		query := link.Query()
+		query.Set("token", token)
+		link.RawQuery = query.Encode()
+		body = fmt.Sprintf("Open this link to %s: %s", email.action, link)
+	}
+
+	return sessMgr.mailer.Send(c, Message{
+		To:      user.Email,
+		Subject: email.subject,
+		Body:    body,
+	})
+}
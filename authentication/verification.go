@@ -0,0 +1,104 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+const verificationTokenDuration = time.Hour * 24 // 24 hours
+
+// CodeEmailNotVerified is the error code of logins refused until the
+// user verifies their email
+const CodeEmailNotVerified = "email_not_verified"
+
+type (
+	VerifyEmailRequest struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	ResendVerificationRequest struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+)
+
+// VerifyEmailHandler marks the user's email as verified with the token
+// they were mailed
+func (sessMgr *SessionManager) VerifyEmailHandler(c *gin.Context) {
+	var req VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	err := sessMgr.db.Transaction(func(tx *gorm.DB) error {
+		userToken, err := consumeUserToken(tx, purposeEmailVerification, req.Token)
+		if err != nil {
+			return err
+		}
+		return tx.Model(&SessionUser{}).
+			Where("id = ? AND email_verified_at IS NULL", userToken.UserID).
+			UpdateColumn("email_verified_at", time.Now()).Error
+	})
+	switch {
+	case errors.Is(err, errInvalidUserToken):
+		core.AbortWithError(c, core.BadRequest("Invalid or already used verification token"))
+		return
+	case errors.Is(err, errExpiredUserToken):
+		core.AbortWithError(c, core.BadRequest("Verification token has expired"))
+		return
+	case err != nil:
+		core.AbortWithError(c, core.Internal("Failed to verify email", err))
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+// ResendVerificationHandler mails a new verification token, at most once a
+// minute per user. The response doesn't reveal whether the email is
+// registered or already verified: throttled and failed emails are only
+// logged.
+func (sessMgr *SessionManager) ResendVerificationHandler(c *gin.Context) {
+	var req ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+
+	var user SessionUser
+	err := sessMgr.db.Where("email = ?", req.Email).First(&user).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		core.AbortWithError(c, core.Internal("Failed to find user", err))
+		return
+	}
+
+	if err == nil && !user.IsEmailVerified() {
+		if err := sessMgr.mailUserTokenOnce(c, &user, sessMgr.verificationEmail()); err != nil {
+			_ = c.Error(fmt.Errorf("failed to send verification email: %w", err))
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "If the email is registered and not verified yet, a verification email has been sent"})
+}
+
+// sendVerificationEmail issues a verification token and mails it to the user
+func (sessMgr *SessionManager) sendVerificationEmail(c *gin.Context, user *SessionUser) error {
+	return sessMgr.mailUserToken(c, user, sessMgr.verificationEmail())
+}
+
+// verificationEmail describes the email carrying verification tokens
+func (sessMgr *SessionManager) verificationEmail() tokenEmail {
+	return tokenEmail{
+		purpose:  purposeEmailVerification,
+		duration: verificationTokenDuration,
+		url:      sessMgr.verificationURL,
+		subject:  "Verify your email address",
+		action:   "verify your email address",
+	}
+}
@@ -0,0 +1,153 @@
+package authentication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMailer keeps the emails it is asked to send
+type recordingMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (mailer *recordingMailer) Send(ctx context.Context, msg Message) error {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	mailer.messages = append(mailer.messages, msg)
+	return nil
+}
+
+func (mailer *recordingMailer) last() Message {
+	mailer.mu.Lock()
+	defer mailer.mu.Unlock()
+	return mailer.messages[len(mailer.messages)-1]
+}
+
+// lastLinkToken extracts the token of the link in the last email
+func (mailer *recordingMailer) lastLinkToken(t *testing.T) string {
+	body := mailer.last().Body
+	link, err := url.Parse(body[strings.Index(body, "http"):])
+	assert.NoError(t, err)
+	return link.Query().Get("token")
+}
+
+func postJSON(router *gin.Engine, path string, body interface{}) *httptest.ResponseRecorder {
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestEmailVerification(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	mailer := &recordingMailer{}
+	for _, opt := range []Option{
+		WithMailer(mailer),
+		WithVerificationURL("https://app.example.com/verify?source=email"),
+		WithRequireVerifiedEmail(),
+	} {
+		opt(sessMgr)
+	}
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	credentials := map[string]string{"email": "test@example.com", "password": "password123"}
+	assert.Equal(t, http.StatusCreated, postJSON(router, "/register", credentials).Code)
+	assert.Equal(t, "test@example.com", mailer.last().To)
+	token := mailer.lastLinkToken(t)
+	assert.NotEmpty(t, token)
+	assert.Contains(t, mailer.last().Body, "source=email")
+
+	// Logins are refused until the email is verified
+	w := postJSON(router, "/login", credentials)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), CodeEmailNotVerified)
+
+	// Resending is throttled silently, like for unknown emails
+	w = postJSON(router, "/verify-email/resend", map[string]string{"email": "test@example.com"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, postJSON(router, "/verify-email/resend", map[string]string{"email": "unknown@example.com"}).Body.String(), w.Body.String())
+	assert.Len(t, mailer.messages, 1)
+	sessMgr.db.Model(&UserToken{}).Where("1 = 1").UpdateColumn("created_at", time.Now().Add(-userTokenResendInterval))
+	assert.Equal(t, http.StatusOK, postJSON(router, "/verify-email/resend", map[string]string{"email": "test@example.com"}).Code)
+	assert.Len(t, mailer.messages, 2)
+
+	// The resent token replaces the first one
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/verify-email", map[string]string{"token": token}).Code)
+	token = mailer.lastLinkToken(t)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/verify-email", map[string]string{"token": token}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(router, "/verify-email", map[string]string{"token": token}).Code)
+
+	var user SessionUser
+	sessMgr.db.Where("email = ?", "test@example.com").First(&user)
+	assert.True(t, user.IsEmailVerified())
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login", credentials).Code)
+
+	// Verified and unknown emails get the same response, without an email
+	assert.Equal(t, http.StatusOK, postJSON(router, "/verify-email/resend", map[string]string{"email": "test@example.com"}).Code)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/verify-email/resend", map[string]string{"email": "unknown@example.com"}).Code)
+	assert.Len(t, mailer.messages, 2)
+}
+
+func TestVerifyEmailRejectsExpiredTokens(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	token, err := issueUserToken(sessMgr.db, user.ID, purposeEmailVerification, -time.Minute)
+	assert.NoError(t, err)
+
+	w := postJSON(router, "/verify-email", map[string]string{"token": token})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "expired")
+}
+
+func TestDefaultMailer(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	router := gin.New()
+	var errs []*gin.Error
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		errs = append(errs, c.Errors...)
+	})
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	// Without a mailer, emails fail instead of leaking their tokens
+	assert.Equal(t, http.StatusCreated, postJSON(router, "/register", map[string]string{"email": "test@example.com", "password": "password123"}).Code)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/forgot-password", map[string]string{"email": "test@example.com"}).Code)
+	assert.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.True(t, errors.Is(err, ErrNoMailer), err.Error())
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	mailer := &FileMailer{Dir: t.TempDir()}
+	assert.NoError(t, mailer.Send(context.Background(), Message{To: "test@example.com", Subject: "Hello", Body: "World"}))
+	assert.NoError(t, mailer.Send(context.Background(), Message{To: "test@example.com", Subject: "Hello again", Body: "World"}))
+
+	entries, err := os.ReadDir(mailer.Dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	content, err := os.ReadFile(mailer.Dir + "/" + entries[0].Name())
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "To: test@example.com")
+}
@@ -0,0 +1,225 @@
+package authentication
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// WebAuthn ceremonies, as found in the client data
+const (
+	webauthnCreate = "webauthn.create"
+	webauthnGet    = "webauthn.get"
+)
+
+// Authenticator data flags
+const (
+	authFlagUserPresent        = 0x01
+	authFlagUserVerified       = 0x04
+	authFlagAttestedCredential = 0x40
+)
+
+// COSE algorithms (RFC 9053) of the supported credential keys
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+)
+
+var (
+	errInvalidWebAuthn    = errors.New("invalid WebAuthn response")
+	errUnsupportedCOSEKey = errors.New("unsupported credential public key")
+)
+
+type (
+	// RelyingParty identifies the site passkeys are registered for. ID is
+	// its domain and Origins the origins the browser may report.
+	RelyingParty struct {
+		ID      string
+		Name    string
+		Origins []string
+	}
+
+	// base64URL is binary data encoded as unpadded base64url in JSON, as
+	// in the WebAuthn JSON serialization
+	base64URL []byte
+
+	clientData struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+
+	authenticatorData struct {
+		flags     byte
+		signCount uint32
+
+		// Attested credential data, only in registrations
+		aaguid       []byte
+		credentialID []byte
+		publicKey    []byte // COSE_Key
+	}
+)
+
+func (data base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(data))
+}
+
+func (data *base64URL) UnmarshalJSON(raw []byte) (err error) {
+	var encoded string
+	if err = json.Unmarshal(raw, &encoded); err != nil {
+		return
+	}
+	*data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	return
+}
+
+func (data authenticatorData) userVerified() bool {
+	return data.flags&authFlagUserVerified != 0
+}
+
+// verifyClientData checks the client data of a ceremony was collected by
+// one of the relying party's origins
+func (rp *RelyingParty) verifyClientData(raw []byte, ceremony string) (data *clientData, err error) {
+	data = &clientData{}
+	if err = json.Unmarshal(raw, data); err != nil {
+		return nil, errInvalidWebAuthn
+	}
+	if data.Type != ceremony || data.Challenge == "" {
+		return nil, errInvalidWebAuthn
+	}
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return data, nil
+		}
+	}
+	return nil, errInvalidWebAuthn
+}
+
+// verifyAuthenticatorData parses authenticator data, checking it was
+// produced for the relying party with the user present
+func (rp *RelyingParty) verifyAuthenticatorData(raw []byte) (data *authenticatorData, err error) {
+	if len(raw) < 37 {
+		return nil, errInvalidWebAuthn
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return nil, errInvalidWebAuthn
+	}
+
+	data = &authenticatorData{
+		flags:     raw[32],
+		signCount: binary.BigEndian.Uint32(raw[33:37]),
+	}
+	if data.flags&authFlagUserPresent == 0 {
+		return nil, errInvalidWebAuthn
+	}
+	if data.flags&authFlagAttestedCredential == 0 {
+		return
+	}
+
+	// AAGUID, credential ID length and credential ID, then the public key
+	rest := raw[37:]
+	if len(rest) < 18 {
+		return nil, errInvalidWebAuthn
+	}
+	data.aaguid = rest[:16]
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLength == 0 || len(rest) < idLength {
+		return nil, errInvalidWebAuthn
+	}
+	data.credentialID, rest = rest[:idLength], rest[idLength:]
+
+	_, extensions, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, errInvalidWebAuthn
+	}
+	data.publicKey = rest[:len(rest)-len(extensions)]
+	return
+}
+
+// attestedAuthenticatorData extracts the authenticator data of an
+// attestation object. Attestation statements aren't verified, as with the
+// "none" attestation conveyance passkeys are registered with.
+func attestedAuthenticatorData(attestationObject []byte) ([]byte, error) {
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, errInvalidWebAuthn
+	}
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errInvalidWebAuthn
+	}
+	authData, ok := object["authData"].([]byte)
+	if !ok {
+		return nil, errInvalidWebAuthn
+	}
+	return authData, nil
+}
+
+// parseCOSEKey parses an ES256 or EdDSA (Ed25519) COSE_Key
+func parseCOSEKey(coseKey []byte) (publicKey interface{}, alg int64, err error) {
+	decoded, _, err := decodeCBOR(coseKey)
+	if err != nil {
+		return nil, 0, errUnsupportedCOSEKey
+	}
+	params, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errUnsupportedCOSEKey
+	}
+	kty, _ := params[int64(1)].(int64)
+	alg, _ = params[int64(3)].(int64)
+	crv, _ := params[int64(-1)].(int64)
+	x, _ := params[int64(-2)].([]byte)
+
+	switch {
+	case kty == 2 && alg == coseAlgES256 && crv == 1:
+		y, _ := params[int64(-3)].([]byte)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, 0, errUnsupportedCOSEKey
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, errUnsupportedCOSEKey
+		}
+		return key, alg, nil
+	case kty == 1 && alg == coseAlgEdDSA && crv == 6:
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, errUnsupportedCOSEKey
+		}
+		return ed25519.PublicKey(x), alg, nil
+	}
+	return nil, 0, errUnsupportedCOSEKey
+}
+
+// verifyAssertion checks the signature of an assertion, made over the
+// authenticator data and the hash of the client data
+func verifyAssertion(coseKey, authData, clientDataJSON, signature []byte) error {
+	publicKey, _, err := parseCOSEKey(coseKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), clientDataHash[:]...)
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		if ecdsa.VerifyASN1(key, digest[:], signature) {
+			return nil
+		}
+	case ed25519.PublicKey:
+		if ed25519.Verify(key, signed, signature) {
+			return nil
+		}
+	}
+	return errInvalidWebAuthn
+}
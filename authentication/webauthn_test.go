@@ -0,0 +1,309 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// encodeCBOR encodes the values the software authenticator needs
+func encodeCBOR(value interface{}) []byte {
+	head := func(major byte, arg uint64) []byte {
+		switch {
+		case arg < 24:
+			return []byte{major<<5 | byte(arg)}
+		case arg <= 0xff:
+			return []byte{major<<5 | 24, byte(arg)}
+		case arg <= 0xffff:
+			return binary.BigEndian.AppendUint16([]byte{major<<5 | 25}, uint16(arg))
+		}
+		return binary.BigEndian.AppendUint32([]byte{major<<5 | 26}, uint32(arg))
+	}
+
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		out := head(5, uint64(len(v)))
+		for key, item := range v {
+			out = append(out, encodeCBOR(key)...)
+			out = append(out, encodeCBOR(item)...)
+		}
+		return out
+	}
+	panic("unsupported CBOR value")
+}
+
+// softAuthenticator is a WebAuthn authenticator holding an ES256 key
+type softAuthenticator struct {
+	t            *testing.T
+	rpID         string
+	origin       string
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{t: t, rpID: rpID, origin: origin, key: key, credentialID: credentialID, userVerified: true}
+}
+
+func (authn *softAuthenticator) authenticatorData(attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(authn.rpID))
+	flags := byte(authFlagUserPresent)
+	if authn.userVerified {
+		flags |= authFlagUserVerified
+	}
+	if attested {
+		flags |= authFlagAttestedCredential
+	}
+	data := append(rpIDHash[:], flags)
+	data = binary.BigEndian.AppendUint32(data, authn.signCount)
+	if !attested {
+		return data
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID
+	data = binary.BigEndian.AppendUint16(data, uint16(len(authn.credentialID)))
+	data = append(data, authn.credentialID...)
+	return append(data, encodeCBOR(map[interface{}]interface{}{
+		1:  2,
+		3:  coseAlgES256,
+		-1: 1,
+		-2: authn.key.X.FillBytes(make([]byte, 32)),
+		-3: authn.key.Y.FillBytes(make([]byte, 32)),
+	})...)
+}
+
+func (authn *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, err := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      authn.origin,
+		"crossOrigin": false,
+	})
+	assert.NoError(authn.t, err)
+	return data
+}
+
+func (authn *softAuthenticator) create(options PasskeyCreationOptions) (credential PasskeyCredential) {
+	assert.Equal(authn.t, authn.rpID, options.RP.ID)
+	credential.ID = base64.RawURLEncoding.EncodeToString(authn.credentialID)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = authn.clientData(webauthnCreate, options.Challenge)
+	credential.Response.AttestationObject = encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authn.authenticatorData(true),
+	})
+	return
+}
+
+func (authn *softAuthenticator) get(options PasskeyRequestOptions) (credential PasskeyCredential) {
+	assert.Equal(authn.t, authn.rpID, options.RPID)
+	authn.signCount++
+	credential.ID = base64.RawURLEncoding.EncodeToString(authn.credentialID)
+	credential.Type = "public-key"
+	credential.Response.ClientDataJSON = authn.clientData(webauthnGet, options.Challenge)
+	credential.Response.AuthenticatorData = authn.authenticatorData(false)
+
+	clientDataHash := sha256.Sum256(credential.Response.ClientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, credential.Response.AuthenticatorData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, authn.key, digest[:])
+	assert.NoError(authn.t, err)
+	credential.Response.Signature = signature
+	return
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	// RFC 8949 appendix A examples
+	for encoded, expected := range map[string]interface{}{
+		"00":         int64(0),
+		"17":         int64(23),
+		"1818":       int64(24),
+		"1903e8":     int64(1000),
+		"20":         int64(-1),
+		"3903e7":     int64(-1000),
+		"4401020304": []byte{1, 2, 3, 4},
+		"6449455446": "IETF",
+		"83010203":   []interface{}{int64(1), int64(2), int64(3)},
+		"a201020304": map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)},
+		"f5":         true,
+		"f6":         nil,
+	} {
+		data, _ := hex.DecodeString(encoded)
+		value, rest, err := decodeCBOR(data)
+		assert.NoError(t, err, encoded)
+		assert.Empty(t, rest)
+		assert.Equal(t, expected, value, encoded)
+	}
+
+	// Indefinite lengths, floats, oversized lengths and truncated items
+	for _, encoded := range []string{"5f42010243030405ff", "f93c00", "9bffffffffffffffff", "1a0001", "a26161016162"} {
+		data, _ := hex.DecodeString(encoded)
+		_, _, err := decodeCBOR(data)
+		assert.Error(t, err, encoded)
+	}
+	_, rest, err := decodeCBOR([]byte{0x01, 0x02})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02}, rest)
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	WithRelyingParty("example.com", "Example")(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user := &SessionUser{Email: "test@example.com", Password: "password123"}
+	sessMgr.db.Create(user)
+	session, err := NewSession(sessMgr.keyring, user, "127.0.0.1", "test-agent")
+	assert.NoError(t, err)
+	sessMgr.db.Create(session)
+
+	authRequest := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, strings.NewReader(string(payload)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", bearerSchema+session.Token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	authn := newSoftAuthenticator(t, "example.com", "https://example.com")
+
+	// Registration
+	w := authRequest(http.MethodPost, "/passkeys/register/begin", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var creation PasskeyCreationOptions
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &creation))
+	assert.Equal(t, "none", creation.Attestation)
+	credential := authn.create(creation)
+	w = authRequest(http.MethodPost, "/passkeys/register/finish", PasskeyRegistrationRequest{Name: "Laptop", Credential: credential})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var passkey Passkey
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &passkey))
+	assert.Equal(t, credential.ID, passkey.CredentialID)
+	assert.Equal(t, int64(coseAlgES256), passkey.Algorithm)
+
+	// The challenge is single use
+	w = authRequest(http.MethodPost, "/passkeys/register/finish", PasskeyRegistrationRequest{Name: "Laptop", Credential: credential})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	beginLogin := func(email string) PasskeyRequestOptions {
+		w := postJSON(router, "/login/passkey/begin", map[string]string{"email": email})
+		assert.Equal(t, http.StatusOK, w.Code)
+		var options PasskeyRequestOptions
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &options))
+		return options
+	}
+
+	// Login with a verified user is multi-factor
+	options := beginLogin("test@example.com")
+	assert.Len(t, options.AllowCredentials, 1)
+	assertion := authn.get(options)
+	w = postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: assertion})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, user.ID, resp.Session.UserID)
+	assert.True(t, resp.Session.MFA)
+
+	// Assertions can't be replayed
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: assertion}).Code)
+
+	// Discoverable login, without an email
+	options = beginLogin("")
+	assert.Empty(t, options.AllowCredentials)
+	assert.Equal(t, http.StatusOK, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: authn.get(options)}).Code)
+
+	// Locked accounts can't log in with a passkey, and every login is recorded
+	sessMgr.db.Model(user).UpdateColumn("locked_until", time.Now().Add(time.Hour))
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: authn.get(beginLogin(""))}).Code)
+	sessMgr.db.Model(user).UpdateColumn("locked_until", nil)
+	var reasons []string
+	sessMgr.db.Model(&LoginAttempt{}).Where("user_id = ?", user.ID).Order("id").Pluck("reason", &reasons)
+	assert.Equal(t, []string{"", "", loginLocked}, reasons)
+
+	// A sign counter going backwards reveals a cloned authenticator
+	authn.signCount = 0
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: authn.get(beginLogin(""))}).Code)
+
+	// Other origins are rejected
+	phishing := *authn
+	phishing.origin = "https://example.com.evil.test"
+	phishing.signCount = 10
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: phishing.get(beginLogin(""))}).Code)
+
+	// Deleted passkeys can't log in
+	w = authRequest(http.MethodGet, "/passkeys", nil)
+	assert.Contains(t, w.Body.String(), passkey.CredentialID)
+	assert.Equal(t, http.StatusNoContent, authRequest(http.MethodDelete, "/passkeys/"+fmt.Sprint(passkey.ID), nil).Code)
+	assert.Equal(t, http.StatusNotFound, authRequest(http.MethodDelete, "/passkeys/"+fmt.Sprint(passkey.ID), nil).Code)
+	authn.signCount = 20
+	assert.Equal(t, http.StatusUnauthorized, postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: authn.get(beginLogin(""))}).Code)
+
+	// Issuing a challenge drops the used and expired ones
+	pending := beginLogin("")
+	sessMgr.db.Model(&UserToken{}).Where("token_hash <> ?", hashToken(pending.Challenge)).UpdateColumn("expires_at", time.Now().Add(-time.Second))
+	beginLogin("")
+	var challenges int64
+	sessMgr.db.Unscoped().Model(&UserToken{}).Where("purpose = ?", purposePasskeyLogin).Count(&challenges)
+	assert.Equal(t, int64(2), challenges)
+}
+
+func TestPasskeyLoginWithoutUserVerification(t *testing.T) {
+	sessMgr := setupTestSessionManager(t)
+	WithRelyingParty("example.com", "Example")(sessMgr)
+	router := gin.New()
+	assert.NoError(t, sessMgr.RegisterRoutes(router))
+
+	user, _ := mfaUser(t, sessMgr, "test@example.com")
+	authn := newSoftAuthenticator(t, "example.com", "https://example.com")
+	authn.userVerified = false
+	data, err := sessMgr.relyingParty.verifyAuthenticatorData(authn.authenticatorData(true))
+	assert.NoError(t, err)
+	sessMgr.db.Create(&Passkey{
+		UserID:       user.ID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(authn.credentialID),
+		PublicKey:    data.publicKey,
+		Algorithm:    coseAlgES256,
+	})
+
+	// Without user verification the passkey is a single factor
+	w := postJSON(router, "/login/passkey/begin", map[string]string{})
+	var options PasskeyRequestOptions
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &options))
+	w = postJSON(router, "/login/passkey/finish", PasskeyLoginRequest{Credential: authn.get(options)})
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.MFARequired)
+	assert.Nil(t, resp.Session)
+}
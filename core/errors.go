@@ -1,17 +1,40 @@
 package core
 
-import "fmt"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
 
 // ErrInvalidField represents a validation error for a specific field
 type ErrInvalidField struct {
 	Field   string
 	Message string
+	// Rule optionally names the check the field failed, e.g. min_length
+	Rule string
 }
 
 func (e ErrInvalidField) Error() string {
 	return fmt.Sprintf("%s: %s", e.Field, e.Message)
 }
 
+// ErrInvalidFields represents several validation errors, reported together
+type ErrInvalidFields []ErrInvalidField
+
+func (e ErrInvalidFields) Error() string {
+	msgs := make([]string, len(e))
+	for idx, fieldErr := range e {
+		msgs[idx] = fieldErr.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
 // ErrDeleteForbidden represents an error when deletion is not allowed
 type ErrDeleteForbidden struct {
 	Message string
@@ -20,3 +43,205 @@ type ErrDeleteForbidden struct {
 func (e ErrDeleteForbidden) Error() string {
 	return e.Message
 }
+
+// ErrDuplicatePlugin represents an error when two plugins share the same name
+type ErrDuplicatePlugin struct {
+	Name string
+}
+
+func (e ErrDuplicatePlugin) Error() string {
+	return fmt.Sprintf("plugin %q is already registered", e.Name)
+}
+
+// ErrMissingDependency represents an error when a plugin depends on a plugin
+// that is not registered
+type ErrMissingDependency struct {
+	Plugin     string
+	Dependency string
+}
+
+func (e ErrMissingDependency) Error() string {
+	return fmt.Sprintf("plugin %q depends on %q which is not registered", e.Plugin, e.Dependency)
+}
+
+// ErrDependencyCycle represents an error when plugins depend on each other
+type ErrDependencyCycle struct {
+	Path []string
+}
+
+func (e ErrDependencyCycle) Error() string {
+	return fmt.Sprintf("plugin dependency cycle: %s", strings.Join(e.Path, " -> "))
+}
+
+// Error codes used in the JSON error envelope
+const (
+	CodeBadRequest      = "bad_request"
+	CodeValidation      = "validation_failed"
+	CodeUnauthorized    = "unauthorized"
+	CodePaymentRequired = "payment_required"
+	CodeForbidden       = "forbidden"
+	CodeNotFound        = "not_found"
+	CodeConflict        = "conflict"
+	CodeTooManyRequests = "too_many_requests"
+	CodeInternal        = "internal_error"
+)
+
+// FieldError describes why a single request field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+	Rule    string `json:"rule,omitempty"`
+}
+
+// Error is the error model rendered by the error middleware as
+// {"error": {"code": ..., "message": ..., "fields": [...], "request_id": ...}}
+type Error struct {
+	Status    int          `json:"-"`
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+
+	// Err is the underlying cause. It is never rendered.
+	Err error `json:"-"`
+}
+
+func NewError(status int, code, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// BadRequest returns a 400 error for a malformed request
+func BadRequest(message string) *Error {
+	return NewError(http.StatusBadRequest, CodeBadRequest, message)
+}
+
+// Unauthorized returns a 401 error for missing or invalid credentials
+func Unauthorized(message string) *Error {
+	return NewError(http.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+// PaymentRequired returns a 402 error for a request needing a paid subscription
+func PaymentRequired(message string) *Error {
+	return NewError(http.StatusPaymentRequired, CodePaymentRequired, message)
+}
+
+// Forbidden returns a 403 error for an authenticated but disallowed request
+func Forbidden(message string) *Error {
+	return NewError(http.StatusForbidden, CodeForbidden, message)
+}
+
+// NotFound returns a 404 error
+func NotFound(message string) *Error {
+	return NewError(http.StatusNotFound, CodeNotFound, message)
+}
+
+// Conflict returns a 409 error for a request conflicting with the current state
+func Conflict(message string) *Error {
+	return NewError(http.StatusConflict, CodeConflict, message)
+}
+
+// TooManyRequests returns a 429 error for a client that has to slow down
+func TooManyRequests(message string) *Error {
+	return NewError(http.StatusTooManyRequests, CodeTooManyRequests, message)
+}
+
+// Internal returns a 500 error. The cause is kept for logging but never rendered.
+func Internal(message string, cause error) *Error {
+	err := NewError(http.StatusInternalServerError, CodeInternal, message)
+	err.Err = cause
+	return err
+}
+
+// ToError maps an error to the Error model. Core errors, GORM's not found
+// and unique constraint errors as well as binding errors get their matching
+// status; anything else is an internal error.
+func ToError(err error) *Error {
+	var (
+		coreErr            *Error
+		invalidFieldErr    ErrInvalidField
+		invalidFieldsErr   ErrInvalidFields
+		deleteForbiddenErr ErrDeleteForbidden
+		validationErrs     validator.ValidationErrors
+		syntaxErr          *json.SyntaxError
+		typeErr            *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &coreErr):
+		return coreErr
+	case errors.As(err, &invalidFieldErr):
+		e := NewError(http.StatusBadRequest, CodeValidation, invalidFieldErr.Error())
+		e.Fields = []FieldError{{Field: invalidFieldErr.Field, Message: invalidFieldErr.Message, Rule: invalidFieldErr.Rule}}
+		e.Err = err
+		return e
+	case errors.As(err, &invalidFieldsErr) && len(invalidFieldsErr) > 0:
+		e := NewError(http.StatusBadRequest, CodeValidation, "validation failed")
+		for _, fieldErr := range invalidFieldsErr {
+			e.Fields = append(e.Fields, FieldError{Field: fieldErr.Field, Message: fieldErr.Message, Rule: fieldErr.Rule})
+		}
+		e.Err = err
+		return e
+	case errors.As(err, &validationErrs):
+		e := NewError(http.StatusBadRequest, CodeValidation, "validation failed")
+		for _, fieldErr := range validationErrs {
+			e.Fields = append(e.Fields, FieldError{Field: fieldErr.Field(), Message: validationMessage(fieldErr)})
+		}
+		e.Err = err
+		return e
+	case errors.As(err, &deleteForbiddenErr):
+		e := Conflict(deleteForbiddenErr.Message)
+		e.Err = err
+		return e
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		e := NotFound("record not found")
+		e.Err = err
+		return e
+	case isUniqueViolation(err):
+		e := Conflict("record already exists")
+		e.Err = err
+		return e
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		e := BadRequest("malformed request body")
+		e.Err = err
+		return e
+	}
+	return Internal("internal server error", err)
+}
+
+// isUniqueViolation detects unique constraint errors, whether or not the
+// GORM dialector translates them
+func isUniqueViolation(err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint failed") ||
+		strings.Contains(msg, "duplicate key value") ||
+		strings.Contains(msg, "Duplicate entry")
+}
+
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min":
+		return fmt.Sprintf("must be at least %s long", fieldErr.Param())
+	case "max":
+		return fmt.Sprintf("must be at most %s long", fieldErr.Param())
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", fieldErr.Param())
+	}
+	return fmt.Sprintf("failed the '%s' check", fieldErr.Tag())
+}
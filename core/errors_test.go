@@ -0,0 +1,166 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type errorEnvelope struct {
+	Error Error `json:"error"`
+}
+
+func TestToError(t *testing.T) {
+	type bindingRequest struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+
+	tests := []struct {
+		name           string
+		err            func() error
+		expectedStatus int
+		expectedCode   string
+		expectedFields []FieldError
+	}{
+		{
+			name:           "core error",
+			err:            func() error { return Forbidden("no access") },
+			expectedStatus: http.StatusForbidden,
+			expectedCode:   CodeForbidden,
+		},
+		{
+			name:           "invalid field",
+			err:            func() error { return ErrInvalidField{Field: "interval", Message: "is invalid"} },
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeValidation,
+			expectedFields: []FieldError{{Field: "interval", Message: "is invalid"}},
+		},
+		{
+			name: "invalid fields",
+			err: func() error {
+				return fmt.Errorf("register: %w", ErrInvalidFields{
+					{Field: "password", Message: "must be at least 8 characters long", Rule: "min_length"},
+					{Field: "password", Message: "must contain a digit", Rule: "digit"},
+				})
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeValidation,
+			expectedFields: []FieldError{
+				{Field: "password", Message: "must be at least 8 characters long", Rule: "min_length"},
+				{Field: "password", Message: "must contain a digit", Rule: "digit"},
+			},
+		},
+		{
+			name:           "delete forbidden wrapped by gorm",
+			err:            func() error { return errors.Join(ErrDeleteForbidden{Message: "in use"}) },
+			expectedStatus: http.StatusConflict,
+			expectedCode:   CodeConflict,
+		},
+		{
+			name:           "record not found",
+			err:            func() error { return gorm.ErrRecordNotFound },
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   CodeNotFound,
+		},
+		{
+			name:           "unique constraint",
+			err:            func() error { return errors.New("UNIQUE constraint failed: plans.name") },
+			expectedStatus: http.StatusConflict,
+			expectedCode:   CodeConflict,
+		},
+		{
+			name: "binding validation",
+			err: func() error {
+				gin.SetMode(gin.TestMode)
+				c, _ := gin.CreateTestContext(httptest.NewRecorder())
+				c.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"email":"invalid"}`))
+				c.Request.Header.Set("Content-Type", "application/json")
+				var req bindingRequest
+				return c.ShouldBindJSON(&req)
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedCode:   CodeValidation,
+			expectedFields: []FieldError{{Field: "email", Message: "must be a valid email address"}},
+		},
+		{
+			name:           "unknown error",
+			err:            func() error { return errors.New("connection refused") },
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   CodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiErr := ToError(tt.err())
+			assert.Equal(t, tt.expectedStatus, apiErr.Status)
+			assert.Equal(t, tt.expectedCode, apiErr.Code)
+			assert.Equal(t, tt.expectedFields, apiErr.Fields)
+		})
+	}
+}
+
+func TestErrorMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID(), ErrorHandler())
+	router.GET("/deferred", func(c *gin.Context) {
+		_ = c.Error(gorm.ErrRecordNotFound)
+	})
+	router.GET("/abort", func(c *gin.Context) {
+		AbortWithError(c, errors.New("secret database details"))
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		requestID      string
+		expectedStatus int
+		expectedCode   string
+	}{
+		{
+			name:           "error attached to the context",
+			path:           "/deferred",
+			requestID:      "req-123",
+			expectedStatus: http.StatusNotFound,
+			expectedCode:   CodeNotFound,
+		},
+		{
+			name:           "aborted with error",
+			path:           "/abort",
+			expectedStatus: http.StatusInternalServerError,
+			expectedCode:   CodeInternal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NotContains(t, w.Body.String(), "secret")
+
+			var envelope errorEnvelope
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+			assert.Equal(t, tt.expectedCode, envelope.Error.Code)
+			assert.NotEmpty(t, envelope.Error.RequestID)
+			assert.Equal(t, w.Header().Get(RequestIDHeader), envelope.Error.RequestID)
+			if tt.requestID != "" {
+				assert.Equal(t, tt.requestID, envelope.Error.RequestID)
+			}
+		})
+	}
+}
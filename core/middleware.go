@@ -0,0 +1,83 @@
+package core
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+)
+
+func init() {
+	// Report binding validation errors with the JSON field names clients send
+	if validate, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "" || name == "-" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// RequestID tags every request with an ID, reusing the X-Request-ID header
+// when the client sends one. The ID is echoed back in the response header.
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" {
+			buf := make([]byte, 16)
+			if _, err := rand.Read(buf); err == nil {
+				requestID = hex.EncodeToString(buf)
+			}
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(RequestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// GetRequestID returns the ID of the current request
+func GetRequestID(c *gin.Context) string {
+	if requestID := c.GetString(requestIDKey); requestID != "" {
+		return requestID
+	}
+	if c.Request == nil {
+		return ""
+	}
+	return c.GetHeader(RequestIDHeader)
+}
+
+// ErrorHandler renders the last error attached with c.Error as the JSON
+// error envelope when the handler chain did not write a response itself
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		renderError(c, c.Errors.Last().Err)
+	}
+}
+
+// AbortWithError aborts the request and renders err as the JSON error envelope
+func AbortWithError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	renderError(c, err)
+}
+
+func renderError(c *gin.Context, err error) {
+	apiErr := *ToError(err)
+	apiErr.RequestID = GetRequestID(c)
+	c.AbortWithStatusJSON(apiErr.Status, gin.H{"error": apiErr})
+}
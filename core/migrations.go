@@ -0,0 +1,209 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type (
+	// Migration is a single versioned schema change owned by a plugin.
+	// Versions only need to be unique and increasing within a plugin.
+	Migration struct {
+		Version uint
+		Name    string
+		Up      func(tx *gorm.DB) error
+		Down    func(tx *gorm.DB) error
+	}
+
+	// SchemaMigration records a migration that has been applied
+	SchemaMigration struct {
+		ID        uint      `json:"id" gorm:"primaryKey"`
+		Plugin    string    `json:"plugin" gorm:"uniqueIndex:idx_schema_migrations_plugin_version;not null"`
+		Version   uint      `json:"version" gorm:"uniqueIndex:idx_schema_migrations_plugin_version;not null"`
+		Name      string    `json:"name" gorm:"not null"`
+		AppliedAt time.Time `json:"applied_at" gorm:"not null"`
+	}
+
+	// MigrationStatus reports whether a registered migration has been applied
+	MigrationStatus struct {
+		Plugin    string     `json:"plugin"`
+		Version   uint       `json:"version"`
+		Name      string     `json:"name"`
+		Applied   bool       `json:"applied"`
+		AppliedAt *time.Time `json:"applied_at,omitempty"`
+	}
+
+	// Migrator applies and rolls back the migrations of every plugin and
+	// tracks them in the schema_migrations table.
+	Migrator struct {
+		db         *gorm.DB
+		plugins    []string
+		migrations map[string][]Migration
+	}
+)
+
+func NewMigrator(db *gorm.DB) *Migrator {
+	return &Migrator{
+		db:         db,
+		migrations: make(map[string][]Migration),
+	}
+}
+
+// Register adds the migrations of a plugin. Plugins are migrated in the
+// order they are registered and their migrations in increasing version order.
+func (m *Migrator) Register(plugin string, migrations ...Migration) (err error) {
+	if _, exists := m.migrations[plugin]; exists {
+		return fmt.Errorf("migrations for plugin %q are already registered", plugin)
+	}
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+
+	for idx, migration := range sorted {
+		if migration.Version == 0 || migration.Name == "" || migration.Up == nil {
+			return fmt.Errorf("migration %d of plugin %q needs a version, a name and an up step", idx, plugin)
+		}
+		if idx > 0 && sorted[idx-1].Version == migration.Version {
+			return fmt.Errorf("plugin %q has duplicate migration version %d", plugin, migration.Version)
+		}
+	}
+	m.plugins = append(m.plugins, plugin)
+	m.migrations[plugin] = sorted
+	return
+}
+
+// Up applies every pending migration. Each migration runs in its own
+// transaction together with its schema_migrations record.
+func (m *Migrator) Up(ctx context.Context) (err error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for _, plugin := range m.plugins {
+		for _, migration := range m.migrations[plugin] {
+			if _, done := applied[plugin][migration.Version]; done {
+				continue
+			}
+			err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				if err := migration.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{
+					Plugin:    plugin,
+					Version:   migration.Version,
+					Name:      migration.Name,
+					AppliedAt: time.Now(),
+				}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("applying migration %s/%d %s: %w", plugin, migration.Version, migration.Name, err)
+			}
+		}
+	}
+	return
+}
+
+// Down rolls back the last steps applied migrations of a plugin, newest first
+func (m *Migrator) Down(ctx context.Context, plugin string, steps int) (err error) {
+	migrations, found := m.migrations[plugin]
+	if !found {
+		return fmt.Errorf("no migrations registered for plugin %q", plugin)
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for idx := len(migrations) - 1; idx >= 0 && steps > 0; idx-- {
+		migration := migrations[idx]
+		if _, done := applied[plugin][migration.Version]; !done {
+			continue
+		}
+		if migration.Down == nil {
+			return fmt.Errorf("migration %s/%d %s cannot be rolled back", plugin, migration.Version, migration.Name)
+		}
+		err = m.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if err := migration.Down(tx); err != nil {
+				return err
+			}
+			return tx.Where("plugin = ? AND version = ?", plugin, migration.Version).
+				Delete(&SchemaMigration{}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rolling back migration %s/%d %s: %w", plugin, migration.Version, migration.Name, err)
+		}
+		steps--
+	}
+	return
+}
+
+// Status reports every registered migration and whether it has been applied
+func (m *Migrator) Status(ctx context.Context) (statuses []MigrationStatus, err error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return
+	}
+	for _, plugin := range m.plugins {
+		for _, migration := range m.migrations[plugin] {
+			status := MigrationStatus{
+				Plugin:  plugin,
+				Version: migration.Version,
+				Name:    migration.Name,
+			}
+			if record, done := applied[plugin][migration.Version]; done {
+				status.Applied = true
+				status.AppliedAt = &record.AppliedAt
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return
+}
+
+// applied loads the schema_migrations records keyed by plugin and version,
+// creating the table on first use
+func (m *Migrator) applied(ctx context.Context) (applied map[string]map[uint]SchemaMigration, err error) {
+	db := m.db.WithContext(ctx)
+	if err = db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return
+	}
+	var records []SchemaMigration
+	if err = db.Find(&records).Error; err != nil {
+		return
+	}
+	applied = make(map[string]map[uint]SchemaMigration)
+	for _, record := range records {
+		if applied[record.Plugin] == nil {
+			applied[record.Plugin] = make(map[uint]SchemaMigration)
+		}
+		applied[record.Plugin][record.Version] = record
+	}
+	return
+}
+
+// CreateTables returns a migration step creating the tables of the given
+// models. Tables that already exist are left untouched so that databases
+// created with AutoMigrate can adopt migrations.
+func CreateTables(models ...interface{}) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		for _, model := range models {
+			if tx.Migrator().HasTable(model) {
+				continue
+			}
+			if err := tx.Migrator().CreateTable(model); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// DropTables returns a migration step dropping the tables of the given models
+func DropTables(models ...interface{}) func(*gorm.DB) error {
+	return func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(models...)
+	}
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type widgetV1 struct {
+	BaseModel
+
+	Name string `gorm:"not null"`
+}
+
+func (widgetV1) TableName() string { return "widgets" }
+
+type widgetV2 struct {
+	Color string
+}
+
+func (widgetV2) TableName() string { return "widgets" }
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	return db
+}
+
+func widgetMigrations() []Migration {
+	return []Migration{
+		{
+			Version: 2,
+			Name:    "add_widget_color",
+			Up: func(tx *gorm.DB) error {
+				return tx.Migrator().AddColumn(&widgetV2{}, "Color")
+			},
+			Down: func(tx *gorm.DB) error {
+				return tx.Migrator().DropColumn(&widgetV2{}, "Color")
+			},
+		},
+		{
+			Version: 1,
+			Name:    "create_widgets",
+			Up:      CreateTables(&widgetV1{}),
+			Down:    DropTables(&widgetV1{}),
+		},
+	}
+}
+
+func TestMigratorUpDownStatus(t *testing.T) {
+	ctx := context.Background()
+	db := setupTestDB(t)
+	migrator := NewMigrator(db)
+	assert.NoError(t, migrator.Register("widgets", widgetMigrations()...))
+
+	statuses, err := migrator.Status(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, uint(1), statuses[0].Version)
+	assert.False(t, statuses[0].Applied)
+
+	assert.NoError(t, migrator.Up(ctx))
+	assert.True(t, db.Migrator().HasColumn(&widgetV2{}, "Color"))
+
+	statuses, err = migrator.Status(ctx)
+	assert.NoError(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.NotNil(t, status.AppliedAt)
+	}
+
+	// Applying again is a no-op
+	assert.NoError(t, migrator.Up(ctx))
+
+	assert.NoError(t, migrator.Down(ctx, "widgets", 1))
+	assert.True(t, db.Migrator().HasTable(&widgetV1{}))
+	assert.False(t, db.Migrator().HasColumn(&widgetV2{}, "Color"))
+
+	assert.NoError(t, migrator.Down(ctx, "widgets", 5))
+	assert.False(t, db.Migrator().HasTable(&widgetV1{}))
+
+	var count int64
+	db.Model(&SchemaMigration{}).Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	assert.Error(t, migrator.Down(ctx, "unknown", 1))
+}
+
+func TestMigratorFailedMigrationIsNotRecorded(t *testing.T) {
+	ctx := context.Background()
+	db := setupTestDB(t)
+	migrator := NewMigrator(db)
+	migrations := append(widgetMigrations(), Migration{
+		Version: 3,
+		Name:    "broken",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Exec("UPDATE widgets SET color = 'red'").Error; err != nil {
+				return err
+			}
+			return errors.New("boom")
+		},
+	})
+	assert.NoError(t, migrator.Register("widgets", migrations...))
+
+	assert.Error(t, migrator.Up(ctx))
+
+	statuses, err := migrator.Status(ctx)
+	assert.NoError(t, err)
+	assert.True(t, statuses[0].Applied)
+	assert.True(t, statuses[1].Applied)
+	assert.False(t, statuses[2].Applied)
+}
+
+func TestMigratorRegisterValidation(t *testing.T) {
+	migrator := NewMigrator(setupTestDB(t))
+	up := func(*gorm.DB) error { return nil }
+
+	assert.Error(t, migrator.Register("a", Migration{Version: 1, Name: "one"}))
+	assert.Error(t, migrator.Register("b", Migration{Version: 1, Name: "one", Up: up}, Migration{Version: 1, Name: "two", Up: up}))
+	assert.NoError(t, migrator.Register("c", Migration{Version: 1, Name: "one", Up: up}))
+	assert.Error(t, migrator.Register("c", Migration{Version: 2, Name: "two", Up: up}))
+}
+
+func TestCreateTablesAdoptsExistingTables(t *testing.T) {
+	db := setupTestDB(t)
+	assert.NoError(t, db.AutoMigrate(&widgetV1{}))
+
+	migrator := NewMigrator(db)
+	assert.NoError(t, migrator.Register("widgets", widgetMigrations()...))
+	assert.NoError(t, migrator.Up(context.Background()))
+}
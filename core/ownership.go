@@ -0,0 +1,166 @@
+package core
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ownerField = "OwnedBy"
+	ownerKey   = "owner"
+)
+
+type (
+	// Owner identifies the user a request acts on behalf of. Admins bypass
+	// the ownership scope.
+	Owner struct {
+		ID    string
+		Admin bool
+	}
+
+	// SharedModel is implemented by BaseModel-derived models whose rows are
+	// visible to every user, e.g. catalog data. OwnedBy is still populated on
+	// create but reads, updates and deletes are not scoped.
+	SharedModel interface {
+		SharedAcrossOwners() bool
+	}
+
+	ownerCtxKey struct{}
+)
+
+// WithOwner returns a copy of ctx carrying the owner
+func WithOwner(ctx context.Context, owner Owner) context.Context {
+	return context.WithValue(ctx, ownerCtxKey{}, owner)
+}
+
+// WithoutOwnerScope returns a copy of ctx whose statements reach the rows of
+// every owner, e.g. for integrity checks that must see other users' rows
+func WithoutOwnerScope(ctx context.Context) context.Context {
+	owner, _ := OwnerFromContext(ctx)
+	owner.Admin = true
+	return WithOwner(ctx, owner)
+}
+
+// SetOwner stores the owner on the gin context and its request context, so
+// that both db.WithContext(c) and db.WithContext(c.Request.Context()) are scoped
+func SetOwner(c *gin.Context, owner Owner) {
+	c.Set(ownerKey, owner)
+	if c.Request != nil {
+		c.Request = c.Request.WithContext(WithOwner(c.Request.Context(), owner))
+	}
+}
+
+// OwnerFromContext returns the owner stored with WithOwner or SetOwner
+func OwnerFromContext(ctx context.Context) (owner Owner, found bool) {
+	if ctx == nil {
+		return
+	}
+	if c, ok := ctx.(*gin.Context); ok {
+		if value, exists := c.Get(ownerKey); exists {
+			owner, found = value.(Owner)
+			return
+		}
+		if c.Request == nil {
+			return
+		}
+		ctx = c.Request.Context()
+	}
+	owner, found = ctx.Value(ownerCtxKey{}).(Owner)
+	return
+}
+
+// ScopeOwner restricts a query to the rows of the owner. It is a no-op for
+// admins. Use it with db.Scopes when querying without an owner in the context.
+func ScopeOwner(owner Owner) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if owner.Admin {
+			return db
+		}
+		return db.Where(clause.Eq{
+			Column: clause.Column{Table: clause.CurrentTable, Name: "owned_by"},
+			Value:  owner.ID,
+		})
+	}
+}
+
+// RegisterOwnership registers GORM callbacks enforcing BaseModel.OwnedBy for
+// statements whose context carries an owner (see WithOwner and SetOwner):
+// creates populate OwnedBy, and queries, updates and deletes are restricted
+// to the owner's rows unless the owner is an admin or the model is shared.
+func RegisterOwnership(db *gorm.DB) (err error) {
+	callbacks := db.Callback()
+	if err = callbacks.Create().Before("gorm:create").Register("goweb:set_owner", setOwnerCallback); err != nil {
+		return
+	}
+	if err = callbacks.Query().Before("gorm:query").Register("goweb:scope_owner", scopeOwnerCallback); err != nil {
+		return
+	}
+	if err = callbacks.Update().Before("gorm:update").Register("goweb:scope_owner", scopeOwnerCallback); err != nil {
+		return
+	}
+	if err = callbacks.Delete().Before("gorm:delete").Register("goweb:scope_owner", scopeOwnerCallback); err != nil {
+		return
+	}
+	err = callbacks.Row().Before("gorm:row").Register("goweb:scope_owner", scopeOwnerCallback)
+	return
+}
+
+func setOwnerCallback(db *gorm.DB) {
+	owner, found := OwnerFromContext(db.Statement.Context)
+	if !found || db.Statement.Schema == nil {
+		return
+	}
+	field := db.Statement.Schema.LookUpField(ownerField)
+	if field == nil {
+		return
+	}
+
+	ctx := db.Statement.Context
+	setOwner := func(rv reflect.Value) {
+		current, isZero := field.ValueOf(ctx, rv)
+		if isZero {
+			if err := field.Set(ctx, rv, owner.ID); err != nil {
+				db.AddError(err)
+			}
+			return
+		}
+		// Also guards Save, which falls back to an upsert when the scoped
+		// update of another owner's row affects nothing
+		if !owner.Admin && current != owner.ID {
+			db.AddError(Forbidden("cannot create records owned by another user"))
+		}
+	}
+
+	switch rv := reflect.Indirect(db.Statement.ReflectValue); rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for idx := 0; idx < rv.Len(); idx++ {
+			setOwner(reflect.Indirect(rv.Index(idx)))
+		}
+	case reflect.Struct:
+		setOwner(rv)
+	}
+}
+
+func scopeOwnerCallback(db *gorm.DB) {
+	owner, found := OwnerFromContext(db.Statement.Context)
+	if !found || owner.Admin || db.Statement.Schema == nil {
+		return
+	}
+	field := db.Statement.Schema.LookUpField(ownerField)
+	if field == nil {
+		return
+	}
+	if shared, ok := reflect.New(db.Statement.Schema.ModelType).Interface().(SharedModel); ok && shared.SharedAcrossOwners() {
+		return
+	}
+	db.Statement.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{
+			Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName},
+			Value:  owner.ID,
+		},
+	}})
+}
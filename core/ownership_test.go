@@ -0,0 +1,99 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type catalogItem struct {
+	BaseModel
+
+	Name string
+}
+
+func (catalogItem) SharedAcrossOwners() bool { return true }
+
+func setupOwnershipDB(t *testing.T) *gorm.DB {
+	db := setupTestDB(t)
+	if err := RegisterOwnership(db); err != nil {
+		t.Fatalf("Failed to register ownership callbacks: %v", err)
+	}
+	if err := db.AutoMigrate(&widgetV1{}, &catalogItem{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+	return db
+}
+
+func TestOwnershipScoping(t *testing.T) {
+	db := setupOwnershipDB(t)
+	alice := WithOwner(context.Background(), Owner{ID: "1"})
+	bob := WithOwner(context.Background(), Owner{ID: "2"})
+	admin := WithOwner(context.Background(), Owner{ID: "3", Admin: true})
+
+	aliceWidget := &widgetV1{Name: "alice"}
+	assert.NoError(t, db.WithContext(alice).Create(aliceWidget).Error)
+	assert.Equal(t, "1", aliceWidget.OwnedBy)
+	assert.NoError(t, db.WithContext(bob).Create(&widgetV1{Name: "bob"}).Error)
+
+	var widgets []widgetV1
+	assert.NoError(t, db.WithContext(alice).Find(&widgets).Error)
+	assert.Len(t, widgets, 1)
+	assert.NoError(t, db.WithContext(admin).Find(&widgets).Error)
+	assert.Len(t, widgets, 2)
+	assert.NoError(t, db.Find(&widgets).Error)
+	assert.Len(t, widgets, 2)
+
+	var widget widgetV1
+	err := db.WithContext(bob).First(&widget, aliceWidget.ID).Error
+	assert.True(t, errors.Is(err, gorm.ErrRecordNotFound))
+
+	result := db.WithContext(bob).Model(&widgetV1{}).Where("id = ?", aliceWidget.ID).Update("name", "stolen")
+	assert.NoError(t, result.Error)
+	assert.Equal(t, int64(0), result.RowsAffected)
+
+	result = db.WithContext(bob).Delete(&widgetV1{}, aliceWidget.ID)
+	assert.NoError(t, result.Error)
+	assert.Equal(t, int64(0), result.RowsAffected)
+
+	// Save falls back to an upsert when the scoped update matches nothing
+	hijacked := *aliceWidget
+	hijacked.Name = "stolen"
+	assert.Error(t, db.WithContext(bob).Save(&hijacked).Error)
+
+	assert.NoError(t, db.First(&widget, aliceWidget.ID).Error)
+	assert.Equal(t, "alice", widget.Name)
+
+	result = db.WithContext(alice).Delete(&widgetV1{}, aliceWidget.ID)
+	assert.Equal(t, int64(1), result.RowsAffected)
+}
+
+func TestOwnershipSharedModels(t *testing.T) {
+	db := setupOwnershipDB(t)
+	alice := WithOwner(context.Background(), Owner{ID: "1"})
+	bob := WithOwner(context.Background(), Owner{ID: "2"})
+
+	item := &catalogItem{Name: "gold"}
+	assert.NoError(t, db.WithContext(alice).Create(item).Error)
+	assert.Equal(t, "1", item.OwnedBy)
+
+	var items []catalogItem
+	assert.NoError(t, db.WithContext(bob).Find(&items).Error)
+	assert.Len(t, items, 1)
+}
+
+func TestScopeOwner(t *testing.T) {
+	db := setupOwnershipDB(t)
+	assert.NoError(t, db.Create(&[]widgetV1{{Name: "a", BaseModel: BaseModel{OwnedBy: "1"}}, {Name: "b", BaseModel: BaseModel{OwnedBy: "2"}}}).Error)
+
+	var widgets []widgetV1
+	assert.NoError(t, db.Scopes(ScopeOwner(Owner{ID: "2"})).Find(&widgets).Error)
+	assert.Len(t, widgets, 1)
+	assert.Equal(t, "b", widgets[0].Name)
+
+	assert.NoError(t, db.Scopes(ScopeOwner(Owner{ID: "2", Admin: true})).Find(&widgets).Error)
+	assert.Len(t, widgets, 2)
+}
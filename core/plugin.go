@@ -1,9 +1,40 @@
 package core
 
-import "gorm.io/gorm"
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
 
 type (
+	// Plugin is the lifecycle every goweb module implements so that it can be
+	// hooked into a server.Server without any hand wiring.
 	Plugin interface {
-		RegisterModels(*gorm.DB) error
+		// Name uniquely identifies the plugin in a Registry
+		Name() string
+		// Dependencies lists the names of the plugins that must be set up first
+		Dependencies() []string
+		// Migrations returns the ordered schema migrations of the plugin
+		Migrations() []Migration
+		// Init prepares the plugin once every plugin's migrations are applied.
+		// The registry can be used to look up the plugin's dependencies.
+		Init(context.Context, *Registry) error
+		// RegisterRoutes mounts the plugin's HTTP handlers on the router
+		RegisterRoutes(gin.IRouter) error
+		// Shutdown releases the resources held by the plugin
+		Shutdown(context.Context) error
+	}
+
+	// PermissionProvider is implemented by plugins whose routes require
+	// permissions, so that they can be granted to roles
+	PermissionProvider interface {
+		Permissions() []Permission
+	}
+
+	// Permission is an action users can be allowed to take, named
+	// <resource>:<action>, e.g. plans:write
+	Permission struct {
+		Name        string
+		Description string
 	}
 )
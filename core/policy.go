@@ -0,0 +1,351 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Effects a rule can have on a decision
+const (
+	// Abstain leaves the decision to the other rules
+	Abstain Effect = iota
+	Allow
+	Deny
+)
+
+// PermissionAll grants every permission to the subjects holding it
+const PermissionAll = "*"
+
+const subjectKey = "policy_subject"
+
+type (
+	// Effect of a rule on a decision
+	Effect int
+
+	// Subject is who a policy decision is made for. The authentication
+	// plugin fills it in for authenticated requests.
+	Subject struct {
+		// ID is the owner ID of the user, as in BaseModel.OwnedBy, empty
+		// for anonymous requests
+		ID          string
+		Admin       bool
+		Roles       []string
+		Permissions []string
+		// User is the authenticated user, e.g. an *authentication.SessionUser
+		User interface{}
+	}
+
+	// SubjectResolver returns the subject of the request carried by ctx
+	SubjectResolver func(ctx context.Context) (Subject, error)
+
+	// Rule takes part in the decisions about its actions. Check returns
+	// Abstain when the rule doesn't apply to the subject or resource.
+	Rule struct {
+		Name string
+		// Actions the rule applies to, e.g. plans:update. A rule without
+		// actions applies to every action.
+		Actions []string
+		Check   func(ctx context.Context, subject Subject, action string, resource interface{}) (Effect, error)
+	}
+
+	// RuleResult is the effect a rule had on a decision
+	RuleResult struct {
+		Rule   string `json:"rule"`
+		Effect Effect `json:"effect"`
+	}
+
+	// Decision tells whether the subject may take an action on a resource,
+	// and which rule decided. Results lists the effect of every rule
+	// applying to the action when the decision was explained.
+	Decision struct {
+		Action  string       `json:"action"`
+		Allowed bool         `json:"allowed"`
+		Rule    string       `json:"rule,omitempty"`
+		Results []RuleResult `json:"results,omitempty"`
+	}
+
+	// Policy decides what subjects may do with resources. Deny rules win
+	// over allow rules, and actions no rule allows are denied.
+	Policy struct {
+		mu       sync.RWMutex
+		rules    []Rule
+		resolver SubjectResolver
+		logger   *log.Logger
+	}
+)
+
+func NewPolicy() *Policy {
+	return &Policy{}
+}
+
+func (effect Effect) String() string {
+	switch effect {
+	case Allow:
+		return "allow"
+	case Deny:
+		return "deny"
+	default:
+		return "abstain"
+	}
+}
+
+// MarshalText renders effects by name
+func (effect Effect) MarshalText() ([]byte, error) {
+	return []byte(effect.String()), nil
+}
+
+// AddRules adds rules to the policy, e.g. from a plugin's Init
+func (policy *Policy) AddRules(rules ...Rule) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	policy.rules = append(policy.rules, rules...)
+}
+
+// SetSubjectResolver sets how the subject of a request is found. By
+// default it only knows the request's Owner.
+func (policy *Policy) SetSubjectResolver(resolver SubjectResolver) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	policy.resolver = resolver
+}
+
+// SetDebug logs every decision with the effect of each rule to logger, or
+// stops logging them when logger is nil. Denials from Require then name
+// the deciding rule.
+func (policy *Policy) SetDebug(logger *log.Logger) {
+	policy.mu.Lock()
+	defer policy.mu.Unlock()
+	policy.logger = logger
+}
+
+// Can reports whether the subject of ctx may take action on resource
+func (policy *Policy) Can(ctx context.Context, action string, resource interface{}) (bool, error) {
+	decision, err := policy.decide(ctx, action, resource, false)
+	return decision.Allowed, err
+}
+
+// Explain decides like Can and reports the effect of every rule
+func (policy *Policy) Explain(ctx context.Context, action string, resource interface{}) (Decision, error) {
+	return policy.decide(ctx, action, resource, true)
+}
+
+// Require only lets requests through whose subject may take action on the
+// resource load returns, e.g. the plan in the URL. Load errors abort the
+// request, so that gorm.ErrRecordNotFound becomes a 404.
+func (policy *Policy) Require(action string, load func(c *gin.Context) (interface{}, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var resource interface{}
+		if load != nil {
+			var err error
+			if resource, err = load(c); err != nil {
+				AbortWithError(c, err)
+				return
+			}
+		}
+
+		decision, err := policy.decide(c, action, resource, false)
+		if err != nil {
+			AbortWithError(c, Internal("Failed to check policy", err))
+			return
+		}
+		if !decision.Allowed {
+			message := "You are not allowed to " + action
+			if policy.debugLogger() != nil {
+				message += ": " + decision.String()
+			}
+			AbortWithError(c, Forbidden(message))
+			return
+		}
+		c.Next()
+	}
+}
+
+// Subject returns the subject of the request carried by ctx
+func (policy *Policy) Subject(ctx context.Context) (subject Subject, err error) {
+	c, isGin := ctx.(*gin.Context)
+	if isGin {
+		if cached, exists := c.Get(subjectKey); exists {
+			return cached.(Subject), nil
+		}
+	}
+
+	policy.mu.RLock()
+	resolver := policy.resolver
+	policy.mu.RUnlock()
+	if resolver != nil {
+		subject, err = resolver(ctx)
+	} else if owner, found := OwnerFromContext(ctx); found {
+		subject = Subject{ID: owner.ID, Admin: owner.Admin}
+	}
+	if err == nil && isGin {
+		c.Set(subjectKey, subject)
+	}
+	return
+}
+
+// decide evaluates the rules of action, recording their results when
+// explaining or debugging
+func (policy *Policy) decide(ctx context.Context, action string, resource interface{}, explain bool) (decision Decision, err error) {
+	decision.Action = action
+	subject, err := policy.Subject(ctx)
+	if err != nil {
+		return
+	}
+
+	policy.mu.RLock()
+	rules := policy.rules
+	logger := policy.logger
+	policy.mu.RUnlock()
+	explain = explain || logger != nil
+
+	var allowedBy string
+	for _, rule := range rules {
+		if !rule.appliesTo(action) {
+			continue
+		}
+		effect, err := rule.Check(ctx, subject, action, resource)
+		if err != nil {
+			return decision, fmt.Errorf("policy rule %s: %w", rule.Name, err)
+		}
+		if explain {
+			decision.Results = append(decision.Results, RuleResult{Rule: rule.Name, Effect: effect})
+		}
+		switch {
+		case effect == Deny && decision.Rule == "":
+			decision.Rule = rule.Name
+			if !explain {
+				return decision, nil
+			}
+		case effect == Allow && allowedBy == "":
+			allowedBy = rule.Name
+		}
+	}
+	if decision.Rule == "" && allowedBy != "" {
+		decision.Allowed, decision.Rule = true, allowedBy
+	}
+
+	if logger != nil {
+		logger.Printf("policy: subject %q: %s", subject.ID, decision)
+	}
+	return
+}
+
+func (policy *Policy) debugLogger() *log.Logger {
+	policy.mu.RLock()
+	defer policy.mu.RUnlock()
+	return policy.logger
+}
+
+// String describes the decision, e.g. "plans:update denied by has_subscribers"
+func (decision Decision) String() string {
+	var sb strings.Builder
+	sb.WriteString(decision.Action)
+	switch {
+	case decision.Allowed:
+		sb.WriteString(" allowed by " + decision.Rule)
+	case decision.Rule != "":
+		sb.WriteString(" denied by " + decision.Rule)
+	default:
+		sb.WriteString(" denied, no rule allows it")
+	}
+	if len(decision.Results) > 0 {
+		results := make([]string, len(decision.Results))
+		for idx, result := range decision.Results {
+			results[idx] = result.Rule + "=" + result.Effect.String()
+		}
+		sb.WriteString(" (" + strings.Join(results, ", ") + ")")
+	}
+	return sb.String()
+}
+
+func (rule Rule) appliesTo(action string) bool {
+	if len(rule.Actions) == 0 {
+		return true
+	}
+	for _, ruleAction := range rule.Actions {
+		if ruleAction == action {
+			return true
+		}
+	}
+	return false
+}
+
+// HasRole reports whether the subject was assigned role
+func (subject Subject) HasRole(role string) bool {
+	for _, assigned := range subject.Roles {
+		if assigned == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the subject was granted permission, or
+// PermissionAll
+func (subject Subject) HasPermission(permission string) bool {
+	for _, granted := range subject.Permissions {
+		if granted == PermissionAll || granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns reports whether the subject owns resource, a BaseModel-derived model
+func (subject Subject) Owns(resource interface{}) bool {
+	owner, ok := ResourceOwner(resource)
+	return ok && subject.ID != "" && owner == subject.ID
+}
+
+// ResourceOwner returns the OwnedBy of a BaseModel-derived model
+func ResourceOwner(resource interface{}) (owner string, ok bool) {
+	value := reflect.ValueOf(resource)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return
+	}
+	field := value.FieldByName(ownerField)
+	if !field.IsValid() || field.Kind() != reflect.String {
+		return
+	}
+	return field.String(), true
+}
+
+// AllowOwner allows the actions on resources the subject owns
+func AllowOwner(name string, actions ...string) Rule {
+	return Rule{
+		Name:    name,
+		Actions: actions,
+		Check: func(ctx context.Context, subject Subject, action string, resource interface{}) (Effect, error) {
+			if subject.Owns(resource) {
+				return Allow, nil
+			}
+			return Abstain, nil
+		},
+	}
+}
+
+// AllowPermission allows the actions to the subjects granted permission
+func AllowPermission(name, permission string, actions ...string) Rule {
+	return Rule{
+		Name:    name,
+		Actions: actions,
+		Check: func(ctx context.Context, subject Subject, action string, resource interface{}) (Effect, error) {
+			if subject.HasPermission(permission) {
+				return Allow, nil
+			}
+			return Abstain, nil
+		},
+	}
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+// document is edited by its owner unless it is locked
+type document struct {
+	BaseModel
+
+	Locked bool
+}
+
+func documentPolicy() *Policy {
+	policy := NewPolicy()
+	policy.AddRules(
+		AllowOwner("owner", "documents:edit"),
+		AllowPermission("editors", "documents:edit", "documents:edit"),
+		Rule{
+			Name:    "locked",
+			Actions: []string{"documents:edit"},
+			Check: func(ctx context.Context, subject Subject, action string, resource interface{}) (Effect, error) {
+				if resource.(*document).Locked && !subject.Admin {
+					return Deny, nil
+				}
+				return Abstain, nil
+			},
+		},
+	)
+	return policy
+}
+
+func TestPolicy(t *testing.T) {
+	policy := documentPolicy()
+	alice := WithOwner(context.Background(), Owner{ID: "1"})
+	bob := WithOwner(context.Background(), Owner{ID: "2"})
+	admin := WithOwner(context.Background(), Owner{ID: "3", Admin: true})
+
+	doc := &document{}
+	doc.OwnedBy = "1"
+	locked := &document{Locked: true}
+	locked.OwnedBy = "1"
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		action   string
+		resource *document
+		allowed  bool
+		rule     string
+	}{
+		{"owner edits", alice, "documents:edit", doc, true, "owner"},
+		{"other user edits", bob, "documents:edit", doc, false, ""},
+		{"anonymous edits", context.Background(), "documents:edit", doc, false, ""},
+		{"owner edits locked", alice, "documents:edit", locked, false, "locked"},
+		{"admin edits locked", admin, "documents:edit", locked, false, ""},
+		{"owner deletes", alice, "documents:delete", doc, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := policy.Can(tt.ctx, tt.action, tt.resource)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.allowed, allowed)
+
+			decision, err := policy.Explain(tt.ctx, tt.action, tt.resource)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.allowed, decision.Allowed)
+			assert.Equal(t, tt.rule, decision.Rule)
+		})
+	}
+
+	// Explaining reports the effect of every rule of the action
+	decision, err := policy.Explain(alice, "documents:edit", locked)
+	assert.NoError(t, err)
+	assert.Equal(t, []RuleResult{{"owner", Allow}, {"editors", Abstain}, {"locked", Deny}}, decision.Results)
+	assert.Equal(t, "documents:edit denied by locked (owner=allow, editors=abstain, locked=deny)", decision.String())
+
+	// Subjects come from the resolver
+	policy.SetSubjectResolver(func(ctx context.Context) (Subject, error) {
+		return Subject{ID: "2", Permissions: []string{PermissionAll}}, nil
+	})
+	allowed, err := policy.Can(context.Background(), "documents:edit", doc)
+	assert.NoError(t, err)
+	assert.True(t, allowed)
+
+	policy.SetSubjectResolver(func(ctx context.Context) (Subject, error) {
+		return Subject{}, errors.New("no database")
+	})
+	_, err = policy.Can(context.Background(), "documents:edit", doc)
+	assert.Error(t, err)
+}
+
+func TestPolicyRequire(t *testing.T) {
+	policy := documentPolicy()
+	var logs bytes.Buffer
+	policy.SetDebug(log.New(&logs, "", 0))
+
+	documents := map[string]*document{"1": {}, "2": {Locked: true}}
+	for _, doc := range documents {
+		doc.OwnedBy = "1"
+	}
+	router := gin.New()
+	router.PATCH("/documents/:id", func(c *gin.Context) {
+		SetOwner(c, Owner{ID: c.GetHeader("X-User")})
+	}, policy.Require("documents:edit", func(c *gin.Context) (interface{}, error) {
+		doc, found := documents[c.Param("id")]
+		if !found {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return doc, nil
+	}), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	edit := func(id, userID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, "/documents/"+id, nil)
+		req.Header.Set("X-User", userID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNoContent, edit("1", "1").Code)
+	assert.Equal(t, http.StatusForbidden, edit("1", "2").Code)
+	assert.Equal(t, http.StatusNotFound, edit("3", "1").Code)
+
+	// Debugging names the deciding rule in denials and logs every decision
+	w := edit("2", "1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "documents:edit denied by locked")
+	assert.Contains(t, logs.String(), `policy: subject "1": documents:edit allowed by owner (owner=allow, editors=abstain, locked=abstain)`)
+	assert.Contains(t, logs.String(), `policy: subject "2": documents:edit denied, no rule allows it`)
+}
+
+func TestResourceOwner(t *testing.T) {
+	doc := &document{}
+	doc.OwnedBy = "7"
+	owner, ok := ResourceOwner(doc)
+	assert.True(t, ok)
+	assert.Equal(t, "7", owner)
+
+	_, ok = ResourceOwner((*document)(nil))
+	assert.False(t, ok)
+	_, ok = ResourceOwner("7")
+	assert.False(t, ok)
+	assert.True(t, Subject{ID: "7"}.Owns(doc))
+	assert.False(t, Subject{}.Owns(&document{}))
+}
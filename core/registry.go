@@ -0,0 +1,117 @@
+package core
+
+import "fmt"
+
+type (
+	// Registry holds the plugins of an application and resolves the order
+	// in which they have to be bootstrapped. Plugins share its Policy.
+	Registry struct {
+		plugins []Plugin
+		byName  map[string]Plugin
+		policy  *Policy
+	}
+)
+
+func NewRegistry() *Registry {
+	return &Registry{
+		byName: make(map[string]Plugin),
+		policy: NewPolicy(),
+	}
+}
+
+// Policy returns the authorization policy plugins add their rules to
+func (reg *Registry) Policy() *Policy {
+	return reg.policy
+}
+
+// Register adds plugins to the registry. Plugin names must be unique.
+func (reg *Registry) Register(plugins ...Plugin) (err error) {
+	for _, plugin := range plugins {
+		name := plugin.Name()
+		if _, exists := reg.byName[name]; exists {
+			return ErrDuplicatePlugin{Name: name}
+		}
+		reg.byName[name] = plugin
+		reg.plugins = append(reg.plugins, plugin)
+	}
+	return
+}
+
+// Get returns the plugin registered with the given name
+func (reg *Registry) Get(name string) (plugin Plugin, found bool) {
+	plugin, found = reg.byName[name]
+	return
+}
+
+// Plugins returns the registered plugins in registration order
+func (reg *Registry) Plugins() []Plugin {
+	plugins := make([]Plugin, len(reg.plugins))
+	copy(plugins, reg.plugins)
+	return plugins
+}
+
+// Resolve returns the plugins ordered so that every plugin comes after its
+// dependencies. Plugins without a dependency between them keep their
+// registration order. Missing dependencies and cycles are reported as errors.
+func (reg *Registry) Resolve() (ordered []Plugin, err error) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(reg.plugins))
+	path := []string{}
+
+	var visit func(plugin Plugin) error
+	visit = func(plugin Plugin) error {
+		name := plugin.Name()
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := append([]string{}, path...)
+			for idx, step := range cycle {
+				if step == name {
+					cycle = cycle[idx:]
+					break
+				}
+			}
+			return ErrDependencyCycle{Path: append(cycle, name)}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, depName := range plugin.Dependencies() {
+			dep, found := reg.byName[depName]
+			if !found {
+				return ErrMissingDependency{Plugin: name, Dependency: depName}
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		ordered = append(ordered, plugin)
+		return nil
+	}
+
+	for _, plugin := range reg.plugins {
+		if err = visit(plugin); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Lookup returns the registered plugin of type T, e.g.
+// Lookup[*authentication.SessionManager](reg)
+func Lookup[T Plugin](reg *Registry) (plugin T, err error) {
+	for _, registered := range reg.plugins {
+		if typed, ok := registered.(T); ok {
+			return typed, nil
+		}
+	}
+	err = fmt.Errorf("no plugin of type %T registered", plugin)
+	return
+}
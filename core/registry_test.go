@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPlugin struct {
+	name string
+	deps []string
+}
+
+func (p *testPlugin) Name() string                          { return p.name }
+func (p *testPlugin) Dependencies() []string                { return p.deps }
+func (p *testPlugin) Migrations() []Migration               { return nil }
+func (p *testPlugin) Init(context.Context, *Registry) error { return nil }
+func (p *testPlugin) RegisterRoutes(gin.IRouter) error      { return nil }
+func (p *testPlugin) Shutdown(context.Context) error        { return nil }
+
+type otherTestPlugin struct {
+	testPlugin
+}
+
+func pluginNames(plugins []Plugin) []string {
+	names := make([]string, len(plugins))
+	for idx, plugin := range plugins {
+		names[idx] = plugin.Name()
+	}
+	return names
+}
+
+func TestRegistryResolve(t *testing.T) {
+	tests := []struct {
+		name          string
+		plugins       []Plugin
+		expectedOrder []string
+		expectedError error
+	}{
+		{
+			name: "no dependencies keeps registration order",
+			plugins: []Plugin{
+				&testPlugin{name: "a"},
+				&testPlugin{name: "b"},
+			},
+			expectedOrder: []string{"a", "b"},
+		},
+		{
+			name: "dependencies come first",
+			plugins: []Plugin{
+				&testPlugin{name: "plans", deps: []string{"authentication"}},
+				&testPlugin{name: "billing", deps: []string{"plans", "authentication"}},
+				&testPlugin{name: "authentication"},
+			},
+			expectedOrder: []string{"authentication", "plans", "billing"},
+		},
+		{
+			name: "missing dependency",
+			plugins: []Plugin{
+				&testPlugin{name: "plans", deps: []string{"authentication"}},
+			},
+			expectedError: ErrMissingDependency{Plugin: "plans", Dependency: "authentication"},
+		},
+		{
+			name: "dependency cycle",
+			plugins: []Plugin{
+				&testPlugin{name: "a", deps: []string{"b"}},
+				&testPlugin{name: "b", deps: []string{"c"}},
+				&testPlugin{name: "c", deps: []string{"b"}},
+			},
+			expectedError: ErrDependencyCycle{Path: []string{"b", "c", "b"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry()
+			assert.NoError(t, reg.Register(tt.plugins...))
+
+			ordered, err := reg.Resolve()
+			if tt.expectedError != nil {
+				assert.Equal(t, tt.expectedError, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedOrder, pluginNames(ordered))
+		})
+	}
+}
+
+func TestRegistryRegisterDuplicate(t *testing.T) {
+	reg := NewRegistry()
+	assert.NoError(t, reg.Register(&testPlugin{name: "a"}))
+	assert.Equal(t, ErrDuplicatePlugin{Name: "a"}, reg.Register(&testPlugin{name: "a"}))
+}
+
+func TestLookup(t *testing.T) {
+	reg := NewRegistry()
+	other := &otherTestPlugin{testPlugin{name: "other"}}
+	assert.NoError(t, reg.Register(&testPlugin{name: "a"}, other))
+
+	found, err := Lookup[*otherTestPlugin](reg)
+	assert.NoError(t, err)
+	assert.Same(t, other, found)
+
+	_, err = Lookup[*otherTestPlugin](NewRegistry())
+	assert.Error(t, err)
+
+	plugin, ok := reg.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, "a", plugin.Name())
+}
@@ -0,0 +1,380 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// protectedFields are never taken from a request body
+var protectedFields = []string{"ID", "CreatedAt", "UpdatedAt", "DeletedAt", "OwnedBy"}
+
+type (
+	// Association is a many-to-many or has-many association of a resource
+	// that is replaced by sending the IDs of the associated records,
+	// e.g. {Field: "Features", Key: "feature_ids"}
+	Association struct {
+		Field string
+		Key   string
+	}
+
+	// Filter maps a List query parameter to a column. Parse converts the
+	// parameter to the column's type; the raw string is used when it is nil.
+	Filter struct {
+		Param  string
+		Column string
+		Parse  func(string) (interface{}, error)
+	}
+
+	// ResourceHook runs inside the transaction of a create, update or delete.
+	// Returning an error aborts the transaction and is rendered as the response.
+	ResourceHook[T any] func(c *gin.Context, tx *gorm.DB, record *T) error
+
+	ResourceHooks[T any] struct {
+		BeforeCreate ResourceHook[T]
+		AfterCreate  ResourceHook[T]
+		BeforeUpdate ResourceHook[T]
+		AfterUpdate  ResourceHook[T]
+		BeforeDelete ResourceHook[T]
+		AfterDelete  ResourceHook[T]
+	}
+
+	ResourceConfig[T any] struct {
+		// Name and Plural are the JSON keys of a single record and of a list
+		Name   string
+		Plural string
+		// Query customises how records are loaded for responses, e.g. preloads
+		Query        func(*gorm.DB) *gorm.DB
+		Filters      []Filter
+		Associations []Association
+		Hooks        ResourceHooks[T]
+	}
+
+	// Resource is a generic REST controller for a BaseModel-derived model.
+	// Every statement runs with the request as context, so ownership
+	// scoping applies.
+	Resource[T any] struct {
+		db  *gorm.DB
+		cfg ResourceConfig[T]
+	}
+)
+
+func NewResource[T any](db *gorm.DB, cfg ResourceConfig[T]) *Resource[T] {
+	if cfg.Plural == "" {
+		cfg.Plural = cfg.Name + "s"
+	}
+	return &Resource[T]{db: db, cfg: cfg}
+}
+
+// BoolFilter returns a filter for a boolean column
+func BoolFilter(param, column string) Filter {
+	return Filter{
+		Param:  param,
+		Column: column,
+		Parse: func(value string) (interface{}, error) {
+			return strconv.ParseBool(value)
+		},
+	}
+}
+
+// Mount mounts the read and write routes of the resource under path
+func (r *Resource[T]) Mount(router gin.IRouter, path string, handlers ...gin.HandlerFunc) {
+	r.MountRead(router, path, handlers...)
+	r.MountWrite(router, path, handlers...)
+}
+
+// MountRead mounts GET path and GET path/:id, preceded by handlers
+func (r *Resource[T]) MountRead(router gin.IRouter, path string, handlers ...gin.HandlerFunc) {
+	router.GET(path, append(handlers, r.List)...)
+	router.GET(path+"/:id", append(handlers, r.Get)...)
+}
+
+// MountWrite mounts POST path, PATCH path/:id and DELETE path/:id, preceded by handlers
+func (r *Resource[T]) MountWrite(router gin.IRouter, path string, handlers ...gin.HandlerFunc) {
+	router.POST(path, append(handlers, r.Create)...)
+	router.PATCH(path+"/:id", append(handlers, r.Update)...)
+	router.DELETE(path+"/:id", append(handlers, r.Delete)...)
+}
+
+// List returns every record matching the configured filters
+func (r *Resource[T]) List(c *gin.Context) {
+	query := r.query(r.db.WithContext(c))
+	for _, filter := range r.cfg.Filters {
+		raw := c.Query(filter.Param)
+		if raw == "" {
+			continue
+		}
+		var value interface{} = raw
+		if filter.Parse != nil {
+			parsed, err := filter.Parse(raw)
+			if err != nil {
+				AbortWithError(c, BadRequest(fmt.Sprintf("invalid %s parameter", filter.Param)))
+				return
+			}
+			value = parsed
+		}
+		query = query.Where(clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: filter.Column}, Value: value})
+	}
+
+	records := []T{}
+	if err := query.Find(&records).Error; err != nil {
+		AbortWithError(c, Internal(fmt.Sprintf("failed to fetch %s", r.cfg.Plural), err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{r.cfg.Plural: records})
+}
+
+// Get returns the record identified by the :id parameter
+func (r *Resource[T]) Get(c *gin.Context) {
+	id, ok := r.parseID(c)
+	if !ok {
+		return
+	}
+	record, err := r.load(r.query(r.db.WithContext(c)), id)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{r.cfg.Name: record})
+}
+
+// Create creates a record from the request body
+func (r *Resource[T]) Create(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		AbortWithError(c, BadRequest("failed to read request body"))
+		return
+	}
+
+	record := new(T)
+	err = r.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		if err := r.decode(tx, body, record); err != nil {
+			return err
+		}
+		if err := r.runHook(r.cfg.Hooks.BeforeCreate, c, tx, record); err != nil {
+			return err
+		}
+		if err := tx.Omit(clause.Associations).Create(record).Error; err != nil {
+			return err
+		}
+		if err := r.replaceAssociations(tx, body, record); err != nil {
+			return err
+		}
+		return r.runHook(r.cfg.Hooks.AfterCreate, c, tx, record)
+	})
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	r.respond(c, http.StatusCreated, record)
+}
+
+// Update applies a partial update from the request body to the record
+// identified by the :id parameter. Fields missing from the body are kept
+// and associations are only replaced when their key is present.
+func (r *Resource[T]) Update(c *gin.Context) {
+	id, ok := r.parseID(c)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		AbortWithError(c, BadRequest("failed to read request body"))
+		return
+	}
+
+	var record *T
+	err = r.db.WithContext(c).Transaction(func(tx *gorm.DB) (err error) {
+		if record, err = r.load(tx, id); err != nil {
+			return
+		}
+		if err = r.decode(tx, body, record); err != nil {
+			return
+		}
+		if err = r.runHook(r.cfg.Hooks.BeforeUpdate, c, tx, record); err != nil {
+			return
+		}
+		if err = tx.Omit(clause.Associations).Save(record).Error; err != nil {
+			return
+		}
+		if err = r.replaceAssociations(tx, body, record); err != nil {
+			return
+		}
+		return r.runHook(r.cfg.Hooks.AfterUpdate, c, tx, record)
+	})
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	r.respond(c, http.StatusOK, record)
+}
+
+// Delete deletes the record identified by the :id parameter
+func (r *Resource[T]) Delete(c *gin.Context) {
+	id, ok := r.parseID(c)
+	if !ok {
+		return
+	}
+
+	err := r.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		record, err := r.load(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := r.runHook(r.cfg.Hooks.BeforeDelete, c, tx, record); err != nil {
+			return err
+		}
+		if err := tx.Delete(record).Error; err != nil {
+			return err
+		}
+		return r.runHook(r.cfg.Hooks.AfterDelete, c, tx, record)
+	})
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func (r *Resource[T]) query(db *gorm.DB) *gorm.DB {
+	if r.cfg.Query != nil {
+		return r.cfg.Query(db)
+	}
+	return db
+}
+
+func (r *Resource[T]) parseID(c *gin.Context) (id uint, ok bool) {
+	parsed, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		AbortWithError(c, BadRequest(fmt.Sprintf("invalid %s ID", r.cfg.Name)))
+		return
+	}
+	return uint(parsed), true
+}
+
+func (r *Resource[T]) load(db *gorm.DB, id uint) (record *T, err error) {
+	record = new(T)
+	if err = db.First(record, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = NotFound(fmt.Sprintf("%s not found", r.cfg.Name))
+		}
+		return nil, err
+	}
+	return
+}
+
+func (r *Resource[T]) respond(c *gin.Context, status int, record *T) {
+	id, _ := r.primaryKey(record)
+	reloaded, err := r.load(r.query(r.db.WithContext(c)), id)
+	if err != nil {
+		AbortWithError(c, err)
+		return
+	}
+	c.JSON(status, gin.H{r.cfg.Name: reloaded})
+}
+
+func (r *Resource[T]) runHook(hook ResourceHook[T], c *gin.Context, tx *gorm.DB, record *T) error {
+	if hook == nil {
+		return nil
+	}
+	return hook(c, tx, record)
+}
+
+// decode merges the JSON body into the record, keeping the protected
+// fields as they were, and validates the result
+func (r *Resource[T]) decode(db *gorm.DB, body []byte, record *T) (err error) {
+	stmt := &gorm.Statement{DB: db}
+	if err = stmt.Parse(record); err != nil {
+		return
+	}
+	rv := reflect.ValueOf(record).Elem()
+	saved := make(map[string]interface{}, len(protectedFields))
+	for _, name := range protectedFields {
+		if field := stmt.Schema.LookUpField(name); field != nil {
+			saved[name], _ = field.ValueOf(db.Statement.Context, rv)
+		}
+	}
+
+	if err = json.Unmarshal(body, record); err != nil {
+		return
+	}
+
+	for name, value := range saved {
+		if err = stmt.Schema.LookUpField(name).Set(db.Statement.Context, rv, value); err != nil {
+			return
+		}
+	}
+	return binding.Validator.ValidateStruct(record)
+}
+
+// replaceAssociations replaces every configured association whose key is
+// present in the body with the records identified by the given IDs
+func (r *Resource[T]) replaceAssociations(tx *gorm.DB, body []byte, record *T) (err error) {
+	if len(r.cfg.Associations) == 0 {
+		return
+	}
+	var raw map[string]json.RawMessage
+	if err = json.Unmarshal(body, &raw); err != nil {
+		return
+	}
+
+	stmt := &gorm.Statement{DB: tx}
+	if err = stmt.Parse(record); err != nil {
+		return
+	}
+	for _, association := range r.cfg.Associations {
+		rawIDs, present := raw[association.Key]
+		if !present {
+			continue
+		}
+		var ids []uint
+		if err = json.Unmarshal(rawIDs, &ids); err != nil {
+			return ErrInvalidField{Field: association.Key, Message: "must be a list of IDs"}
+		}
+		// Repeated IDs name the same record once
+		slices.Sort(ids)
+		ids = slices.Compact(ids)
+		relationship, found := stmt.Schema.Relationships.Relations[association.Field]
+		if !found {
+			return fmt.Errorf("%T has no association %s", record, association.Field)
+		}
+
+		related := reflect.New(reflect.SliceOf(relationship.FieldSchema.ModelType))
+		if len(ids) > 0 {
+			if err = tx.Where("id IN ?", ids).Find(related.Interface()).Error; err != nil {
+				return
+			}
+		}
+		if related.Elem().Len() != len(ids) {
+			return ErrInvalidField{
+				Field:   association.Key,
+				Message: fmt.Sprintf("one or more %s not found", strings.ToLower(association.Field)),
+			}
+		}
+		if err = tx.Model(record).Association(association.Field).Replace(related.Elem().Interface()); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (r *Resource[T]) primaryKey(record *T) (id uint, err error) {
+	stmt := &gorm.Statement{DB: r.db}
+	if err = stmt.Parse(record); err != nil {
+		return
+	}
+	value, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(r.db.Statement.Context, reflect.ValueOf(record).Elem())
+	id, _ = value.(uint)
+	return
+}
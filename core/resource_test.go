@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type (
+	gadget struct {
+		BaseModel
+
+		Name     string `json:"name" binding:"required" gorm:"not null"`
+		Color    string `json:"color"`
+		IsActive bool   `json:"is_active"`
+		Tags     []tag  `json:"tags" gorm:"many2many:gadget_tags"`
+	}
+
+	tag struct {
+		BaseModel
+
+		Label string `json:"label"`
+	}
+)
+
+func setupTestResource(t *testing.T, hooks ResourceHooks[gadget]) (*gin.Engine, *gorm.DB) {
+	gin.SetMode(gin.TestMode)
+	db := setupOwnershipDB(t)
+	if err := db.AutoMigrate(&gadget{}, &tag{}); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	resource := NewResource(db, ResourceConfig[gadget]{
+		Name:         "gadget",
+		Query:        func(tx *gorm.DB) *gorm.DB { return tx.Preload("Tags") },
+		Filters:      []Filter{BoolFilter("active", "is_active")},
+		Associations: []Association{{Field: "Tags", Key: "tag_ids"}},
+		Hooks:        hooks,
+	})
+	router := gin.New()
+	resource.Mount(router, "/gadgets", func(c *gin.Context) {
+		if owner := c.GetHeader("X-Owner"); owner != "" {
+			SetOwner(c, Owner{ID: owner})
+		}
+	})
+	return router, db
+}
+
+func doJSON(router *gin.Engine, method, path, owner string, body interface{}) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if owner != "" {
+		req.Header.Set("X-Owner", owner)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func decodeGadget(t *testing.T, w *httptest.ResponseRecorder) gadget {
+	var response struct {
+		Gadget gadget `json:"gadget"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Gadget
+}
+
+func TestResourceCRUD(t *testing.T) {
+	router, db := setupTestResource(t, ResourceHooks[gadget]{})
+	tags := []tag{{Label: "a", BaseModel: BaseModel{OwnedBy: "1"}}, {Label: "b", BaseModel: BaseModel{OwnedBy: "1"}}}
+	assert.NoError(t, db.Create(&tags).Error)
+
+	// Create
+	w := doJSON(router, http.MethodPost, "/gadgets", "1", map[string]interface{}{
+		"id":        99,
+		"owned_by":  "2",
+		"name":      "Widget",
+		"color":     "red",
+		"is_active": true,
+		"tag_ids":   []uint{tags[0].ID},
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	created := decodeGadget(t, w)
+	assert.NotEqual(t, uint(99), created.ID)
+	assert.Equal(t, "1", created.OwnedBy)
+	assert.Len(t, created.Tags, 1)
+
+	w = doJSON(router, http.MethodPost, "/gadgets", "1", map[string]interface{}{"color": "blue"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), CodeValidation)
+
+	// Partial update keeps fields missing from the body
+	w = doJSON(router, http.MethodPatch, "/gadgets/1", "1", map[string]interface{}{
+		"name":    "Renamed",
+		"tag_ids": []uint{tags[0].ID, tags[1].ID},
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	updated := decodeGadget(t, w)
+	assert.Equal(t, "Renamed", updated.Name)
+	assert.Equal(t, "red", updated.Color)
+	assert.Len(t, updated.Tags, 2)
+
+	// Repeated IDs are the same tag
+	w = doJSON(router, http.MethodPatch, "/gadgets/1", "1", map[string]interface{}{"tag_ids": []uint{tags[1].ID, tags[1].ID}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeGadget(t, w).Tags, 1)
+
+	w = doJSON(router, http.MethodPatch, "/gadgets/1", "1", map[string]interface{}{"tag_ids": []uint{999}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "tag_ids")
+
+	// Other owners can't see or modify the record
+	assert.Equal(t, http.StatusNotFound, doJSON(router, http.MethodGet, "/gadgets/1", "2", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, http.MethodPatch, "/gadgets/1", "2", map[string]interface{}{"name": "x"}).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, http.MethodDelete, "/gadgets/1", "2", nil).Code)
+
+	// List and filters
+	doJSON(router, http.MethodPost, "/gadgets", "1", map[string]interface{}{"name": "Inactive"})
+	var list struct {
+		Gadgets []gadget `json:"gadgets"`
+	}
+	w = doJSON(router, http.MethodGet, "/gadgets?active=true", "1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Gadgets, 1)
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, http.MethodGet, "/gadgets?active=maybe", "1", nil).Code)
+
+	// Delete
+	assert.Equal(t, http.StatusNoContent, doJSON(router, http.MethodDelete, "/gadgets/1", "1", nil).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(router, http.MethodGet, "/gadgets/1", "1", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, doJSON(router, http.MethodGet, "/gadgets/abc", "1", nil).Code)
+}
+
+func TestResourceHooks(t *testing.T) {
+	router, db := setupTestResource(t, ResourceHooks[gadget]{
+		BeforeCreate: func(c *gin.Context, tx *gorm.DB, record *gadget) error {
+			record.Color = "green"
+			return nil
+		},
+		AfterCreate: func(c *gin.Context, tx *gorm.DB, record *gadget) error {
+			if record.Name == "Rejected" {
+				return ErrInvalidField{Field: "name", Message: "is rejected"}
+			}
+			return nil
+		},
+		BeforeDelete: func(c *gin.Context, tx *gorm.DB, record *gadget) error {
+			return ErrDeleteForbidden{Message: "gadgets are forever"}
+		},
+	})
+
+	w := doJSON(router, http.MethodPost, "/gadgets", "", map[string]interface{}{"name": "Hooked"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "green", decodeGadget(t, w).Color)
+
+	// Errors in hooks roll the transaction back
+	w = doJSON(router, http.MethodPost, "/gadgets", "", map[string]interface{}{"name": "Rejected"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var count int64
+	db.WithContext(context.Background()).Model(&gadget{}).Where("name = ?", "Rejected").Count(&count)
+	assert.Equal(t, int64(0), count)
+
+	assert.Equal(t, http.StatusConflict, doJSON(router, http.MethodDelete, "/gadgets/1", "", nil).Code)
+}
@@ -0,0 +1,107 @@
+package plans
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+)
+
+// CodeFeatureNotIncluded is the error code returned when the user's plan
+// lacks a feature required by a route
+const CodeFeatureNotIncluded = "feature_not_included"
+
+// Entitlements returns the names of the active features included in the
+// plan of the user's current subscription. Users without a current
+// subscription have no entitlements.
+func (pm *PlanManager) Entitlements(ctx context.Context, userID uint) (features []string, err error) {
+	subscription, err := pm.CurrentSubscription(ctx, userID)
+	if err != nil {
+		if isNotFound(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return subscriptionFeatures(subscription), nil
+}
+
+// HasFeature reports whether the user's current subscription includes the active feature
+func (pm *PlanManager) HasFeature(ctx context.Context, userID uint, feature string) (bool, error) {
+	features, err := pm.Entitlements(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range features {
+		if name == feature {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RequireFeature only lets users whose current subscription includes the
+// active feature through. Users without a current subscription get a 402,
+// users whose plan lacks the feature or was deleted a 403. It only reads the
+// subscription, see CurrentSubscription. It must run after AuthMiddleware.
+func (pm *PlanManager) RequireFeature(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := pm.sessMgr.GetUserID(c)
+		if userID == 0 {
+			core.AbortWithError(c, core.Unauthorized("Not authenticated"))
+			return
+		}
+
+		subscription, err := pm.CurrentSubscription(c, userID)
+		if err != nil {
+			if isNotFound(err) {
+				core.AbortWithError(c, core.PaymentRequired(fmt.Sprintf("a subscription is required to use '%s'", feature)))
+				return
+			}
+			core.AbortWithError(c, core.Internal("failed to fetch subscription", err))
+			return
+		}
+
+		if subscription.Plan == nil {
+			core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeFeatureNotIncluded,
+				fmt.Sprintf("the subscription's plan is no longer available to use '%s'", feature)))
+			return
+		}
+		for _, name := range subscriptionFeatures(subscription) {
+			if name == feature {
+				c.Next()
+				return
+			}
+		}
+		core.AbortWithError(c, core.NewError(http.StatusForbidden, CodeFeatureNotIncluded,
+			fmt.Sprintf("plan '%s' does not include '%s'", subscription.Plan.Name, feature)))
+	}
+}
+
+// GetEntitlementsHandler returns the features the authenticated user is entitled to
+func (pm *PlanManager) GetEntitlementsHandler(c *gin.Context) {
+	features, err := pm.Entitlements(c, pm.sessMgr.GetUserID(c))
+	if err != nil {
+		core.AbortWithError(c, core.Internal("failed to fetch entitlements", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"features": features})
+}
+
+func subscriptionFeatures(subscription *Subscription) []string {
+	features := []string{}
+	if subscription.Plan == nil {
+		return features
+	}
+	for _, feature := range subscription.Plan.Features {
+		features = append(features, feature.Name)
+	}
+	return features
+}
+
+func isNotFound(err error) bool {
+	var apiErr *core.Error
+	return errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound
+}
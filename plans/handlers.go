@@ -2,13 +2,17 @@ package plans
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
 	"gorm.io/gorm"
 )
 
+// UpdatePlanRequest documents the partial update accepted by UpdatePlanHandler.
+// Fields left out are kept; FeatureIDs replaces the plan's features.
 type UpdatePlanRequest struct {
 	Name        *string  `json:"name,omitempty"`
 	Description *string  `json:"description,omitempty"`
@@ -18,155 +22,144 @@ type UpdatePlanRequest struct {
 	FeatureIDs  []uint   `json:"feature_ids,omitempty"`
 }
 
-// GetPlansHandler returns all active plans with their features
-func (pm *PlanManager) GetPlansHandler(c *gin.Context) {
-	var plans []Plan
-	query := pm.db.Preload("Features", "is_active = ?", true)
-
-	// Filter by active status if specified
-	if active := c.Query("active"); active != "" {
-		isActive, err := strconv.ParseBool(active)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid active parameter"})
-			return
-		}
-		query = query.Where("is_active = ?", isActive)
-	}
+// newPlanResource builds the REST controller for plans. Plans are returned
+// with their active features and can be filtered with ?active=true|false.
+func newPlanResource(db *gorm.DB) *core.Resource[Plan] {
+	return core.NewResource(db, core.ResourceConfig[Plan]{
+		Name:   "plan",
+		Plural: "plans",
+		Query: func(tx *gorm.DB) *gorm.DB {
+			return tx.Preload("Features", "is_active = ?", true)
+		},
+		Filters: []core.Filter{
+			core.BoolFilter("active", "is_active"),
+		},
+		Associations: []core.Association{
+			{Field: "Features", Key: "feature_ids"},
+		},
+	})
+}
 
-	if err := query.Find(&plans).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch plans"})
-		return
-	}
+// newFeatureResource builds the REST controller for features. Features can
+// be filtered with ?active=true|false.
+func newFeatureResource(db *gorm.DB) *core.Resource[Feature] {
+	return core.NewResource(db, core.ResourceConfig[Feature]{
+		Name:   "feature",
+		Plural: "features",
+		Filters: []core.Filter{
+			core.BoolFilter("active", "is_active"),
+		},
+	})
+}
 
-	c.JSON(http.StatusOK, gin.H{"plans": plans})
+// GetPlansHandler returns all plans with their active features
+func (pm *PlanManager) GetPlansHandler(c *gin.Context) {
+	pm.plans.List(c)
 }
 
 // GetPlanHandler returns a single plan by ID
 func (pm *PlanManager) GetPlanHandler(c *gin.Context) {
-	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan ID"})
-		return
-	}
-
-	var plan Plan
-	err = pm.db.Preload("Features", "is_active = ?", true).First(&plan, id).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "plan not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch plan"})
-		return
-	}
-
-	c.JSON(http.StatusOK, gin.H{"plan": plan})
+	pm.plans.Get(c)
 }
 
 // UpdatePlanHandler updates an existing plan
 func (pm *PlanManager) UpdatePlanHandler(c *gin.Context) {
-	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan ID"})
-		return
-	}
+	pm.plans.Update(c)
+}
 
-	var req UpdatePlanRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
+// CreatePlanHandler creates a plan, optionally with its feature_ids
+func (pm *PlanManager) CreatePlanHandler(c *gin.Context) {
+	pm.plans.Create(c)
+}
 
-	// Start a transaction
-	tx := pm.db.Begin()
-	if tx.Error != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start transaction"})
-		return
-	}
-	defer func() {
-		if r := recover(); r != nil {
-			tx.Rollback()
-		}
-	}()
+// DeletePlanHandler deletes a plan
+func (pm *PlanManager) DeletePlanHandler(c *gin.Context) {
+	pm.plans.Delete(c)
+}
 
-	// Fetch existing plan
-	var plan Plan
-	if err := tx.First(&plan, id).Error; err != nil {
-		tx.Rollback()
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			c.JSON(http.StatusNotFound, gin.H{"error": "plan not found"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch plan"})
-		return
-	}
+// GetFeaturesHandler returns all features
+func (pm *PlanManager) GetFeaturesHandler(c *gin.Context) {
+	pm.features.List(c)
+}
 
-	// Update fields if provided
-	if req.Name != nil {
-		plan.Name = *req.Name
-	}
-	if req.Description != nil {
-		plan.Description = *req.Description
-	}
-	if req.Price != nil {
-		plan.Price = *req.Price
-	}
-	if req.Interval != nil {
-		plan.Interval = *req.Interval
-	}
-	if req.IsActive != nil {
-		plan.IsActive = *req.IsActive
-	}
+// GetFeatureHandler returns a single feature by ID
+func (pm *PlanManager) GetFeatureHandler(c *gin.Context) {
+	pm.features.Get(c)
+}
 
-	// Update plan
-	if err := tx.Save(&plan).Error; err != nil {
-		tx.Rollback()
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update plan"})
-		return
-	}
+// CreateFeatureHandler creates a feature
+func (pm *PlanManager) CreateFeatureHandler(c *gin.Context) {
+	pm.features.Create(c)
+}
 
-	// Update features if provided
-	if req.FeatureIDs != nil {
-		// Clear existing features
-		if err := tx.Model(&plan).Association("Features").Clear(); err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear features"})
-			return
-		}
+// UpdateFeatureHandler updates an existing feature
+func (pm *PlanManager) UpdateFeatureHandler(c *gin.Context) {
+	pm.features.Update(c)
+}
 
-		// Add new features
-		var features []Feature
-		if err := tx.Where("id IN ?", req.FeatureIDs).Find(&features).Error; err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch features"})
-			return
-		}
+// DeleteFeatureHandler deletes a feature unless it is used in active plans
+func (pm *PlanManager) DeleteFeatureHandler(c *gin.Context) {
+	pm.features.Delete(c)
+}
 
-		if len(features) != len(req.FeatureIDs) {
-			tx.Rollback()
-			c.JSON(http.StatusBadRequest, gin.H{"error": "one or more features not found"})
-			return
-		}
+// AddPlanFeatureHandler attaches the :feature_id feature to the :id plan
+func (pm *PlanManager) AddPlanFeatureHandler(c *gin.Context) {
+	pm.updatePlanFeature(c, func(association *gorm.Association, feature *Feature) error {
+		return association.Append(feature)
+	})
+}
 
-		if err := tx.Model(&plan).Association("Features").Replace(features); err != nil {
-			tx.Rollback()
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update features"})
-			return
-		}
+// RemovePlanFeatureHandler detaches the :feature_id feature from the :id plan
+func (pm *PlanManager) RemovePlanFeatureHandler(c *gin.Context) {
+	pm.updatePlanFeature(c, func(association *gorm.Association, feature *Feature) error {
+		return association.Delete(feature)
+	})
+}
+
+func (pm *PlanManager) updatePlanFeature(c *gin.Context, update func(*gorm.Association, *Feature) error) {
+	planID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid plan ID"))
+		return
+	}
+	featureID, err := strconv.ParseUint(c.Param("feature_id"), 10, 32)
+	if err != nil {
+		core.AbortWithError(c, core.BadRequest("invalid feature ID"))
+		return
 	}
 
-	// Commit transaction
-	if err := tx.Commit().Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to commit transaction"})
+	err = pm.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		var plan Plan
+		if err := tx.First(&plan, planID).Error; err != nil {
+			return notFound(err, "plan not found")
+		}
+		var feature Feature
+		if err := tx.First(&feature, featureID).Error; err != nil {
+			return notFound(err, "feature not found")
+		}
+		association := tx.Model(&plan).Association("Features")
+		if err := update(association, &feature); err != nil {
+			return err
+		}
+		return association.Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
 		return
 	}
 
-	// Fetch updated plan with features
-	var updatedPlan Plan
-	if err := pm.db.Preload("Features").First(&updatedPlan, id).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch updated plan"})
+	var plan Plan
+	if err := pm.db.WithContext(c).Preload("Features", "is_active = ?", true).First(&plan, planID).Error; err != nil {
+		core.AbortWithError(c, core.Internal("failed to fetch plan", err))
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"plan": plan})
+}
 
-	c.JSON(http.StatusOK, gin.H{"plan": updatedPlan})
+// notFound replaces gorm.ErrRecordNotFound with a not found error carrying message
+func notFound(err error, message string) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return core.NotFound(message)
+	}
+	return fmt.Errorf("%s: %w", message, err)
 }
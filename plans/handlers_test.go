@@ -8,10 +8,13 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/authentication"
+	"github.com/gsarmaonline/goweb/core"
 	"github.com/stretchr/testify/assert"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -34,9 +37,12 @@ func setupTestDB(t *testing.T) *gorm.DB {
 		t.Fatalf("Failed to connect to test database: %v", err)
 	}
 
-	// Auto migrate the schema
-	err = db.AutoMigrate(&Plan{}, &Feature{}, &PlanFeature{})
-	if err != nil {
+	// Apply the plugin's migrations
+	migrator := core.NewMigrator(db)
+	if err = migrator.Register(PluginName, (&PlanManager{}).Migrations()...); err != nil {
+		t.Fatalf("Failed to register migrations: %v", err)
+	}
+	if err = migrator.Up(context.Background()); err != nil {
 		t.Fatalf("Failed to migrate test database: %v", err)
 	}
 
@@ -301,3 +307,462 @@ func TestUpdatePlanHandler(t *testing.T) {
 		})
 	}
 }
+
+const testSecretKey = "test-secret-key"
+
+type testRouter struct {
+	router      *gin.Engine
+	db          *gorm.DB
+	planManager *PlanManager
+	sessMgr     *authentication.SessionManager
+	adminToken  string
+	userToken   string
+}
+
+// setupTestRouter mounts the plans routes behind a real session manager and
+// creates bearer tokens for a superadmin and a regular user
+func setupTestRouter(t *testing.T) *testRouter {
+	planManager, db := setupTestPlanManager(t)
+
+	migrator := core.NewMigrator(db)
+	if err := migrator.Register(authentication.PluginName, (&authentication.SessionManager{}).Migrations()...); err != nil {
+		t.Fatalf("Failed to register migrations: %v", err)
+	}
+	if err := migrator.Up(context.Background()); err != nil {
+		t.Fatalf("Failed to migrate test database: %v", err)
+	}
+
+	// Scope queries to their owner like server.NewServer
+	if err := core.RegisterOwnership(db); err != nil {
+		t.Fatalf("Failed to register ownership callbacks: %v", err)
+	}
+
+	t.Setenv("JWT_SECRET_KEY", testSecretKey)
+	router := gin.New()
+	sessMgr, err := authentication.NewSessionManager(context.Background(), db, router,
+		authentication.WithSuperadmin("admin@example.com", ""))
+	if err != nil {
+		t.Fatalf("Failed to create session manager: %v", err)
+	}
+
+	adminToken := createTestToken(t, db, sessMgr.Keyring(), "admin@example.com", true)
+	userToken := createTestToken(t, db, sessMgr.Keyring(), "user@example.com", false)
+
+	// Initialising the session manager makes the admin a superadmin
+	reg := core.NewRegistry()
+	if err := reg.Register(sessMgr, planManager); err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+	if err := sessMgr.Init(context.Background(), reg); err != nil {
+		t.Fatalf("Failed to init session manager: %v", err)
+	}
+	if err := planManager.Init(context.Background(), reg); err != nil {
+		t.Fatalf("Failed to init plan manager: %v", err)
+	}
+	if err := planManager.RegisterRoutes(router); err != nil {
+		t.Fatalf("Failed to register routes: %v", err)
+	}
+
+	return &testRouter{
+		router:      router,
+		db:          db,
+		planManager: planManager,
+		sessMgr:     sessMgr,
+		adminToken:  adminToken,
+		userToken:   userToken,
+	}
+}
+
+func createTestToken(t *testing.T, db *gorm.DB, keyring *authentication.Keyring, email string, isAdmin bool) string {
+	user := &authentication.SessionUser{Email: email, Password: "password123", IsAdmin: isAdmin}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+	session, err := authentication.NewSession(keyring, user, "127.0.0.1", "test-agent")
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	if err := db.Create(session).Error; err != nil {
+		t.Fatalf("Failed to save session: %v", err)
+	}
+	return session.Token
+}
+
+func doRequest(router *gin.Engine, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestPlanRoutesRequirePermission(t *testing.T) {
+	env := setupTestRouter(t)
+	router, db, adminToken, userToken := env.router, env.db, env.adminToken, env.userToken
+	plan := createTestPlan(t, db, "Routes")
+	planPath := "/plans/" + strconv.Itoa(int(plan.ID))
+
+	// Editors are granted plans:write by their role
+	var permission authentication.Permission
+	if err := db.Where("name = ?", PermissionPlansWrite).First(&permission).Error; err != nil {
+		t.Fatalf("Failed to find permission: %v", err)
+	}
+	if err := db.Create(&authentication.Role{Name: "editor", Permissions: []*authentication.Permission{&permission}}).Error; err != nil {
+		t.Fatalf("Failed to create role: %v", err)
+	}
+	editorToken := createTestToken(t, db, env.sessMgr.Keyring(), "editor@example.com", false)
+	var editor authentication.SessionUser
+	db.Where("email = ?", "editor@example.com").First(&editor)
+	if err := env.sessMgr.AssignRole(editor.ID, "editor"); err != nil {
+		t.Fatalf("Failed to assign role: %v", err)
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		path         string
+		token        string
+		body         interface{}
+		expectedCode int
+	}{
+		{"list plans anonymously", http.MethodGet, "/plans", "", nil, http.StatusOK},
+		{"get plan anonymously", http.MethodGet, planPath, "", nil, http.StatusOK},
+		{"list features anonymously", http.MethodGet, "/features", "", nil, http.StatusOK},
+		{"create plan anonymously", http.MethodPost, "/plans", "", map[string]interface{}{"name": "X"}, http.StatusUnauthorized},
+		{"create plan as user", http.MethodPost, "/plans", userToken, map[string]interface{}{"name": "X"}, http.StatusForbidden},
+		{"update plan as user", http.MethodPatch, planPath, userToken, map[string]interface{}{"name": "X"}, http.StatusForbidden},
+		{"delete plan as user", http.MethodDelete, planPath, userToken, nil, http.StatusForbidden},
+		{"create feature as user", http.MethodPost, "/features", userToken, map[string]interface{}{"name": "X"}, http.StatusForbidden},
+		{"update plan as superadmin", http.MethodPatch, planPath, adminToken, map[string]interface{}{"name": "Renamed"}, http.StatusOK},
+		{"update other's plan as editor", http.MethodPatch, planPath, editorToken, map[string]interface{}{"name": "Edited"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := doRequest(router, tt.method, tt.path, tt.token, tt.body)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+
+	// Editors only edit their own plans, while nobody subscribes to them
+	w := doRequest(router, http.MethodPost, "/plans", editorToken, map[string]interface{}{"name": "Editor Plan", "price": 5, "interval": "monthly"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		Plan Plan `json:"plan"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	editorPlanPath := "/plans/" + strconv.Itoa(int(created.Plan.ID))
+	assert.Equal(t, http.StatusOK, doRequest(router, http.MethodPatch, editorPlanPath, editorToken, map[string]interface{}{"price": 6}).Code)
+	assert.Equal(t, http.StatusCreated, doRequest(router, http.MethodPost, "/subscriptions", userToken, map[string]interface{}{
+		"plan_id": created.Plan.ID,
+	}).Code)
+	w = doRequest(router, http.MethodPatch, editorPlanPath, editorToken, map[string]interface{}{"price": 7})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, http.StatusForbidden, doRequest(router, http.MethodPatch, editorPlanPath, adminToken, map[string]interface{}{"price": 7}).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodPatch, "/plans/999", adminToken, map[string]interface{}{"price": 7}).Code)
+
+	// Editors aren't admins, yet other users' subscriptions still keep the
+	// plan from being deleted
+	w = doRequest(router, http.MethodDelete, editorPlanPath, editorToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "plan has active subscriptions")
+}
+
+func TestPlanAndFeatureManagement(t *testing.T) {
+	env := setupTestRouter(t)
+	router, adminToken := env.router, env.adminToken
+
+	// Create features and a plan using them
+	var featureResponse struct {
+		Feature Feature `json:"feature"`
+	}
+	w := doRequest(router, http.MethodPost, "/features", adminToken, map[string]interface{}{
+		"name": "export", "description": "Export data", "is_active": true,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &featureResponse))
+	export := featureResponse.Feature
+
+	w = doRequest(router, http.MethodPost, "/features", adminToken, map[string]interface{}{
+		"name": "api", "is_active": true,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &featureResponse))
+	api := featureResponse.Feature
+
+	assert.Equal(t, http.StatusConflict, doRequest(router, http.MethodPost, "/features", adminToken, map[string]interface{}{
+		"name": "api",
+	}).Code)
+
+	var planResponse struct {
+		Plan Plan `json:"plan"`
+	}
+	w = doRequest(router, http.MethodPost, "/plans", adminToken, map[string]interface{}{
+		"name": "Pro", "price": 29.0, "interval": "monthly", "is_active": true,
+		"feature_ids": []uint{export.ID},
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &planResponse))
+	assert.Len(t, planResponse.Plan.Features, 1)
+	planPath := "/plans/" + strconv.Itoa(int(planResponse.Plan.ID))
+
+	w = doRequest(router, http.MethodPost, "/plans", adminToken, map[string]interface{}{
+		"name": "Weekly", "price": 1.0, "interval": "weekly",
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "interval")
+
+	// Attach and detach individual features
+	w = doRequest(router, http.MethodPost, planPath+"/features/"+strconv.Itoa(int(api.ID)), adminToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &planResponse))
+	assert.Len(t, planResponse.Plan.Features, 2)
+
+	w = doRequest(router, http.MethodDelete, planPath+"/features/"+strconv.Itoa(int(api.ID)), adminToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &planResponse))
+	assert.Len(t, planResponse.Plan.Features, 1)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodPost, planPath+"/features/999", adminToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodPost, "/plans/999/features/1", adminToken, nil).Code)
+
+	// Features used in active plans can't be deleted
+	exportPath := "/features/" + strconv.Itoa(int(export.ID))
+	w = doRequest(router, http.MethodDelete, exportPath, adminToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "feature is used in active plans")
+
+	w = doRequest(router, http.MethodPatch, exportPath, adminToken, map[string]interface{}{"description": "CSV export"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &featureResponse))
+	assert.Equal(t, "CSV export", featureResponse.Feature.Description)
+	assert.Equal(t, "export", featureResponse.Feature.Name)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(router, http.MethodDelete, planPath, adminToken, nil).Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodGet, planPath, "", nil).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(router, http.MethodDelete, exportPath, adminToken, nil).Code)
+}
+
+func TestSubscriptionLifecycle(t *testing.T) {
+	env := setupTestRouter(t)
+	router, db, adminToken, userToken := env.router, env.db, env.adminToken, env.userToken
+	monthly := createTestPlan(t, db, "Monthly")
+	yearly := createTestPlan(t, db, "Yearly")
+	yearly.Interval = "yearly"
+	db.Save(yearly)
+
+	var response struct {
+		Subscription Subscription `json:"subscription"`
+	}
+
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodGet, "/subscriptions/current", userToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, http.MethodGet, "/subscriptions/current", "", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(router, http.MethodPost, "/subscriptions", userToken, map[string]interface{}{
+		"plan_id": 999,
+	}).Code)
+
+	// Subscribe with a trial
+	w := doRequest(router, http.MethodPost, "/subscriptions", userToken, map[string]interface{}{
+		"plan_id": monthly.ID, "trial_days": 14,
+	})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, SubscriptionTrialing, response.Subscription.Status)
+	assert.Equal(t, monthly.ID, response.Subscription.Plan.ID)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 14), response.Subscription.CurrentPeriodEnd, time.Minute)
+
+	assert.Equal(t, http.StatusConflict, doRequest(router, http.MethodPost, "/subscriptions", userToken, map[string]interface{}{
+		"plan_id": monthly.ID,
+	}).Code)
+
+	// Plans with active subscriptions can't be deleted
+	w = doRequest(router, http.MethodDelete, "/plans/"+strconv.Itoa(int(monthly.ID)), adminToken, nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "plan has active subscriptions")
+
+	// Change plan
+	w = doRequest(router, http.MethodPost, "/subscriptions/current/change-plan", userToken, map[string]interface{}{
+		"plan_id": yearly.ID,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, yearly.ID, response.Subscription.PlanID)
+
+	// Cancel at period end keeps the subscription until the period is over
+	w = doRequest(router, http.MethodPost, "/subscriptions/current/cancel", userToken, map[string]interface{}{
+		"at_period_end": true,
+	})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, response.Subscription.CancelAtPeriodEnd)
+	assert.Equal(t, SubscriptionTrialing, response.Subscription.Status)
+
+	// Cancel immediately, with an empty chunked body
+	req := httptest.NewRequest(http.MethodPost, "/subscriptions/current/cancel", bytes.NewReader(nil))
+	req.ContentLength = -1
+	req.Header.Set("Authorization", "Bearer "+userToken)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, SubscriptionCanceled, response.Subscription.Status)
+	assert.NotNil(t, response.Subscription.CanceledAt)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(router, http.MethodGet, "/subscriptions/current", userToken, nil).Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(router, http.MethodDelete, "/plans/"+strconv.Itoa(int(monthly.ID)), adminToken, nil).Code)
+
+	var list struct {
+		Subscriptions []Subscription `json:"subscriptions"`
+	}
+	w = doRequest(router, http.MethodGet, "/subscriptions", userToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Subscriptions, 1)
+
+	w = doRequest(router, http.MethodGet, "/subscriptions", adminToken, nil)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Subscriptions, 0)
+}
+
+func TestSubscriptionRenewal(t *testing.T) {
+	planManager, db := setupTestPlanManager(t)
+	plan := createTestPlan(t, db, "Renewing")
+	now := time.Now()
+	planManager.now = func() time.Time { return now }
+	lastMonth := now.AddDate(0, -1, 0).Add(-time.Hour)
+
+	subscriptions := []Subscription{
+		{UserID: 1, PlanID: plan.ID, Status: SubscriptionActive, CurrentPeriodEnd: now.Add(-time.Hour), CancelAtPeriodEnd: true},
+		{UserID: 2, PlanID: plan.ID, Status: SubscriptionActive, CurrentPeriodStart: lastMonth.AddDate(0, -1, 0), CurrentPeriodEnd: lastMonth},
+		{UserID: 3, PlanID: plan.ID, Status: SubscriptionCanceled, CurrentPeriodEnd: now.Add(-time.Hour)},
+		{UserID: 4, PlanID: plan.ID, Status: SubscriptionTrialing, CurrentPeriodEnd: now.Add(time.Hour)},
+		{UserID: 5, PlanID: plan.ID, Status: SubscriptionTrialing, CurrentPeriodEnd: now.Add(-time.Hour)},
+		{UserID: 6, PlanID: plan.ID, Status: SubscriptionPastDue, CurrentPeriodEnd: now.Add(-time.Hour)},
+	}
+	assert.NoError(t, db.Create(&subscriptions).Error)
+	reload := func(idx int) Subscription {
+		var subscription Subscription
+		db.First(&subscription, subscriptions[idx].ID)
+		return subscription
+	}
+
+	// Looking up the current subscription only reads, leaving out the ones due to expire
+	_, err := planManager.CurrentSubscription(context.Background(), 1)
+	assert.Error(t, err)
+	assert.Equal(t, SubscriptionActive, reload(0).Status)
+	current, err := planManager.CurrentSubscription(context.Background(), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, plan.ID, current.Plan.ID)
+	assert.Equal(t, lastMonth.Unix(), reload(1).CurrentPeriodEnd.Unix())
+
+	// The subscription endpoints move it on
+	current, err = planManager.currentSubscription(db, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, SubscriptionActive, current.Status)
+	assert.True(t, current.CurrentPeriodEnd.After(now))
+	assert.Equal(t, lastMonth.AddDate(0, 2, 0).Unix(), current.CurrentPeriodEnd.Unix(), "missed periods are renewed")
+
+	renewed, err := planManager.RenewSubscriptions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), renewed)
+	assert.Equal(t, SubscriptionExpired, reload(0).Status)
+	assert.Equal(t, SubscriptionExpired, reload(2).Status)
+	assert.Equal(t, SubscriptionTrialing, reload(3).Status)
+	activated := reload(4)
+	assert.Equal(t, SubscriptionActive, activated.Status)
+	assert.Equal(t, now.Add(-time.Hour).Unix(), activated.CurrentPeriodStart.Unix())
+	assert.Equal(t, now.Add(-time.Hour).AddDate(0, 1, 0).Unix(), activated.CurrentPeriodEnd.Unix())
+	assert.Equal(t, SubscriptionPastDue, reload(5).Status)
+
+	// Saving a subscription follows the state machine
+	expired := reload(2)
+	expired.Status = SubscriptionActive
+	assert.ErrorContains(t, db.Save(&expired).Error, "subscription cannot move from expired to active")
+	assert.Equal(t, SubscriptionExpired, reload(2).Status)
+}
+
+func TestRequireFeature(t *testing.T) {
+	env := setupTestRouter(t)
+	router, db, userToken := env.router, env.db, env.userToken
+	planManager, sessMgr := env.planManager, env.sessMgr
+
+	plan := createTestPlan(t, db, "Entitled")
+	features := createTestFeatures(t, db, 2)
+	db.Model(plan).Association("Features").Replace(features)
+	inactive := Feature{Name: "Inactive", IsActive: true}
+	db.Create(&inactive)
+	db.Model(plan).Association("Features").Append(&inactive)
+	db.Model(&inactive).Update("is_active", false)
+
+	router.GET("/export", sessMgr.AuthMiddleware, planManager.RequireFeature(features[0].Name), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/reports", sessMgr.AuthMiddleware, planManager.RequireFeature("Reports"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/legacy", sessMgr.AuthMiddleware, planManager.RequireFeature(inactive.Name), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := doRequest(router, http.MethodGet, "/export", userToken, nil)
+	assert.Equal(t, http.StatusPaymentRequired, w.Code)
+	assert.Contains(t, w.Body.String(), core.CodePaymentRequired)
+
+	var user authentication.SessionUser
+	db.Where("email = ?", "user@example.com").First(&user)
+	entitlements, err := planManager.Entitlements(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, entitlements)
+
+	assert.Equal(t, http.StatusCreated, doRequest(router, http.MethodPost, "/subscriptions", userToken, map[string]interface{}{
+		"plan_id": plan.ID,
+	}).Code)
+
+	assert.Equal(t, http.StatusOK, doRequest(router, http.MethodGet, "/export", userToken, nil).Code)
+	w = doRequest(router, http.MethodGet, "/reports", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), CodeFeatureNotIncluded)
+	assert.Equal(t, http.StatusForbidden, doRequest(router, http.MethodGet, "/legacy", userToken, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, doRequest(router, http.MethodGet, "/export", "", nil).Code)
+
+	entitlements, err = planManager.Entitlements(context.Background(), user.ID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{features[0].Name, features[1].Name}, entitlements)
+
+	hasFeature, err := planManager.HasFeature(context.Background(), user.ID, "Reports")
+	assert.NoError(t, err)
+	assert.False(t, hasFeature)
+
+	var response struct {
+		Features []string `json:"features"`
+	}
+	w = doRequest(router, http.MethodGet, "/subscriptions/current/entitlements", userToken, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Len(t, response.Features, 2)
+
+	// A deleted plan no longer grants its features
+	var subscription Subscription
+	db.Where("user_id = ?", user.ID).First(&subscription)
+	db.Model(plan).UpdateColumn("deleted_at", time.Now())
+	w = doRequest(router, http.MethodGet, "/export", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), CodeFeatureNotIncluded)
+	db.Model(plan).UpdateColumn("deleted_at", nil)
+
+	// Subscriptions due to expire are refused without being written
+	db.Model(&subscription).UpdateColumns(map[string]interface{}{
+		"cancel_at_period_end": true,
+		"current_period_end":   time.Now().Add(-time.Hour),
+	})
+	assert.Equal(t, http.StatusPaymentRequired, doRequest(router, http.MethodGet, "/export", userToken, nil).Code)
+	db.First(&subscription, subscription.ID)
+	assert.Equal(t, SubscriptionActive, subscription.Status)
+}
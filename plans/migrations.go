@@ -0,0 +1,69 @@
+package plans
+
+import (
+	"time"
+
+	"github.com/gsarmaonline/goweb/core"
+)
+
+// The migrations work on snapshots of the models as they were when the
+// migration was written, so that later model changes don't alter them.
+type (
+	planV1 struct {
+		core.BaseModel
+
+		Name        string `gorm:"uniqueIndex;not null"`
+		Description string
+		Price       float64 `gorm:"not null"`
+		Interval    string  `gorm:"not null"`
+		IsActive    bool    `gorm:"default:true"`
+	}
+
+	featureV1 struct {
+		core.BaseModel
+
+		Name        string `gorm:"uniqueIndex;not null"`
+		Description string
+		IsActive    bool `gorm:"default:true"`
+	}
+
+	planFeatureV1 struct {
+		PlanID    uint `gorm:"primaryKey"`
+		FeatureID uint `gorm:"primaryKey"`
+	}
+
+	subscriptionV2 struct {
+		core.BaseModel
+
+		UserID             uint   `gorm:"not null;index"`
+		PlanID             uint   `gorm:"not null;index"`
+		Status             string `gorm:"not null;index"`
+		CurrentPeriodStart time.Time
+		CurrentPeriodEnd   time.Time
+		CancelAtPeriodEnd  bool `gorm:"not null;default:false"`
+		CanceledAt         *time.Time
+	}
+)
+
+func (planV1) TableName() string         { return "plans" }
+func (featureV1) TableName() string      { return "features" }
+func (planFeatureV1) TableName() string  { return "plan_features" }
+func (subscriptionV2) TableName() string { return "subscriptions" }
+
+// Migrations returns the schema migrations of the plans plugin
+func (pm *PlanManager) Migrations() []core.Migration {
+	return []core.Migration{
+		{
+			Version: 1,
+			Name:    "create_plans_and_features",
+			Up:      core.CreateTables(&planV1{}, &featureV1{}, &planFeatureV1{}),
+			Down:    core.DropTables(&planFeatureV1{}, &featureV1{}, &planV1{}),
+		},
+		{
+			Version: 2,
+			Name:    "create_subscriptions",
+			Up:      core.CreateTables(&subscriptionV2{}),
+			Down:    core.DropTables(&subscriptionV2{}),
+		},
+	}
+}
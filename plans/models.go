@@ -1,10 +1,44 @@
 package plans
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/gsarmaonline/goweb/core"
 	"gorm.io/gorm"
 )
 
+// SubscriptionStatus is the lifecycle state of a subscription
+type SubscriptionStatus string
+
+const (
+	SubscriptionTrialing SubscriptionStatus = "trialing"
+	SubscriptionActive   SubscriptionStatus = "active"
+	SubscriptionPastDue  SubscriptionStatus = "past_due"
+	SubscriptionCanceled SubscriptionStatus = "canceled"
+	SubscriptionExpired  SubscriptionStatus = "expired"
+)
+
+var (
+	// subscriptionTransitions lists the states each state may move to
+	subscriptionTransitions = map[SubscriptionStatus][]SubscriptionStatus{
+		SubscriptionTrialing: {SubscriptionActive, SubscriptionCanceled, SubscriptionExpired},
+		SubscriptionActive:   {SubscriptionPastDue, SubscriptionCanceled, SubscriptionExpired},
+		SubscriptionPastDue:  {SubscriptionActive, SubscriptionCanceled, SubscriptionExpired},
+		SubscriptionCanceled: {SubscriptionExpired},
+		SubscriptionExpired:  {},
+	}
+
+	// currentSubscriptionStatuses are the states in which a subscription
+	// still gives access to its plan
+	currentSubscriptionStatuses = []SubscriptionStatus{
+		SubscriptionTrialing,
+		SubscriptionActive,
+		SubscriptionPastDue,
+	}
+)
+
 type (
 	// Plan represents a subscription plan with its features and pricing
 	Plan struct {
@@ -28,6 +62,20 @@ type (
 		Plans       []Plan `json:"plans" gorm:"many2many:plan_features"`
 	}
 
+	// Subscription links a user to a plan for the current billing period
+	Subscription struct {
+		core.BaseModel
+
+		UserID             uint               `json:"user_id" gorm:"not null;index"`
+		PlanID             uint               `json:"plan_id" gorm:"not null;index"`
+		Plan               *Plan              `json:"plan,omitempty"`
+		Status             SubscriptionStatus `json:"status" gorm:"not null;index"`
+		CurrentPeriodStart time.Time          `json:"current_period_start"`
+		CurrentPeriodEnd   time.Time          `json:"current_period_end"`
+		CancelAtPeriodEnd  bool               `json:"cancel_at_period_end" gorm:"not null;default:false"`
+		CanceledAt         *time.Time         `json:"canceled_at,omitempty"`
+	}
+
 	// PlanFeature represents the many-to-many relationship between plans and features
 	PlanFeature struct {
 		PlanID    uint `gorm:"primaryKey"`
@@ -35,6 +83,12 @@ type (
 	}
 )
 
+// SharedAcrossOwners makes plans visible to every user
+func (p *Plan) SharedAcrossOwners() bool { return true }
+
+// SharedAcrossOwners makes features visible to every user
+func (f *Feature) SharedAcrossOwners() bool { return true }
+
 // BeforeCreate hook for Plan to validate the interval
 func (p *Plan) BeforeCreate(tx *gorm.DB) error {
 	// Validate interval
@@ -46,12 +100,39 @@ func (p *Plan) BeforeCreate(tx *gorm.DB) error {
 	}
 }
 
-// BeforeDelete hook for Plan to prevent deletion if it has active subscriptions
+// BeforeDelete hook for Plan to prevent deletion if it has active
+// subscriptions, whoever they belong to
 func (p *Plan) BeforeDelete(tx *gorm.DB) error {
-	// TODO: Add check for active subscriptions when subscription model is added
+	allOwners := tx.Session(&gorm.Session{NewDB: true, Context: core.WithoutOwnerScope(tx.Statement.Context)})
+	count, err := p.countSubscribers(allOwners)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return core.ErrDeleteForbidden{Message: "plan has active subscriptions"}
+	}
+
 	return nil
 }
 
+// countSubscribers counts the current subscriptions to the plan that db
+// can see
+func (p *Plan) countSubscribers(db *gorm.DB) (count int64, err error) {
+	err = db.Model(&Subscription{}).
+		Where("plan_id = ? AND status IN ?", p.ID, currentSubscriptionStatuses).
+		Count(&count).Error
+	return
+}
+
+// periodEnd returns the end of a billing period of the plan starting at start
+func (p *Plan) periodEnd(start time.Time) time.Time {
+	if p.Interval == "yearly" {
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
 // BeforeDelete hook for Feature to prevent deletion if it's used in any active plans
 func (f *Feature) BeforeDelete(tx *gorm.DB) error {
 	var count int64
@@ -68,3 +149,99 @@ func (f *Feature) BeforeDelete(tx *gorm.DB) error {
 
 	return nil
 }
+
+// BeforeSave hook for Subscription to validate the status, and that saved
+// subscriptions only move along the state machine
+func (s *Subscription) BeforeSave(tx *gorm.DB) error {
+	if _, known := subscriptionTransitions[s.Status]; !known {
+		return core.ErrInvalidField{Field: "status", Message: fmt.Sprintf("unknown status '%s'", s.Status)}
+	}
+	if s.ID == 0 {
+		return nil
+	}
+
+	persisted := &Subscription{}
+	err := tx.Session(&gorm.Session{NewDB: true, Context: core.WithoutOwnerScope(tx.Statement.Context)}).
+		Select("status").Where("id = ?", s.ID).Take(persisted).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if persisted.Status != s.Status && !persisted.CanTransition(s.Status) {
+		return core.Conflict(fmt.Sprintf("subscription cannot move from %s to %s", persisted.Status, s.Status))
+	}
+	return nil
+}
+
+// CanTransition reports whether the subscription may move to the status
+func (s *Subscription) CanTransition(to SubscriptionStatus) bool {
+	for _, allowed := range subscriptionTransitions[s.Status] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the subscription to the status, enforcing the state machine
+func (s *Subscription) Transition(to SubscriptionStatus, now time.Time) error {
+	if !s.CanTransition(to) {
+		return core.Conflict(fmt.Sprintf("subscription cannot move from %s to %s", s.Status, to))
+	}
+	if to == SubscriptionCanceled {
+		s.CanceledAt = &now
+	}
+	s.Status = to
+	return nil
+}
+
+// IsCurrent reports whether the subscription still gives access to its plan
+func (s *Subscription) IsCurrent() bool {
+	for _, status := range currentSubscriptionStatuses {
+		if s.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldExpire reports whether the subscription's period is over and it is
+// not going to be renewed: it was canceled or is set to cancel at period end
+func (s *Subscription) ShouldExpire(now time.Time) bool {
+	if s.Status == SubscriptionExpired || now.Before(s.CurrentPeriodEnd) {
+		return false
+	}
+	return s.Status == SubscriptionCanceled || s.CancelAtPeriodEnd
+}
+
+// Renew moves a subscription whose period is over on: it expires when it is
+// not renewed, and otherwise its trial turns active or its active period is
+// renewed for the plan's interval. Past due subscriptions wait. It reports
+// whether the subscription changed.
+func (s *Subscription) Renew(plan *Plan, now time.Time) (changed bool, err error) {
+	if s.Status == SubscriptionExpired || now.Before(s.CurrentPeriodEnd) {
+		return false, nil
+	}
+	if s.ShouldExpire(now) {
+		return true, s.Transition(SubscriptionExpired, now)
+	}
+
+	switch s.Status {
+	case SubscriptionTrialing:
+		if err = s.Transition(SubscriptionActive, now); err != nil {
+			return
+		}
+	case SubscriptionActive:
+	default:
+		return false, nil
+	}
+	if plan == nil {
+		return false, errors.New("subscription plan not loaded")
+	}
+	for !now.Before(s.CurrentPeriodEnd) {
+		s.CurrentPeriodStart = s.CurrentPeriodEnd
+		s.CurrentPeriodEnd = plan.periodEnd(s.CurrentPeriodStart)
+	}
+	return true, nil
+}
@@ -0,0 +1,59 @@
+package plans
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionTransition(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		from    SubscriptionStatus
+		to      SubscriptionStatus
+		allowed bool
+	}{
+		{SubscriptionTrialing, SubscriptionActive, true},
+		{SubscriptionTrialing, SubscriptionPastDue, false},
+		{SubscriptionActive, SubscriptionPastDue, true},
+		{SubscriptionActive, SubscriptionTrialing, false},
+		{SubscriptionPastDue, SubscriptionActive, true},
+		{SubscriptionActive, SubscriptionCanceled, true},
+		{SubscriptionCanceled, SubscriptionActive, false},
+		{SubscriptionCanceled, SubscriptionExpired, true},
+		{SubscriptionExpired, SubscriptionActive, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" to "+string(tt.to), func(t *testing.T) {
+			subscription := &Subscription{Status: tt.from}
+			err := subscription.Transition(tt.to, now)
+			if tt.allowed {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.to, subscription.Status)
+			} else {
+				assert.Error(t, err)
+				assert.Equal(t, tt.from, subscription.Status)
+			}
+		})
+	}
+
+	subscription := &Subscription{Status: SubscriptionActive}
+	assert.NoError(t, subscription.Transition(SubscriptionCanceled, now))
+	assert.Equal(t, &now, subscription.CanceledAt)
+}
+
+func TestSubscriptionShouldExpire(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	future := now.Add(time.Hour)
+
+	assert.False(t, (&Subscription{Status: SubscriptionActive, CurrentPeriodEnd: past}).ShouldExpire(now))
+	assert.True(t, (&Subscription{Status: SubscriptionActive, CurrentPeriodEnd: past, CancelAtPeriodEnd: true}).ShouldExpire(now))
+	assert.False(t, (&Subscription{Status: SubscriptionActive, CurrentPeriodEnd: future, CancelAtPeriodEnd: true}).ShouldExpire(now))
+	assert.False(t, (&Subscription{Status: SubscriptionTrialing, CurrentPeriodEnd: past}).ShouldExpire(now))
+	assert.True(t, (&Subscription{Status: SubscriptionTrialing, CurrentPeriodEnd: past, CancelAtPeriodEnd: true}).ShouldExpire(now))
+	assert.True(t, (&Subscription{Status: SubscriptionCanceled, CurrentPeriodEnd: past}).ShouldExpire(now))
+	assert.False(t, (&Subscription{Status: SubscriptionExpired, CurrentPeriodEnd: past}).ShouldExpire(now))
+}
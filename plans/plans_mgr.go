@@ -2,17 +2,105 @@ package plans
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/authentication"
+	"github.com/gsarmaonline/goweb/core"
 	"gorm.io/gorm"
 )
 
+// PluginName is the name the plans plugin is registered under
+const PluginName = "plans"
+
+// PermissionPlansWrite allows managing plans and features
+const PermissionPlansWrite = "plans:write"
+
+var (
+	_ core.Plugin             = (*PlanManager)(nil)
+	_ core.PermissionProvider = (*PlanManager)(nil)
+)
+
 type PlanManager struct {
 	ctx       context.Context
 	apiEngine *gin.Engine
 	db        *gorm.DB
+
+	sessMgr  *authentication.SessionManager
+	policy   *core.Policy
+	plans    *core.Resource[Plan]
+	features *core.Resource[Feature]
+
+	now func() time.Time
 }
 
 func NewPlanManager(ctx context.Context, apiEngine *gin.Engine, db *gorm.DB) *PlanManager {
-	return &PlanManager{db: db}
+	return &PlanManager{
+		ctx:       ctx,
+		apiEngine: apiEngine,
+		db:        db,
+		plans:     newPlanResource(db),
+		features:  newFeatureResource(db),
+		now:       nowFunc,
+	}
+}
+
+func (pm *PlanManager) Name() string {
+	return PluginName
+}
+
+// Dependencies of the plans plugin. Authentication is needed for owner
+// checks and entitlements.
+func (pm *PlanManager) Dependencies() []string {
+	return []string{authentication.PluginName}
+}
+
+// Permissions declares the permission managing plans and features requires
+func (pm *PlanManager) Permissions() []core.Permission {
+	return []core.Permission{
+		{Name: PermissionPlansWrite, Description: "Create, update and delete plans and features"},
+	}
+}
+
+// Init looks up the session manager and adds the plan rules to the
+// registry's policy
+func (pm *PlanManager) Init(ctx context.Context, reg *core.Registry) (err error) {
+	if pm.sessMgr, err = core.Lookup[*authentication.SessionManager](reg); err != nil {
+		return
+	}
+	pm.policy = reg.Policy()
+	pm.policy.AddRules(pm.policyRules()...)
+	return
+}
+
+// RegisterRoutes mounts the plan, feature and subscription endpoints. Plan
+// and feature reads are public; creating, updating, deleting and attaching
+// features require the plans:write permission, and updating a plan the
+// plans:update policy action. Subscriptions require an authenticated user.
+func (pm *PlanManager) RegisterRoutes(router gin.IRouter) (err error) {
+	if pm.sessMgr == nil {
+		return errors.New("plans routes need the authentication plugin")
+	}
+	router.GET("/plans", pm.GetPlansHandler)
+	router.GET("/plans/:id", pm.GetPlanHandler)
+	router.GET("/features", pm.GetFeaturesHandler)
+	router.GET("/features/:id", pm.GetFeatureHandler)
+
+	write := router.Group("", pm.sessMgr.AuthMiddleware, pm.sessMgr.RequirePermission(PermissionPlansWrite))
+	write.POST("/plans", pm.CreatePlanHandler)
+	write.PATCH("/plans/:id", pm.policy.Require(ActionPlanUpdate, pm.loadPlan), pm.UpdatePlanHandler)
+	write.DELETE("/plans/:id", pm.DeletePlanHandler)
+	write.POST("/plans/:id/features/:feature_id", pm.AddPlanFeatureHandler)
+	write.DELETE("/plans/:id/features/:feature_id", pm.RemovePlanFeatureHandler)
+	write.POST("/features", pm.CreateFeatureHandler)
+	write.PATCH("/features/:id", pm.UpdateFeatureHandler)
+	write.DELETE("/features/:id", pm.DeleteFeatureHandler)
+
+	pm.registerSubscriptionRoutes(router)
+	return
+}
+
+func (pm *PlanManager) Shutdown(ctx context.Context) (err error) {
+	return
 }
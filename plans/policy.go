@@ -0,0 +1,49 @@
+package plans
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+)
+
+// ActionPlanUpdate is the policy action of editing a plan
+const ActionPlanUpdate = "plans:update"
+
+// policyRules let the owner of a plan, or a superadmin, edit it while it has
+// no current subscribers
+func (pm *PlanManager) policyRules() []core.Rule {
+	return []core.Rule{
+		core.AllowOwner("plan_owner", ActionPlanUpdate),
+		core.AllowPermission("plan_superadmin", core.PermissionAll, ActionPlanUpdate),
+		{
+			Name:    "plan_has_subscribers",
+			Actions: []string{ActionPlanUpdate},
+			Check: func(ctx context.Context, subject core.Subject, action string, resource interface{}) (core.Effect, error) {
+				plan, ok := resource.(*Plan)
+				if !ok {
+					return core.Abstain, nil
+				}
+				count, err := plan.countSubscribers(pm.db.WithContext(core.WithoutOwnerScope(ctx)))
+				if err != nil || count == 0 {
+					return core.Abstain, err
+				}
+				return core.Deny, nil
+			},
+		},
+	}
+}
+
+// loadPlan loads the plan in the URL for policy decisions
+func (pm *PlanManager) loadPlan(c *gin.Context) (interface{}, error) {
+	planID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return nil, core.BadRequest("invalid plan ID")
+	}
+	plan := &Plan{}
+	if err := pm.db.WithContext(c).First(plan, planID).Error; err != nil {
+		return nil, notFound(err, "plan not found")
+	}
+	return plan, nil
+}
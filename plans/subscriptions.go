@@ -0,0 +1,298 @@
+package plans
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
+)
+
+type (
+	SubscribeRequest struct {
+		PlanID    uint `json:"plan_id" binding:"required"`
+		TrialDays int  `json:"trial_days" binding:"min=0,max=365"`
+	}
+
+	ChangePlanRequest struct {
+		PlanID uint `json:"plan_id" binding:"required"`
+	}
+
+	CancelSubscriptionRequest struct {
+		AtPeriodEnd bool `json:"at_period_end"`
+	}
+)
+
+// CurrentSubscription returns the user's current subscription with its plan
+// and the plan's active features. It only reads: subscriptions whose period
+// is over and that are not renewed are left out, and the subscription
+// endpoints or RenewSubscriptions move the others on.
+func (pm *PlanManager) CurrentSubscription(ctx context.Context, userID uint) (subscription *Subscription, err error) {
+	if subscription, err = pm.findCurrentSubscription(pm.db.WithContext(ctx), userID); err != nil {
+		return
+	}
+	err = pm.db.WithContext(ctx).
+		Preload("Plan").
+		Preload("Plan.Features", "is_active = ?", true).
+		First(subscription, subscription.ID).Error
+	return
+}
+
+// RenewSubscriptions expires, activates or renews every subscription whose
+// period is over, see Subscription.Renew. It returns the number of changed
+// subscriptions.
+func (pm *PlanManager) RenewSubscriptions(ctx context.Context) (renewed int64, err error) {
+	return pm.renewDue(pm.db.WithContext(ctx))
+}
+
+// renewDue renews the subscriptions narrowed by scopes whose period is
+// over, through Subscription.Renew and the status checks of BeforeSave
+func (pm *PlanManager) renewDue(tx *gorm.DB, scopes ...func(*gorm.DB) *gorm.DB) (renewed int64, err error) {
+	now := pm.now()
+	var due []Subscription
+	err = tx.Scopes(scopes...).
+		Preload("Plan", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+		Where("status <> ? AND current_period_end <= ?", SubscriptionExpired, now).
+		Find(&due).Error
+	if err != nil {
+		return
+	}
+
+	for idx := range due {
+		subscription := &due[idx]
+		changed, err := subscription.Renew(subscription.Plan, now)
+		if err != nil {
+			return renewed, err
+		}
+		if !changed {
+			continue
+		}
+		subscription.Plan = nil
+		if err := tx.Save(subscription).Error; err != nil {
+			return renewed, err
+		}
+		renewed++
+	}
+	return
+}
+
+// currentSubscription moves the user's subscriptions whose period is over
+// on, then returns the current one
+func (pm *PlanManager) currentSubscription(tx *gorm.DB, userID uint) (*Subscription, error) {
+	if _, err := pm.renewDue(tx, subscriptionsOf(userID)); err != nil {
+		return nil, err
+	}
+	return pm.findCurrentSubscription(tx, userID)
+}
+
+// findCurrentSubscription returns the user's current subscription, leaving
+// out the ones whose period is over and that are set to cancel
+func (pm *PlanManager) findCurrentSubscription(tx *gorm.DB, userID uint) (*Subscription, error) {
+	var subscription Subscription
+	err := tx.Where("user_id = ? AND status IN ?", userID, currentSubscriptionStatuses).
+		Where("NOT (cancel_at_period_end = ? AND current_period_end <= ?)", true, pm.now()).
+		Order("id DESC").
+		First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, core.NotFound("no active subscription")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// subscriptionsOf narrows subscriptions to the user's
+func subscriptionsOf(userID uint) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB { return db.Where("user_id = ?", userID) }
+}
+
+// subscribablePlan loads an active plan for the plan_id field
+func (pm *PlanManager) subscribablePlan(tx *gorm.DB, planID uint) (*Plan, error) {
+	var plan Plan
+	err := tx.Where("is_active = ?", true).First(&plan, planID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, core.ErrInvalidField{Field: "plan_id", Message: "plan not found or inactive"}
+	}
+	return &plan, err
+}
+
+func (pm *PlanManager) respondSubscription(c *gin.Context, status int, userID uint) {
+	if _, err := pm.renewDue(pm.db.WithContext(c), subscriptionsOf(userID)); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	subscription, err := pm.CurrentSubscription(c, userID)
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	c.JSON(status, gin.H{"subscription": subscription})
+}
+
+// SubscribeHandler subscribes the authenticated user to a plan, starting
+// with a trial when trial_days is set
+func (pm *PlanManager) SubscribeHandler(c *gin.Context) {
+	var req SubscribeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	userID := pm.sessMgr.GetUserID(c)
+
+	err := pm.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		_, err := pm.currentSubscription(tx, userID)
+		if err == nil {
+			return core.Conflict("user already has an active subscription")
+		}
+		if !isNotFound(err) {
+			return err
+		}
+
+		plan, err := pm.subscribablePlan(tx, req.PlanID)
+		if err != nil {
+			return err
+		}
+
+		now := pm.now()
+		subscription := &Subscription{
+			UserID:             userID,
+			PlanID:             plan.ID,
+			Status:             SubscriptionActive,
+			CurrentPeriodStart: now,
+			CurrentPeriodEnd:   plan.periodEnd(now),
+		}
+		if req.TrialDays > 0 {
+			subscription.Status = SubscriptionTrialing
+			subscription.CurrentPeriodEnd = now.AddDate(0, 0, req.TrialDays)
+		}
+		return tx.Create(subscription).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	pm.respondSubscription(c, http.StatusCreated, userID)
+}
+
+// GetSubscriptionsHandler returns every subscription of the authenticated user
+func (pm *PlanManager) GetSubscriptionsHandler(c *gin.Context) {
+	var subscriptions []Subscription
+	err := pm.db.WithContext(c).
+		Preload("Plan").
+		Where("user_id = ?", pm.sessMgr.GetUserID(c)).
+		Order("id DESC").
+		Find(&subscriptions).Error
+	if err != nil {
+		core.AbortWithError(c, core.Internal("failed to fetch subscriptions", err))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subscriptions})
+}
+
+// GetCurrentSubscriptionHandler returns the current subscription of the authenticated user
+func (pm *PlanManager) GetCurrentSubscriptionHandler(c *gin.Context) {
+	pm.respondSubscription(c, http.StatusOK, pm.sessMgr.GetUserID(c))
+}
+
+// ChangePlanHandler moves the current subscription to another plan. A new
+// billing period starts when the plan's interval differs.
+func (pm *PlanManager) ChangePlanHandler(c *gin.Context) {
+	var req ChangePlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	userID := pm.sessMgr.GetUserID(c)
+
+	err := pm.db.WithContext(c).Transaction(func(tx *gorm.DB) error {
+		subscription, err := pm.currentSubscription(tx, userID)
+		if err != nil {
+			return err
+		}
+		if subscription.Status == SubscriptionPastDue {
+			return core.Conflict("past due subscriptions can't change plan")
+		}
+		var currentPlan Plan
+		if err := tx.Unscoped().First(&currentPlan, subscription.PlanID).Error; err != nil {
+			return err
+		}
+		plan, err := pm.subscribablePlan(tx, req.PlanID)
+		if err != nil {
+			return err
+		}
+
+		subscription.PlanID = plan.ID
+		subscription.Plan = nil
+		subscription.CancelAtPeriodEnd = false
+		if plan.Interval != currentPlan.Interval && subscription.Status == SubscriptionActive {
+			now := pm.now()
+			subscription.CurrentPeriodStart = now
+			subscription.CurrentPeriodEnd = plan.periodEnd(now)
+		}
+		return tx.Save(subscription).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	pm.respondSubscription(c, http.StatusOK, userID)
+}
+
+// CancelSubscriptionHandler cancels the current subscription, either
+// immediately or at the end of the current period when at_period_end is set
+func (pm *PlanManager) CancelSubscriptionHandler(c *gin.Context) {
+	// The body is optional
+	var req CancelSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		core.AbortWithError(c, err)
+		return
+	}
+	userID := pm.sessMgr.GetUserID(c)
+
+	var subscription *Subscription
+	err := pm.db.WithContext(c).Transaction(func(tx *gorm.DB) (err error) {
+		if subscription, err = pm.currentSubscription(tx, userID); err != nil {
+			return
+		}
+		if req.AtPeriodEnd {
+			subscription.CancelAtPeriodEnd = true
+			return tx.Save(subscription).Error
+		}
+		now := pm.now()
+		if err = subscription.Transition(SubscriptionCanceled, now); err != nil {
+			return
+		}
+		subscription.CurrentPeriodEnd = now
+		return tx.Save(subscription).Error
+	})
+	if err != nil {
+		core.AbortWithError(c, err)
+		return
+	}
+	if req.AtPeriodEnd {
+		pm.respondSubscription(c, http.StatusOK, userID)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription})
+}
+
+// registerSubscriptionRoutes mounts the subscription endpoints for authenticated users
+func (pm *PlanManager) registerSubscriptionRoutes(router gin.IRouter) {
+	subscriptions := router.Group("/subscriptions", pm.sessMgr.AuthMiddleware)
+	subscriptions.GET("", pm.GetSubscriptionsHandler)
+	subscriptions.POST("", pm.SubscribeHandler)
+	subscriptions.GET("/current", pm.GetCurrentSubscriptionHandler)
+	subscriptions.POST("/current/change-plan", pm.ChangePlanHandler)
+	subscriptions.POST("/current/cancel", pm.CancelSubscriptionHandler)
+	subscriptions.GET("/current/entitlements", pm.GetEntitlementsHandler)
+}
+
+// nowFunc is the clock used for subscription periods
+func nowFunc() time.Time {
+	return time.Now()
+}
@@ -2,36 +2,248 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"gorm.io/gorm"
 )
 
 type (
 	Server struct {
 		ctx context.Context
 		cfg *ServerConfig
+		db  *gorm.DB
 
 		apiEngine *gin.Engine
+		registry  *core.Registry
+		migrator  *core.Migrator
+		// plugins holds the registered plugins in dependency order once Setup has run
+		plugins   []core.Plugin
+		setupOnce sync.Once
+		setupErr  error
 	}
 
 	ServerConfig struct {
 		Host string `json:"host"`
 		Port string `json:"port"`
+		// ShutdownTimeout bounds how long in-flight requests are drained for
+		// on shutdown. Defaults to DefaultShutdownTimeout.
+		ShutdownTimeout time.Duration `json:"shutdown_timeout"`
 	}
 )
 
-func NewServer(ctx context.Context, cfg *ServerConfig) (srv *Server, err error) {
+const (
+	DefaultPort            = "8080"
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+func NewServer(ctx context.Context, cfg *ServerConfig, db *gorm.DB) (srv *Server, err error) {
 	srv = &Server{
-		ctx: ctx,
-		cfg: cfg,
+		ctx:      ctx,
+		cfg:      cfg,
+		db:       db,
+		registry: core.NewRegistry(),
+	}
+	if err = core.RegisterOwnership(db); err != nil {
+		return nil, err
 	}
 	srv.apiEngine = gin.Default()
+	srv.apiEngine.Use(core.RequestID(), core.ErrorHandler())
+	return
+}
+
+// APIEngine returns the gin engine the plugins are mounted on
+func (srv *Server) APIEngine() *gin.Engine {
+	return srv.apiEngine
+}
+
+// Registry returns the registry holding the server's plugins
+func (srv *Server) Registry() *core.Registry {
+	return srv.registry
+}
+
+// RegisterPlugin adds plugins to the server. Plugins are set up after their
+// dependencies and shut down in the reverse order.
+func (srv *Server) RegisterPlugin(plugins ...core.Plugin) (err error) {
+	err = srv.registry.Register(plugins...)
+	return
+}
+
+// Migrator returns the migrator holding the migrations of every plugin in
+// dependency order. It is used by Setup and can be used directly to roll
+// back or inspect migrations.
+func (srv *Server) Migrator() (migrator *core.Migrator, err error) {
+	if srv.migrator != nil {
+		return srv.migrator, nil
+	}
+	plugins, err := srv.registry.Resolve()
+	if err != nil {
+		return
+	}
+	migrator = core.NewMigrator(srv.db)
+	for _, plugin := range plugins {
+		if err = migrator.Register(plugin.Name(), plugin.Migrations()...); err != nil {
+			return nil, err
+		}
+	}
+	srv.migrator = migrator
+	return
+}
+
+// Migrate applies the pending migrations of every plugin
+func (srv *Server) Migrate(ctx context.Context) (err error) {
+	migrator, err := srv.Migrator()
+	if err != nil {
+		return
+	}
+	err = migrator.Up(ctx)
+	return
+}
+
+// Rollback rolls back the last steps applied migrations of a plugin
+func (srv *Server) Rollback(ctx context.Context, plugin string, steps int) (err error) {
+	migrator, err := srv.Migrator()
+	if err != nil {
+		return
+	}
+	err = migrator.Down(ctx, plugin, steps)
+	return
+}
+
+// MigrationStatus reports the migrations of every plugin and whether they are applied
+func (srv *Server) MigrationStatus(ctx context.Context) (statuses []core.MigrationStatus, err error) {
+	migrator, err := srv.Migrator()
+	if err != nil {
+		return
+	}
+	statuses, err = migrator.Status(ctx)
+	return
+}
+
+// Setup resolves the plugin dependency order, then applies the migrations
+// of every plugin, initialises them and mounts their routes. It is called
+// by Run and Serve and only does the work once: later calls return the
+// first call's error. When it fails, the plugins already initialised are
+// shut down in the reverse order.
+func (srv *Server) Setup() (err error) {
+	srv.setupOnce.Do(func() {
+		srv.setupErr = srv.setup()
+	})
+	err = srv.setupErr
 	return
 }
 
+func (srv *Server) setup() (err error) {
+	plugins, err := srv.registry.Resolve()
+	if err != nil {
+		return
+	}
+	if err = srv.Migrate(srv.ctx); err != nil {
+		return
+	}
+	for idx, plugin := range plugins {
+		if err = plugin.Init(srv.ctx, srv.registry); err != nil {
+			err = fmt.Errorf("initialising %s: %w", plugin.Name(), err)
+			return errors.Join(err, shutdownPlugins(srv.ctx, plugins[:idx]))
+		}
+	}
+	for _, plugin := range plugins {
+		if err = plugin.RegisterRoutes(srv.apiEngine); err != nil {
+			err = fmt.Errorf("registering routes for %s: %w", plugin.Name(), err)
+			return errors.Join(err, shutdownPlugins(srv.ctx, plugins))
+		}
+	}
+	srv.plugins = plugins
+	return
+}
+
+// Shutdown stops every plugin in the reverse order of setup. All plugins
+// are shut down even if some of them fail; the first error is returned.
+func (srv *Server) Shutdown(ctx context.Context) (err error) {
+	err = shutdownPlugins(ctx, srv.plugins)
+	return
+}
+
+func shutdownPlugins(ctx context.Context, plugins []core.Plugin) (err error) {
+	for idx := len(plugins) - 1; idx >= 0; idx-- {
+		plugin := plugins[idx]
+		if shutdownErr := plugin.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = fmt.Errorf("shutting down %s: %w", plugin.Name(), shutdownErr)
+		}
+	}
+	return
+}
+
+// Addr returns the address the server listens on
+func (srv *Server) Addr() string {
+	port := srv.cfg.Port
+	if port == "" {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(srv.cfg.Host, port)
+}
+
+// Run sets up the plugins and serves on the configured address until the
+// server's context is cancelled or SIGINT/SIGTERM is received
 func (srv *Server) Run() (err error) {
-	if err = srv.apiEngine.Run(); err != nil {
+	if err = srv.Setup(); err != nil {
+		return
+	}
+	listener, err := net.Listen("tcp", srv.Addr())
+	if err != nil {
 		return
 	}
+	err = srv.Serve(listener)
+	return
+}
+
+// Serve sets up the plugins and serves on the listener until the server's
+// context is cancelled or SIGINT/SIGTERM is received. It then stops accepting
+// connections, drains in-flight requests for at most the configured shutdown
+// timeout and shuts the plugins down.
+func (srv *Server) Serve(listener net.Listener) (err error) {
+	if err = srv.Setup(); err != nil {
+		listener.Close()
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(srv.ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	httpServer := &http.Server{Handler: srv.apiEngine}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.Serve(listener)
+	}()
+
+	select {
+	case err = <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+	}
+
+	timeout := srv.cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if shutdownErr := httpServer.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = fmt.Errorf("draining requests: %w", shutdownErr)
+	}
+	if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
 	return
 }
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gsarmaonline/goweb/core"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type testPlugin struct {
+	name     string
+	deps     []string
+	events   *[]string
+	handler  gin.HandlerFunc
+	shutdown bool
+	// initErr and routesErr fail Init and RegisterRoutes
+	initErr   error
+	routesErr error
+}
+
+func (p *testPlugin) Name() string                 { return p.name }
+func (p *testPlugin) Dependencies() []string       { return p.deps }
+func (p *testPlugin) Migrations() []core.Migration { return nil }
+
+func (p *testPlugin) Init(context.Context, *core.Registry) error {
+	*p.events = append(*p.events, "init "+p.name)
+	return p.initErr
+}
+
+func (p *testPlugin) RegisterRoutes(router gin.IRouter) error {
+	if p.handler != nil {
+		router.GET("/"+p.name, p.handler)
+	}
+	return p.routesErr
+}
+
+func (p *testPlugin) Shutdown(context.Context) error {
+	*p.events = append(*p.events, "shutdown "+p.name)
+	p.shutdown = true
+	return nil
+}
+
+func setupTestServer(t *testing.T, ctx context.Context, cfg *ServerConfig) *Server {
+	gin.SetMode(gin.TestMode)
+	db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to test database: %v", err)
+	}
+	srv, err := NewServer(ctx, cfg, db)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	return srv
+}
+
+func TestSetupOrdersPlugins(t *testing.T) {
+	srv := setupTestServer(t, context.Background(), &ServerConfig{})
+	events := []string{}
+	assert.NoError(t, srv.RegisterPlugin(
+		&testPlugin{name: "plans", deps: []string{"authentication"}, events: &events},
+		&testPlugin{name: "authentication", events: &events},
+	))
+
+	assert.NoError(t, srv.Setup())
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	assert.Equal(t, []string{
+		"init authentication",
+		"init plans",
+		"shutdown plans",
+		"shutdown authentication",
+	}, events)
+}
+
+func TestSetupShutsDownInitialisedPluginsOnFailure(t *testing.T) {
+	errFailed := errors.New("failed")
+	handler := func(c *gin.Context) { c.Status(http.StatusOK) }
+	tests := []struct {
+		name    string
+		plans   *testPlugin
+		wantErr string
+		events  []string
+	}{
+		{
+			name:    "init fails",
+			plans:   &testPlugin{name: "plans", deps: []string{"authentication"}, initErr: errFailed},
+			wantErr: "initialising plans: failed",
+			events:  []string{"init authentication", "init plans", "shutdown authentication"},
+		},
+		{
+			name:    "registering routes fails",
+			plans:   &testPlugin{name: "plans", deps: []string{"authentication"}, routesErr: errFailed},
+			wantErr: "registering routes for plans: failed",
+			events:  []string{"init authentication", "init plans", "shutdown plans", "shutdown authentication"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := setupTestServer(t, context.Background(), &ServerConfig{})
+			events := []string{}
+			tt.plans.events = &events
+			assert.NoError(t, srv.RegisterPlugin(
+				tt.plans,
+				&testPlugin{name: "authentication", events: &events, handler: handler},
+			))
+
+			err := srv.Setup()
+			assert.ErrorIs(t, err, errFailed)
+			assert.EqualError(t, err, tt.wantErr)
+			assert.Equal(t, tt.events, events)
+
+			// Retrying returns the error without registering routes twice
+			assert.NotPanics(t, func() {
+				assert.Equal(t, err, srv.Setup())
+			})
+			assert.NoError(t, srv.Shutdown(context.Background()))
+			assert.Equal(t, tt.events, events)
+		})
+	}
+}
+
+func TestAddr(t *testing.T) {
+	srv := setupTestServer(t, context.Background(), &ServerConfig{Host: "127.0.0.1"})
+	assert.Equal(t, "127.0.0.1:8080", srv.Addr())
+
+	srv = setupTestServer(t, context.Background(), &ServerConfig{Host: "0.0.0.0", Port: "9000"})
+	assert.Equal(t, "0.0.0.0:9000", srv.Addr())
+}
+
+func TestServeDrainsRequestsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := setupTestServer(t, ctx, &ServerConfig{ShutdownTimeout: 5 * time.Second})
+
+	requestStarted := make(chan struct{})
+	events := []string{}
+	plugin := &testPlugin{
+		name:   "slow",
+		events: &events,
+		handler: func(c *gin.Context) {
+			close(requestStarted)
+			time.Sleep(200 * time.Millisecond)
+			c.Status(http.StatusOK)
+		},
+	}
+	assert.NoError(t, srv.RegisterPlugin(plugin))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+
+	<-requestStarted
+	cancel()
+
+	assert.Equal(t, http.StatusOK, <-responses)
+	assert.NoError(t, <-served)
+	assert.True(t, plugin.shutdown)
+
+	_, err = http.Get("http://" + listener.Addr().String() + "/slow")
+	assert.Error(t, err)
+}